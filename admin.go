@@ -0,0 +1,267 @@
+package ungzip
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func init() {
+	caddy.RegisterModule(adminAPI{})
+}
+
+// adminAPI exposes the state of the response_ungzip handlers on the
+// admin endpoint:
+//
+//	GET /ungzip/health     health of each handler; 503 if any is degraded
+//	GET /ungzip/decisions  recent decisions of each handler, if kept
+//	GET /ungzip/pools      buffer pool statistics
+//	GET /ungzip/config     effective configuration of each handler
+type adminAPI struct{}
+
+// CaddyModule returns the Caddy module information.
+func (adminAPI) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "admin.api.ungzip",
+		New: func() caddy.Module { return new(adminAPI) },
+	}
+}
+
+// Routes implements caddy.AdminRouter.
+func (a adminAPI) Routes() []caddy.AdminRoute {
+	return []caddy.AdminRoute{
+		{Pattern: "/ungzip/health", Handler: caddy.AdminHandlerFunc(a.handleHealth)},
+		{Pattern: "/ungzip/decisions", Handler: caddy.AdminHandlerFunc(a.handleDecisions)},
+		{Pattern: "/ungzip/pools", Handler: caddy.AdminHandlerFunc(a.handlePools)},
+		{Pattern: "/ungzip/config", Handler: caddy.AdminHandlerFunc(a.handleConfig)},
+	}
+}
+
+func (adminAPI) handleHealth(w http.ResponseWriter, r *http.Request) error {
+	if err := requireGet(r); err != nil {
+		return err
+	}
+	reports := []healthReport{}
+	status := http.StatusOK
+	eachInstance(func(h *ResponseUngzip) {
+		report := h.health()
+		if !report.Healthy {
+			status = http.StatusServiceUnavailable
+		}
+		reports = append(reports, report)
+	})
+	return writeJSON(w, status, reports)
+}
+
+// handlerDecisions lists the recent decisions of one handler.
+type handlerDecisions struct {
+	MetricsLabel string     `json:"metrics_label,omitempty"`
+	Paths        []string   `json:"paths,omitempty"`
+	Decisions    []decision `json:"decisions"`
+}
+
+func (adminAPI) handleDecisions(w http.ResponseWriter, r *http.Request) error {
+	if err := requireGet(r); err != nil {
+		return err
+	}
+	lists := []handlerDecisions{}
+	eachInstance(func(h *ResponseUngzip) {
+		if h.decisions == nil {
+			return
+		}
+		lists = append(lists, handlerDecisions{
+			MetricsLabel: h.MetricsLabel,
+			Paths:        h.Paths,
+			Decisions:    h.decisions.list(),
+		})
+	})
+	return writeJSON(w, http.StatusOK, lists)
+}
+
+func (adminAPI) handlePools(w http.ResponseWriter, r *http.Request) error {
+	if err := requireGet(r); err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusOK, map[string]bufferPoolStats{
+		"buffers": bufPool.stats(),
+	})
+}
+
+// handleConfig lists the configuration of each response_ungzip,
+// request_ungzip and decode handler as it was loaded, with the defaults
+// filled in at provision time, so that operators can confirm what is in
+// effect after global options, presets and environment defaults are
+// applied. Each is a module object named by its handler key, as in the
+// config. Secrets are redacted.
+func (adminAPI) handleConfig(w http.ResponseWriter, r *http.Request) error {
+	if err := requireGet(r); err != nil {
+		return err
+	}
+	list := []json.RawMessage{}
+	eachConfig(func(h configSource) {
+		list = append(list, caddyconfig.JSONModuleObject(h.effectiveConfig(), "handler", h.CaddyModule().ID.Name(), nil))
+	})
+	return writeJSON(w, http.StatusOK, list)
+}
+
+// configSource is a handler listed by /ungzip/config.
+type configSource interface {
+	caddy.Module
+	effectiveConfig() any
+}
+
+// configs holds the provisioned handlers listed by /ungzip/config.
+var configs = struct {
+	sync.Mutex
+	handlers map[configSource]struct{}
+}{handlers: make(map[configSource]struct{})}
+
+func registerConfig(h configSource) {
+	configs.Lock()
+	configs.handlers[h] = struct{}{}
+	configs.Unlock()
+}
+
+func unregisterConfig(h configSource) {
+	configs.Lock()
+	delete(configs.handlers, h)
+	configs.Unlock()
+}
+
+// eachConfig calls fn for every handler listed by /ungzip/config.
+func eachConfig(fn func(h configSource)) {
+	configs.Lock()
+	defer configs.Unlock()
+	for h := range configs.handlers {
+		fn(h)
+	}
+}
+
+// effectiveConfig returns a copy of the configuration of r that is safe
+// to show. Values that may hold secrets, some of them from environment
+// placeholders replaced at load time, are redacted: the verify key, the
+// values of add_headers, the credentials and query of the shadow URL,
+// the matchers of shadow routes, and the configuration of filter,
+// predicate and shadow route handler modules, of which only the names
+// are kept.
+func (r *ResponseUngzip) effectiveConfig() any {
+	return r.redactedConfig()
+}
+
+// redactedConfig is effectiveConfig with the type of r.
+func (r *ResponseUngzip) redactedConfig() ResponseUngzip {
+	config := *r
+	if config.Verify != nil && config.Verify.Key != "" {
+		verify := *config.Verify
+		verify.Key = redacted
+		config.Verify = &verify
+	}
+	if config.AddHeaders != nil {
+		config.AddHeaders = make(http.Header, len(r.AddHeaders))
+		for name := range r.AddHeaders {
+			config.AddHeaders[name] = []string{redacted}
+		}
+	}
+	if config.Shadow != nil {
+		shadow := *config.Shadow
+		if shadow.URL != "" {
+			shadow.URL = redacted
+			if u, err := url.Parse(config.Shadow.URL); err == nil {
+				if u.RawQuery != "" {
+					u.RawQuery = redacted
+				}
+				shadow.URL = u.Redacted()
+			}
+		}
+		if shadow.Routes != nil {
+			shadow.Routes = make(caddyhttp.RouteList, len(shadow.routes))
+			for i, route := range shadow.routes {
+				shadow.Routes[i] = caddyhttp.Route{
+					Group:       route.Group,
+					HandlersRaw: redactModules(route.HandlersRaw, "handler"),
+					Terminal:    route.Terminal,
+				}
+			}
+		}
+		config.Shadow = &shadow
+	}
+	config.FiltersRaw = redactModules(r.filtersRaw, "filter")
+	config.PredicatesRaw = redactModules(r.predicatesRaw, "predicate")
+	return config
+}
+
+// effectiveConfig returns a copy of the configuration of r. None of its
+// options hold secrets.
+func (r *RequestUngzip) effectiveConfig() any {
+	return *r
+}
+
+// decodeConfig is the configuration of a decode handler as
+// /ungzip/config lists it: its own options, and those of the handlers
+// it runs for either direction.
+type decodeConfig struct {
+	Decode
+	Request  *RequestUngzip  `json:"request,omitempty"`
+	Response *ResponseUngzip `json:"response,omitempty"`
+}
+
+// effectiveConfig returns the configuration of dec, with that of the
+// handlers it runs redacted like theirs.
+func (dec *Decode) effectiveConfig() any {
+	config := decodeConfig{Decode: *dec}
+	if dec.request != nil {
+		request := *dec.request
+		config.Request = &request
+	}
+	if dec.response != nil {
+		response := dec.response.redactedConfig()
+		config.Response = &response
+	}
+	return config
+}
+
+// redacted stands in for the values effectiveConfig hides.
+const redacted = "REDACTED"
+
+// redactModules returns the module objects in raw, whose names are in
+// inlineKey, with only their names.
+func redactModules(raw []json.RawMessage, inlineKey string) []json.RawMessage {
+	if raw == nil {
+		return nil
+	}
+	names := make([]json.RawMessage, 0, len(raw))
+	for _, module := range raw {
+		var fields map[string]json.RawMessage
+		_ = json.Unmarshal(module, &fields)
+		name, _ := json.Marshal(map[string]json.RawMessage{inlineKey: fields[inlineKey]})
+		names = append(names, name)
+	}
+	return names
+}
+
+func requireGet(r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+	return nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) error {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	return json.NewEncoder(w).Encode(v)
+}
+
+// Interface guards
+var (
+	_ caddy.AdminRouter = (*adminAPI)(nil)
+)
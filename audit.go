@@ -0,0 +1,24 @@
+package ungzip
+
+import (
+	"encoding/hex"
+	"net/http"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// audit records a transformed response to the audit logger. The
+// checksum is the SHA-256 of the decompressed body exactly as sent to
+// the client.
+func (r ResponseUngzip) audit(req *http.Request, compressedSize, decompressedSize int, checksum []byte, elapsed time.Duration) {
+	r.auditLogger.Info("transformed response",
+		zap.String("method", req.Method),
+		zap.String("host", req.Host),
+		zap.String("uri", req.RequestURI),
+		zap.Int("compressed_size", compressedSize),
+		zap.Int("decompressed_size", decompressedSize),
+		zap.Duration("duration", elapsed),
+		zap.String("sha256", hex.EncodeToString(checksum)),
+	)
+}
@@ -0,0 +1,117 @@
+package ungzip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+
+	"github.com/klauspost/compress/gzip"
+)
+
+// bgzfMaxBlock is the most a BGZF block decompresses to.
+const bgzfMaxBlock = 1 << 16
+
+var errBGZFBlock = errors.New("bgzf: block decompresses to more than 64KiB")
+
+// bgzfBlocks splits src into its blocks if it is in the BGZF format of
+// bgzip: a series of gzip members of at most 64KiB, each of which
+// records its compressed size in a "BC" extra subfield. Blocks can
+// then be decompressed independently, and so in parallel.
+func bgzfBlocks(src []byte) ([][]byte, bool) {
+	var blocks [][]byte
+	for len(src) > 0 {
+		size, ok := bgzfBlockSize(src)
+		if !ok || size > len(src) {
+			return nil, false
+		}
+		blocks = append(blocks, src[:size])
+		src = src[size:]
+	}
+	return blocks, len(blocks) > 0
+}
+
+// bgzfBlockSize returns the size of the BGZF block at the start of src.
+func bgzfBlockSize(src []byte) (int, bool) {
+	// ID1 ID2 CM FLG with FEXTRA set, then MTIME XFL OS XLEN
+	if len(src) < 12 || src[0] != 0x1f || src[1] != 0x8b || src[2] != 8 || src[3]&4 == 0 {
+		return 0, false
+	}
+	xlen := int(binary.LittleEndian.Uint16(src[10:]))
+	if len(src) < 12+xlen {
+		return 0, false
+	}
+	extra := src[12 : 12+xlen]
+	for len(extra) >= 4 {
+		slen := int(binary.LittleEndian.Uint16(extra[2:]))
+		if len(extra) < 4+slen {
+			return 0, false
+		}
+		if extra[0] == 'B' && extra[1] == 'C' && slen == 2 {
+			return int(binary.LittleEndian.Uint16(extra[4:])) + 1, true
+		}
+		extra = extra[4+slen:]
+	}
+	return 0, false
+}
+
+// decodeBGZF decompresses blocks to dst with up to workers blocks being
+// decompressed at once, writing them out in order. The limits are
+// checked after each batch, which decompresses to at most workers
+// times 64KiB.
+func decodeBGZF(dst io.Writer, blocks [][]byte, workers int, limits decodeLimits) error {
+	out := make([][]byte, workers)
+	errs := make([]error, workers)
+	deadline := limits.deadline()
+	var input, output int64
+	for len(blocks) > 0 {
+		batch := blocks[:min(workers, len(blocks))]
+		blocks = blocks[len(batch):]
+
+		var wg sync.WaitGroup
+		wg.Add(len(batch))
+		for i, block := range batch {
+			go func() {
+				defer wg.Done()
+				out[i], errs[i] = decodeBGZFBlock(block, out[i][:0])
+			}()
+		}
+		wg.Wait()
+
+		for i, block := range batch {
+			if errs[i] != nil {
+				return errs[i]
+			}
+			input += int64(len(block))
+			output += int64(len(out[i]))
+		}
+		if err := limits.check(input, output, deadline); err != nil {
+			return err
+		}
+		for i := range batch {
+			if _, err := dst.Write(out[i]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func decodeBGZFBlock(block, buf []byte) ([]byte, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(block))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	zr.Multistream(false)
+	out := bytes.NewBuffer(buf)
+	n, err := out.ReadFrom(io.LimitReader(zr, bgzfMaxBlock+1))
+	if err != nil {
+		return nil, err
+	}
+	if n > bgzfMaxBlock {
+		return nil, errBGZFBlock
+	}
+	return out.Bytes(), nil
+}
@@ -0,0 +1,135 @@
+package ungzip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/gzip"
+)
+
+// bgzfBlock compresses data into a BGZF block, with the extra field
+// given, into which the block size is written at offset bcAt.
+func bgzfBlock(t testing.TB, data []byte, extra []byte, bcAt int) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Extra = extra
+	if _, err := zw.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	block := buf.Bytes()
+	if bcAt >= 0 {
+		binary.LittleEndian.PutUint16(block[12+bcAt:], uint16(len(block)-1))
+	}
+	return block
+}
+
+func TestBGZFBlocks(t *testing.T) {
+	bc := []byte{'B', 'C', 2, 0, 0, 0}
+	block := func(data string) []byte { return bgzfBlock(t, []byte(data), bc, 4) }
+	one, two, three := block("one"), block("two"), block("three")
+	// the empty block bgzip ends files with
+	eof := block("")
+	plain := gzipped(t, []byte("plain"))
+	otherFirst := bgzfBlock(t, []byte("other"), []byte{'X', 'Y', 1, 0, 9, 'B', 'C', 2, 0, 0, 0}, 9)
+	wrongLength := bgzfBlock(t, []byte("wrong"), []byte{'B', 'C', 3, 0, 0, 0, 0}, -1)
+	noBC := bgzfBlock(t, []byte("none"), []byte{'X', 'Y', 2, 0, 0, 0}, -1)
+	badSubfield := bgzfBlock(t, []byte("bad"), []byte{'B', 'C', 9, 0, 0, 0}, -1)
+	short := append([]byte(nil), one...)
+	binary.LittleEndian.PutUint16(short[16:], uint16(len(one)))
+
+	cat := func(blocks ...[]byte) []byte { return bytes.Join(blocks, nil) }
+	for _, tc := range []struct {
+		name   string
+		src    []byte
+		blocks [][]byte
+	}{
+		{name: "empty"},
+		{name: "one block", src: one, blocks: [][]byte{one}},
+		{name: "several blocks", src: cat(one, two, three, eof), blocks: [][]byte{one, two, three, eof}},
+		{name: "after another subfield", src: cat(otherFirst, one), blocks: [][]byte{otherFirst, one}},
+		{name: "plain gzip", src: plain},
+		{name: "plain gzip after a block", src: cat(one, plain)},
+		{name: "no BC subfield", src: noBC},
+		{name: "BC subfield of the wrong length", src: wrongLength},
+		{name: "subfield past the extra field", src: badSubfield},
+		{name: "truncated block", src: one[:len(one)-1]},
+		{name: "truncated second block", src: cat(one, two[:len(two)-8])},
+		{name: "truncated header", src: one[:11]},
+		{name: "truncated extra field", src: one[:14]},
+		{name: "size past the end", src: cat(short)},
+		{name: "trailing garbage", src: cat(one, []byte{0x1f, 0x8b})},
+		{name: "not gzip", src: []byte(strings.Repeat("x", 32))},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			blocks, ok := bgzfBlocks(tc.src)
+			if ok != (tc.blocks != nil) {
+				t.Fatalf("got ok %v", ok)
+			}
+			if len(blocks) != len(tc.blocks) {
+				t.Fatalf("got %d blocks, want %d", len(blocks), len(tc.blocks))
+			}
+			for i := range blocks {
+				if !bytes.Equal(blocks[i], tc.blocks[i]) {
+					t.Errorf("block %d: got %d bytes, want %d", i, len(blocks[i]), len(tc.blocks[i]))
+				}
+			}
+		})
+	}
+}
+
+func TestDecodeBGZF(t *testing.T) {
+	bc := []byte{'B', 'C', 2, 0, 0, 0}
+	var blocks [][]byte
+	var want []byte
+	for i := range 5 {
+		data := bytes.Repeat([]byte{byte('a' + i)}, bgzfMaxBlock-i)
+		blocks = append(blocks, bgzfBlock(t, data, bc, 4))
+		want = append(want, data...)
+	}
+	full := bgzfBlock(t, make([]byte, bgzfMaxBlock), bc, 4)
+	oversized := bgzfBlock(t, make([]byte, bgzfMaxBlock+1), bc, 4)
+	corrupt := append([]byte(nil), blocks[0]...)
+	corrupt[len(corrupt)-5] ^= 0xff
+
+	for _, tc := range []struct {
+		name    string
+		blocks  [][]byte
+		workers int
+		limits  decodeLimits
+		want    []byte
+		err     error
+	}{
+		{name: "one worker", blocks: blocks, workers: 1, want: want},
+		{name: "fewer workers than blocks", blocks: blocks, workers: 2, want: want},
+		{name: "more workers than blocks", blocks: blocks, workers: 8, want: want},
+		{name: "block at the limit", blocks: [][]byte{full}, workers: 1, want: make([]byte, bgzfMaxBlock)},
+		{name: "oversized block", blocks: [][]byte{blocks[0], oversized}, workers: 2, err: errBGZFBlock},
+		{name: "output limit", blocks: blocks, workers: 1, limits: decodeLimits{output: 2 * bgzfMaxBlock}, err: errOutputLimit},
+		{name: "truncated block", blocks: [][]byte{blocks[0][:len(blocks[0])-4]}, workers: 1},
+		{name: "corrupt block", blocks: [][]byte{corrupt}, workers: 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var out bytes.Buffer
+			err := decodeBGZF(&out, tc.blocks, tc.workers, tc.limits)
+			if tc.want == nil {
+				if err == nil || (tc.err != nil && !errors.Is(err, tc.err)) {
+					t.Fatalf("got %v, want %v", err, tc.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(out.Bytes(), tc.want) {
+				t.Errorf("got %d bytes, want %d", out.Len(), len(tc.want))
+			}
+		})
+	}
+}
@@ -0,0 +1,29 @@
+// Package brotli adds the br content coding to the response_ungzip
+// and request_ungzip handlers. It lives in its own module so that the
+// decoder is only compiled into Caddy builds that ask for it:
+//
+//	xcaddy build --with github.com/danielballan/caddy-ungzip/brotli
+//
+// and is then enabled with the encodings option:
+//
+//	ungzip {
+//		encodings gzip br
+//	}
+package brotli
+
+import (
+	"io"
+
+	"github.com/andybalholm/brotli"
+
+	ungzip "github.com/danielballan/caddy-ungzip"
+)
+
+func init() {
+	// brotli streams have no magic number to recognize them by
+	ungzip.RegisterDecoder("br", ungzip.Decoder{
+		NewReader: func(src io.Reader) (io.ReadCloser, error) {
+			return io.NopCloser(brotli.NewReader(src)), nil
+		},
+	})
+}
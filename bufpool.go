@@ -0,0 +1,93 @@
+package ungzip
+
+import (
+	"bytes"
+	"expvar"
+	"sync"
+	"sync/atomic"
+)
+
+// bufferPool is a pool of buffers for response bodies that keeps
+// statistics on its use, to help tune memory settings.
+type bufferPool struct {
+	pool   sync.Pool
+	gets   atomic.Int64
+	puts   atomic.Int64
+	misses atomic.Int64
+
+	// number of buffers returned, by capacity
+	classes [len(bufferClasses) + 1]atomic.Int64
+}
+
+// bufferClasses are the upper bounds of the buffer size classes.
+var bufferClasses = [...]struct {
+	name string
+	size int
+}{
+	{"4KiB", 4 << 10},
+	{"64KiB", 64 << 10},
+	{"1MiB", 1 << 20},
+	{"16MiB", 16 << 20},
+}
+
+var bufPool = newBufferPool()
+
+func newBufferPool() *bufferPool {
+	p := new(bufferPool)
+	p.pool.New = func() any {
+		p.misses.Add(1)
+		return new(bytes.Buffer)
+	}
+	return p
+}
+
+// get returns an empty buffer.
+func (p *bufferPool) get() *bytes.Buffer {
+	p.gets.Add(1)
+	buf := p.pool.Get().(*bytes.Buffer)
+	buf.Reset()
+	return buf
+}
+
+// put returns buf to the pool.
+func (p *bufferPool) put(buf *bytes.Buffer) {
+	p.puts.Add(1)
+	class := len(bufferClasses)
+	for i, c := range bufferClasses {
+		if buf.Cap() <= c.size {
+			class = i
+			break
+		}
+	}
+	p.classes[class].Add(1)
+	p.pool.Put(buf)
+}
+
+// bufferPoolStats is a snapshot of a bufferPool's statistics.
+type bufferPoolStats struct {
+	Gets   int64 `json:"gets"`
+	Puts   int64 `json:"puts"`
+	Misses int64 `json:"misses"`
+
+	// Number of buffers returned to the pool, by capacity
+	SizeClasses map[string]int64 `json:"size_classes"`
+}
+
+func (p *bufferPool) stats() bufferPoolStats {
+	stats := bufferPoolStats{
+		Gets:        p.gets.Load(),
+		Puts:        p.puts.Load(),
+		Misses:      p.misses.Load(),
+		SizeClasses: make(map[string]int64, len(p.classes)),
+	}
+	for i, c := range bufferClasses {
+		stats.SizeClasses["<="+c.name] = p.classes[i].Load()
+	}
+	stats.SizeClasses[">"+bufferClasses[len(bufferClasses)-1].name] = p.classes[len(bufferClasses)].Load()
+	return stats
+}
+
+func init() {
+	// served by the admin endpoint at /debug/vars
+	expvar.Publish("ungzip_buffer_pool", expvar.Func(func() any { return bufPool.stats() }))
+}
@@ -0,0 +1,76 @@
+package ungzip
+
+import (
+	"container/list"
+	"sync"
+)
+
+// lruCache holds byte slices up to a total size, evicting the least
+// recently used entries first. It is safe for concurrent use.
+type lruCache struct {
+	mu      sync.Mutex
+	maxSize int64
+	size    int64
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+type lruEntry struct {
+	key   string
+	value []byte
+}
+
+func newLRUCache(maxSize int64) *lruCache {
+	return &lruCache{
+		maxSize: maxSize,
+		order:   list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+func (c *lruCache) get(key string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(el)
+	return el.Value.(*lruEntry).value, true
+}
+
+// put stores value under key. value must not be modified afterwards.
+// Values larger than the whole cache are not stored.
+func (c *lruCache) put(key string, value []byte) {
+	size := int64(len(value))
+	if size > c.maxSize {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[key]; ok {
+		c.size -= int64(len(el.Value.(*lruEntry).value))
+		c.order.Remove(el)
+		delete(c.entries, key)
+	}
+	for c.size+size > c.maxSize {
+		oldest := c.order.Back()
+		entry := oldest.Value.(*lruEntry)
+		c.size -= int64(len(entry.value))
+		c.order.Remove(oldest)
+		delete(c.entries, entry.key)
+	}
+	c.entries[key] = c.order.PushFront(&lruEntry{key: key, value: value})
+	c.size += size
+}
+
+// remove drops the entry stored under key, if any.
+func (c *lruCache) remove(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[key]; ok {
+		c.size -= int64(len(el.Value.(*lruEntry).value))
+		c.order.Remove(el)
+		delete(c.entries, key)
+	}
+}
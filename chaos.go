@@ -0,0 +1,66 @@
+package ungzip
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+var errChaos = errors.New("decode failure injected by chaos")
+
+// Chaos injects failures and latency into the decoding of responses, so
+// that alerting, failure_rate_threshold health reporting and on_error
+// fallbacks can be checked before a real incident. Injected failures go
+// through the same path as real ones: they are logged, counted,
+// quarantined and handled per on_error. It is for test environments
+// only.
+type Chaos struct {
+	// Fraction of responses, between 0 and 1, whose decoding fails
+	FailureRate float64 `json:"failure_rate,omitempty"`
+
+	// Delay to add before decoding responses
+	Latency caddy.Duration `json:"latency,omitempty"`
+
+	// Fraction of responses, between 0 and 1, that get the delay
+	// Default: 1
+	LatencyRate float64 `json:"latency_rate,omitempty"`
+}
+
+func (c *Chaos) provision() {
+	if c.LatencyRate == 0 {
+		c.LatencyRate = 1
+	}
+}
+
+func (c *Chaos) validate() error {
+	if c.FailureRate < 0 || c.FailureRate > 1 || c.LatencyRate < 0 || c.LatencyRate > 1 {
+		return fmt.Errorf("chaos failure_rate and latency_rate must be between 0 and 1")
+	}
+	if c.Latency < 0 {
+		return fmt.Errorf("chaos latency cannot be negative")
+	}
+	return nil
+}
+
+// inject delays and fails the decode of a response as configured,
+// returning errChaos for a failure, or the error of ctx if it ends
+// during the delay.
+func (c *Chaos) inject(ctx context.Context) error {
+	if c.Latency > 0 && rand.Float64() < c.LatencyRate {
+		timer := time.NewTimer(time.Duration(c.Latency))
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	if c.FailureRate > 0 && rand.Float64() < c.FailureRate {
+		return errChaos
+	}
+	return nil
+}
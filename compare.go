@@ -0,0 +1,48 @@
+package ungzip
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"math/rand/v2"
+	"net/http"
+
+	"go.uber.org/zap"
+)
+
+// compare checks, for a sample of compare_sample_rate of responses,
+// the body of the response to req as sent against decoded, the
+// decompressed and filtered body it was made from: a recompressed body
+// must decode back to it, and a JSON one must parse. Divergences are
+// logged and counted; the response has been flushed to the client
+// before, so that it does not wait for the check.
+func (r ResponseUngzip) compare(req *http.Request, header http.Header, decoded, sent []byte) {
+	if rand.Float64() >= r.CompareSampleRate {
+		return
+	}
+	result := "match"
+	if enc := header.Get("Content-Encoding"); enc != "" {
+		reader, err := r.newReader([]string{enc}, bytes.NewReader(sent))
+		if err == nil {
+			var roundTrip bytes.Buffer
+			_, err = io.Copy(&roundTrip, reader)
+			reader.Close()
+			if err == nil && !bytes.Equal(roundTrip.Bytes(), decoded) {
+				result = "recompress_mismatch"
+			}
+		}
+		if err != nil {
+			result = "recompress_invalid"
+		}
+	}
+	if result == "match" && isJSON(header.Get("Content-Type")) && !json.Valid(decoded) {
+		result = "invalid_json"
+	}
+	r.metrics.observeComparison(r.metricsLabel(req), result)
+	if result != "match" {
+		r.logger.Warn("transformed response diverges",
+			zap.String("uri", req.RequestURI),
+			zap.String("upstream", upstreamHostport(req)),
+			zap.String("result", result))
+	}
+}
@@ -0,0 +1,569 @@
+package ungzip
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"net/textproto"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+	"github.com/quic-go/quic-go/http3"
+)
+
+// fixture is the upstream of the conformance suite: it serves the
+// response it declares, interim responses and trailers included.
+type fixture struct {
+	interim []int
+	status  int
+	header  map[string]string
+	body    []byte
+	trailer map[string]string
+}
+
+func (f fixture) ServeHTTP(w http.ResponseWriter, r *http.Request) error {
+	for _, code := range f.interim {
+		w.Header().Set("Link", "</style.css>; rel=preload; as=style")
+		w.WriteHeader(code)
+	}
+	for name, value := range f.header {
+		w.Header().Set(name, value)
+	}
+	for name := range f.trailer {
+		w.Header().Add("Trailer", name)
+	}
+	status := f.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	w.WriteHeader(status)
+	if r.Method != http.MethodHead {
+		if _, err := w.Write(f.body); err != nil {
+			return err
+		}
+	}
+	for name, value := range f.trailer {
+		w.Header().Set(name, value)
+	}
+	return nil
+}
+
+func gzipped(t testing.TB, data []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func zstded(t testing.TB, data []byte) []byte {
+	t.Helper()
+	enc, err := zstd.NewWriter(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer enc.Close()
+	return enc.EncodeAll(data, nil)
+}
+
+// TestConformance is the behaviour every decoder and mode must keep:
+// each case is served by a fixture upstream through a provisioned
+// handler.
+func TestConformance(t *testing.T) {
+	text := []byte(strings.Repeat("conformance ", 100))
+	bomb := gzipped(t, make([]byte, 8<<20))
+	events := []byte("data: one\n\ndata: two\n\n")
+
+	for _, tc := range []struct {
+		name      string
+		handler   ResponseUngzip
+		method    string
+		upstream  fixture
+		status    int
+		body      []byte
+		encoding  string
+		trailer   string
+		errorCode string
+	}{
+		{
+			name:     "gzip",
+			upstream: fixture{header: map[string]string{"Content-Encoding": "gzip"}, body: gzipped(t, text)},
+			body:     text,
+		},
+		{
+			name:     "zstd",
+			handler:  ResponseUngzip{Encodings: []string{"gzip", "zstd"}},
+			upstream: fixture{header: map[string]string{"Content-Encoding": "zstd"}, body: zstded(t, text)},
+			body:     text,
+		},
+		{
+			name:     "zstd not enabled",
+			upstream: fixture{header: map[string]string{"Content-Encoding": "zstd"}, body: zstded(t, text)},
+			body:     zstded(t, text),
+			encoding: "zstd",
+		},
+		{
+			name:     "identity",
+			upstream: fixture{body: text},
+			body:     text,
+		},
+		{
+			name:     "chained",
+			handler:  ResponseUngzip{Encodings: []string{"gzip", "zstd"}},
+			upstream: fixture{header: map[string]string{"Content-Encoding": "gzip, zstd"}, body: zstded(t, gzipped(t, text))},
+			body:     text,
+		},
+		{
+			name:     "too many layers",
+			handler:  ResponseUngzip{MaxEncodingLayers: 1},
+			upstream: fixture{header: map[string]string{"Content-Encoding": "gzip, gzip"}, body: gzipped(t, gzipped(t, text))},
+			body:     gzipped(t, gzipped(t, text)),
+			encoding: "gzip, gzip",
+		},
+		{
+			name:     "truncated passes through",
+			upstream: fixture{header: map[string]string{"Content-Encoding": "gzip"}, body: gzipped(t, text)[:20]},
+			body:     gzipped(t, text)[:20],
+			encoding: "gzip",
+		},
+		{
+			name:      "truncated with on_error error",
+			handler:   ResponseUngzip{OnError: "error"},
+			upstream:  fixture{header: map[string]string{"Content-Encoding": "gzip"}, body: gzipped(t, text)[:20]},
+			status:    http.StatusBadGateway,
+			errorCode: "bad_stream",
+		},
+		{
+			name:      "bomb",
+			handler:   ResponseUngzip{MaxDecompressedSize: 1 << 20, OnError: "error"},
+			upstream:  fixture{header: map[string]string{"Content-Encoding": "gzip"}, body: bomb},
+			status:    http.StatusBadGateway,
+			errorCode: "too_large",
+		},
+		{
+			name:      "bomb by ratio",
+			handler:   ResponseUngzip{MaxRatio: 100, OnError: "error"},
+			upstream:  fixture{header: map[string]string{"Content-Encoding": "gzip"}, body: bomb},
+			status:    http.StatusBadGateway,
+			errorCode: "ratio_exceeded",
+		},
+		{
+			name:     "over max_size",
+			handler:  ResponseUngzip{MaxSize: 10},
+			upstream: fixture{header: map[string]string{"Content-Encoding": "gzip"}, body: gzipped(t, text)},
+			body:     gzipped(t, text),
+			encoding: "gzip",
+		},
+		{
+			name:     "server-sent events",
+			handler:  ResponseUngzip{Stream: true},
+			upstream: fixture{header: map[string]string{"Content-Encoding": "gzip", "Content-Type": "text/event-stream"}, body: gzipped(t, events)},
+			body:     events,
+		},
+		{
+			name:     "HEAD",
+			method:   http.MethodHead,
+			upstream: fixture{header: map[string]string{"Content-Encoding": "gzip"}},
+		},
+		{
+			name:     "partial content",
+			upstream: fixture{status: http.StatusPartialContent, header: map[string]string{"Content-Encoding": "gzip", "Content-Range": "bytes 0-9/100"}, body: gzipped(t, text)[:10]},
+			status:   http.StatusPartialContent,
+			body:     gzipped(t, text)[:10],
+			encoding: "gzip",
+		},
+		{
+			name:     "trailers",
+			upstream: fixture{header: map[string]string{"Content-Encoding": "gzip"}, body: gzipped(t, text), trailer: map[string]string{"X-Checksum": "abc"}},
+			body:     text,
+			trailer:  "abc",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+			defer cancel()
+			h := tc.handler
+			if err := h.Provision(ctx); err != nil {
+				t.Fatal(err)
+			}
+			if err := h.Validate(); err != nil {
+				t.Fatal(err)
+			}
+
+			method := tc.method
+			if method == "" {
+				method = http.MethodGet
+			}
+			req := httptest.NewRequest(method, "/", nil)
+			req.Header.Set("Accept-Encoding", "gzip, zstd")
+			vars := map[string]any{}
+			reqCtx := context.WithValue(req.Context(), caddy.ReplacerCtxKey, caddy.NewReplacer())
+			reqCtx = context.WithValue(reqCtx, caddyhttp.VarsCtxKey, vars)
+			req = req.WithContext(reqCtx)
+
+			w := httptest.NewRecorder()
+			err := h.ServeHTTP(w, req, tc.upstream)
+
+			want := tc.status
+			if want == 0 {
+				want = http.StatusOK
+			}
+			if tc.errorCode != "" {
+				var handlerErr caddyhttp.HandlerError
+				if !errors.As(err, &handlerErr) || handlerErr.StatusCode != want {
+					t.Fatalf("got error %v, want status %d", err, want)
+				}
+				if vars["ungzip_error"] != tc.errorCode {
+					t.Errorf("got ungzip_error %v, want %s", vars["ungzip_error"], tc.errorCode)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if w.Code != want {
+				t.Errorf("got status %d, want %d", w.Code, want)
+			}
+			if !bytes.Equal(w.Body.Bytes(), tc.body) {
+				t.Errorf("got body of %d bytes, want %d", w.Body.Len(), len(tc.body))
+			}
+			if got := w.Header().Get("Content-Encoding"); got != tc.encoding {
+				t.Errorf("got Content-Encoding %q, want %q", got, tc.encoding)
+			}
+			if tc.trailer != "" {
+				if got := w.Result().Trailer.Get("X-Checksum"); got != tc.trailer {
+					t.Errorf("got trailer %q, want %q", got, tc.trailer)
+				}
+			}
+		})
+	}
+}
+
+// protocolClients serves handler over HTTP/1.1, HTTP/2 and HTTP/3 and
+// returns the URL and client to reach it by, per protocol.
+func protocolClients(t *testing.T, handler http.Handler) map[string]struct {
+	url    string
+	client *http.Client
+} {
+	t.Helper()
+	h1 := httptest.NewServer(handler)
+	t.Cleanup(h1.Close)
+
+	h2 := httptest.NewUnstartedServer(handler)
+	h2.EnableHTTP2 = true
+	h2.StartTLS()
+	t.Cleanup(h2.Close)
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h3 := &http3.Server{Handler: handler, TLSConfig: http3.ConfigureTLSConfig(h2.TLS.Clone())}
+	go func() { _ = h3.Serve(conn) }()
+	t.Cleanup(func() {
+		_ = h3.Close()
+		_ = conn.Close()
+	})
+	roots := x509.NewCertPool()
+	roots.AddCert(h2.Certificate())
+	h3Transport := &http3.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}}
+	t.Cleanup(func() { _ = h3Transport.Close() })
+
+	return map[string]struct {
+		url    string
+		client *http.Client
+	}{
+		"HTTP/1.1": {h1.URL, h1.Client()},
+		"HTTP/2.0": {h2.URL, h2.Client()},
+		"HTTP/3.0": {"https://" + conn.LocalAddr().String(), &http.Client{Transport: h3Transport}},
+	}
+}
+
+// TestProtocolConformance checks the framing of decoded responses over
+// real connections: trailers have to survive, and the body has to agree
+// with any Content-Length sent, on every protocol version.
+func TestProtocolConformance(t *testing.T) {
+	text := []byte(strings.Repeat("conformance ", 100))
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	var h ResponseUngzip
+	if err := h.Provision(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer h.Cleanup()
+
+	upstreams := map[string]fixture{
+		"/plain":    {header: map[string]string{"Content-Encoding": "gzip"}, body: gzipped(t, text)},
+		"/trailers": {header: map[string]string{"Content-Encoding": "gzip"}, body: gzipped(t, text), trailer: map[string]string{"X-Checksum": "abc"}},
+	}
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		req = caddyhttp.PrepareRequest(req, caddyhttp.NewTestReplacer(req), nil, nil)
+		if err := h.ServeHTTP(w, req, upstreams[req.URL.Path]); err != nil {
+			t.Error(err)
+		}
+	})
+
+	for proto, c := range protocolClients(t, handler) {
+		for path := range upstreams {
+			t.Run(proto+path, func(t *testing.T) {
+				req, err := http.NewRequest(http.MethodGet, c.url+path, nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				// set explicitly, so that no client decodes the body itself
+				req.Header.Set("Accept-Encoding", "gzip")
+				resp, err := c.client.Do(req)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer resp.Body.Close()
+				body, err := io.ReadAll(resp.Body)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if resp.Proto != proto {
+					t.Errorf("got %s, want %s", resp.Proto, proto)
+				}
+				if !bytes.Equal(body, text) {
+					t.Errorf("got body of %d bytes, want %d", len(body), len(text))
+				}
+				if got := resp.Header.Get("Content-Encoding"); got != "" {
+					t.Errorf("got Content-Encoding %q", got)
+				}
+				if resp.ContentLength != -1 && resp.ContentLength != int64(len(body)) {
+					t.Errorf("got Content-Length %d for a body of %d bytes", resp.ContentLength, len(body))
+				}
+				if path == "/trailers" {
+					if resp.ContentLength != -1 {
+						t.Errorf("got Content-Length %d with trailers", resp.ContentLength)
+					}
+					if got := resp.Trailer.Get("X-Checksum"); got != "abc" {
+						t.Errorf("got trailer %q, want %q", got, "abc")
+					}
+				}
+			})
+		}
+	}
+}
+
+// TestInterimResponses checks that 1xx responses from the upstream
+// reach the client ahead of the final response, whatever becomes of
+// that response, on every protocol version.
+func TestInterimResponses(t *testing.T) {
+	text := []byte(strings.Repeat("conformance ", 100))
+	events := []byte("data: one\n\ndata: two\n\n")
+	gzipHeader := map[string]string{"Content-Encoding": "gzip"}
+
+	cases := []struct {
+		name     string
+		handler  ResponseUngzip
+		upstream fixture
+		status   int
+		body     []byte
+	}{
+		{
+			name:     "early hints then decoded",
+			upstream: fixture{interim: []int{http.StatusEarlyHints}, header: gzipHeader, body: gzipped(t, text)},
+			body:     text,
+		},
+		{
+			name:     "processing and early hints then decoded",
+			upstream: fixture{interim: []int{http.StatusProcessing, http.StatusEarlyHints}, header: gzipHeader, body: gzipped(t, text)},
+			body:     text,
+		},
+		{
+			name:     "early hints then identity",
+			upstream: fixture{interim: []int{http.StatusEarlyHints}, body: text},
+			body:     text,
+		},
+		{
+			name:     "early hints then streamed",
+			handler:  ResponseUngzip{Stream: true},
+			upstream: fixture{interim: []int{http.StatusEarlyHints}, header: map[string]string{"Content-Encoding": "gzip", "Content-Type": "text/event-stream"}, body: gzipped(t, events)},
+			body:     events,
+		},
+		{
+			name:     "early hints then not modified",
+			upstream: fixture{interim: []int{http.StatusEarlyHints}, status: http.StatusNotModified, header: gzipHeader},
+			status:   http.StatusNotModified,
+		},
+		{
+			name:     "early hints then decode error",
+			handler:  ResponseUngzip{OnError: "error"},
+			upstream: fixture{interim: []int{http.StatusEarlyHints}, header: gzipHeader, body: gzipped(t, text)[:20]},
+			status:   http.StatusBadGateway,
+		},
+	}
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	for i := range cases {
+		if err := cases[i].handler.Provision(ctx); err != nil {
+			t.Fatal(err)
+		}
+		defer cases[i].handler.Cleanup()
+	}
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		tc := cases[len(req.URL.Path)-1]
+		req = caddyhttp.PrepareRequest(req, caddyhttp.NewTestReplacer(req), nil, nil)
+		if err := tc.handler.ServeHTTP(w, req, tc.upstream); err != nil {
+			var handlerErr caddyhttp.HandlerError
+			if !errors.As(err, &handlerErr) {
+				t.Error(err)
+			}
+			w.WriteHeader(handlerErr.StatusCode)
+		}
+	})
+
+	for proto, c := range protocolClients(t, handler) {
+		for i, tc := range cases {
+			t.Run(proto+" "+tc.name, func(t *testing.T) {
+				var interim []int
+				trace := &httptrace.ClientTrace{
+					Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+						if header.Get("Link") == "" {
+							t.Errorf("got %d without its Link header", code)
+						}
+						interim = append(interim, code)
+						return nil
+					},
+				}
+				// one path per case, by length
+				path := "/" + strings.Repeat("x", i)
+				req, err := http.NewRequestWithContext(httptrace.WithClientTrace(context.Background(), trace), http.MethodGet, c.url+path, nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				req.Header.Set("Accept-Encoding", "gzip")
+				resp, err := c.client.Do(req)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer resp.Body.Close()
+				body, err := io.ReadAll(resp.Body)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if !slices.Equal(interim, tc.upstream.interim) {
+					t.Errorf("got interim responses %v, want %v", interim, tc.upstream.interim)
+				}
+				want := tc.status
+				if want == 0 {
+					want = http.StatusOK
+				}
+				if resp.StatusCode != want {
+					t.Errorf("got status %d, want %d", resp.StatusCode, want)
+				}
+				if want == http.StatusOK && !bytes.Equal(body, tc.body) {
+					t.Errorf("got body of %d bytes, want %d", len(body), len(tc.body))
+				}
+			})
+		}
+	}
+}
+
+// TestBodiless covers the responses that have no body to decompress,
+// under both bodiless settings.
+func TestBodiless(t *testing.T) {
+	text := []byte(strings.Repeat("conformance ", 100))
+	header := map[string]string{
+		"Content-Encoding": "gzip",
+		"Content-Length":   "123",
+		"Content-Digest":   "sha-256=:AAAA:",
+	}
+
+	for _, tc := range []struct {
+		name     string
+		method   string
+		upstream fixture
+		decoded  bool
+	}{
+		{name: "HEAD", method: http.MethodHead, upstream: fixture{header: header}},
+		{name: "no content", upstream: fixture{status: http.StatusNoContent, header: header}},
+		{name: "not modified", upstream: fixture{status: http.StatusNotModified, header: header}},
+		{name: "empty OPTIONS", method: http.MethodOptions, upstream: fixture{header: header}},
+		// a body is decompressed whatever the method
+		{
+			name:     "OPTIONS with a body",
+			method:   http.MethodOptions,
+			upstream: fixture{header: map[string]string{"Content-Encoding": "gzip"}, body: gzipped(t, text)},
+			decoded:  true,
+		},
+	} {
+		for _, bodiless := range []string{"", "adjust", "keep"} {
+			t.Run(tc.name+" "+bodiless, func(t *testing.T) {
+				ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+				defer cancel()
+				h := ResponseUngzip{Bodiless: bodiless}
+				if err := h.Provision(ctx); err != nil {
+					t.Fatal(err)
+				}
+				defer h.Cleanup()
+				if err := h.Validate(); err != nil {
+					t.Fatal(err)
+				}
+
+				method := tc.method
+				if method == "" {
+					method = http.MethodGet
+				}
+				req := httptest.NewRequest(method, "/", nil)
+				req.Header.Set("Accept-Encoding", "gzip")
+				req = caddyhttp.PrepareRequest(req, caddyhttp.NewTestReplacer(req), nil, nil)
+				w := httptest.NewRecorder()
+				if err := h.ServeHTTP(w, req, tc.upstream); err != nil {
+					t.Fatal(err)
+				}
+
+				wantStatus := tc.upstream.status
+				if wantStatus == 0 {
+					wantStatus = http.StatusOK
+				}
+				if w.Code != wantStatus {
+					t.Errorf("got status %d, want %d", w.Code, wantStatus)
+				}
+				if tc.decoded {
+					if !bytes.Equal(w.Body.Bytes(), text) {
+						t.Errorf("got body of %d bytes, want %d", w.Body.Len(), len(text))
+					}
+					if got := w.Header().Get("Content-Encoding"); got != "" {
+						t.Errorf("got Content-Encoding %q", got)
+					}
+					return
+				}
+				if w.Body.Len() != 0 {
+					t.Errorf("got a body of %d bytes", w.Body.Len())
+				}
+				want := header
+				if bodiless != "keep" {
+					want = map[string]string{}
+				}
+				for _, name := range []string{"Content-Encoding", "Content-Length", "Content-Digest"} {
+					if got := w.Header().Get(name); got != want[name] {
+						t.Errorf("got %s %q, want %q", name, got, want[name])
+					}
+				}
+			})
+		}
+	}
+}
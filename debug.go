@@ -0,0 +1,177 @@
+package ungzip
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// DebugParam lets trusted clients ask how the response to a request was
+// handled, by adding a query parameter such as ?__ungzip_debug=1. The
+// answer comes as a JSON trailer listing the decisions made, the sizes
+// of the body before and after decoding, and the time taken. The
+// decision is only known once the response is under way, hence the
+// trailer; as HTTP/1.1 carries trailers on chunked bodies only,
+// Content-Length is dropped from these responses. The parameter is
+// taken off the request before it is passed on.
+type DebugParam struct {
+	// Query parameter that asks for the trailer
+	// Default: "__ungzip_debug"
+	Name string `json:"name,omitempty"`
+
+	// Trailer to send the description in
+	// Default: "X-Ungzip-Debug"
+	Trailer string `json:"trailer,omitempty"`
+
+	// Client IPs or ranges in CIDR notation allowed to ask. The parameter
+	// is ignored for other clients
+	// Default: private and loopback ranges
+	From []string `json:"from,omitempty"`
+
+	prefixes []netip.Prefix
+}
+
+func (p *DebugParam) provision() error {
+	if p.Name == "" {
+		p.Name = "__ungzip_debug"
+	}
+	if p.Trailer == "" {
+		p.Trailer = "X-Ungzip-Debug"
+	}
+	from := p.From
+	if len(from) == 0 {
+		from = caddyhttp.PrivateRangesCIDR()
+	}
+	p.prefixes = make([]netip.Prefix, 0, len(from))
+	for _, cidr := range from {
+		prefix, err := caddyhttp.CIDRExpressionToPrefix(cidr)
+		if err != nil {
+			return fmt.Errorf("invalid debug_param range: %v", err)
+		}
+		p.prefixes = append(p.prefixes, prefix)
+	}
+	return nil
+}
+
+// requested reports whether req asks for the debug trailer, from a
+// client allowed to.
+func (p *DebugParam) requested(req *http.Request) bool {
+	// a substring check spares most requests parsing the query
+	if !strings.Contains(req.URL.RawQuery, p.Name) || !req.URL.Query().Has(p.Name) {
+		return false
+	}
+	address, _ := caddyhttp.GetVar(req.Context(), caddyhttp.ClientIPVarKey).(string)
+	if address == "" {
+		address, _, _ = net.SplitHostPort(req.RemoteAddr)
+	}
+	ip, err := netip.ParseAddr(address)
+	if err != nil {
+		return false
+	}
+	ip = ip.Unmap()
+	for _, prefix := range p.prefixes {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// withoutParam returns the query rawQuery without the parameter name,
+// leaving the others as they were.
+func withoutParam(rawQuery, name string) string {
+	params := strings.Split(rawQuery, "&")
+	params = slices.DeleteFunc(params, func(param string) bool {
+		key, _, _ := strings.Cut(param, "=")
+		key, err := url.QueryUnescape(key)
+		return err == nil && key == name
+	})
+	return strings.Join(params, "&")
+}
+
+// debugInfo describes how the response to a request asking for the
+// debug trailer was handled.
+type debugInfo struct {
+	Decisions    []debugDecision `json:"decisions"`
+	Compressed   int             `json:"compressed_bytes,omitempty"`
+	Decompressed int             `json:"decompressed_bytes,omitempty"`
+	Duration     string          `json:"duration"`
+}
+
+type debugDecision struct {
+	Action string `json:"action"`
+	Reason string `json:"reason,omitempty"`
+}
+
+type debugKey struct{}
+
+// debugOf returns the debug description being built for req, if any.
+func debugOf(req *http.Request) *debugInfo {
+	info, _ := req.Context().Value(debugKey{}).(*debugInfo)
+	return info
+}
+
+// noteDebug adds a decision to the debug description of req, if it
+// asked for one.
+func (r ResponseUngzip) noteDebug(req *http.Request, action, reason string) {
+	if r.DebugParam == nil {
+		return
+	}
+	if info := debugOf(req); info != nil {
+		info.Decisions = append(info.Decisions, debugDecision{Action: action, Reason: reason})
+	}
+}
+
+// serveDebug handles req as usual, describing how in the debug trailer.
+// The parameter is taken off the request first, so that neither the
+// upstream nor the cache sees it.
+func (r ResponseUngzip) serveDebug(w http.ResponseWriter, req *http.Request, next caddyhttp.Handler) error {
+	info := &debugInfo{Decisions: []debugDecision{}}
+	req = req.WithContext(context.WithValue(req.Context(), debugKey{}, info))
+	u := *req.URL
+	u.RawQuery = withoutParam(u.RawQuery, r.DebugParam.Name)
+	req.URL, req.RequestURI = &u, u.RequestURI()
+	start := time.Now()
+	dw := &debugWriter{ResponseWriter: w}
+	err := r.ServeHTTP(dw, req, next)
+	info.Duration = time.Since(start).String()
+	if value, jsonErr := json.Marshal(info); jsonErr == nil {
+		w.Header().Set(http.TrailerPrefix+r.DebugParam.Trailer, string(value))
+	}
+	return err
+}
+
+// debugWriter drops the Content-Length of the final response, so that
+// it is chunked and can carry the debug trailer.
+type debugWriter struct {
+	http.ResponseWriter
+	wroteHeader bool
+}
+
+func (d *debugWriter) WriteHeader(status int) {
+	if !d.wroteHeader && status >= 200 {
+		d.wroteHeader = true
+		d.Header().Del("Content-Length")
+	}
+	d.ResponseWriter.WriteHeader(status)
+}
+
+func (d *debugWriter) Write(p []byte) (int, error) {
+	if !d.wroteHeader {
+		d.WriteHeader(http.StatusOK)
+	}
+	return d.ResponseWriter.Write(p)
+}
+
+func (d *debugWriter) Unwrap() http.ResponseWriter {
+	return d.ResponseWriter
+}
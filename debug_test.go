@@ -0,0 +1,58 @@
+package ungzip
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func TestDebugParamNotForwarded(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	h := ResponseUngzip{DebugParam: &DebugParam{}}
+	if err := h.Provision(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer h.Cleanup()
+
+	for _, tc := range []struct {
+		name, remoteAddr, target string
+		wantURI                  string
+		wantTrailer              bool
+	}{
+		{"only parameter", "127.0.0.1:1234", "/page?__ungzip_debug=1", "/page", true},
+		{"among others", "127.0.0.1:1234", "/page?b=2&__ungzip_debug&a=1", "/page?b=2&a=1", true},
+		{"others left escaped", "10.0.0.1:1234", "/page?a=%2F+x&__ungzip_debug=1", "/page?a=%2F+x", true},
+		// the parameter means nothing coming from elsewhere
+		{"untrusted client", "192.0.2.1:1234", "/page?__ungzip_debug=1", "/page?__ungzip_debug=1", false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tc.target, nil)
+			req.RemoteAddr = tc.remoteAddr
+			req = caddyhttp.PrepareRequest(req, caddyhttp.NewTestReplacer(req), nil, nil)
+			var gotURI, gotRequestURI string
+			upstream := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+				gotURI, gotRequestURI = r.URL.RequestURI(), r.RequestURI
+				_, err := w.Write([]byte("page"))
+				return err
+			})
+			w := httptest.NewRecorder()
+			if err := h.ServeHTTP(w, req, upstream); err != nil {
+				t.Fatal(err)
+			}
+			if gotURI != tc.wantURI || gotRequestURI != tc.wantURI {
+				t.Errorf("upstream got %s (RequestURI %s), want %s", gotURI, gotRequestURI, tc.wantURI)
+			}
+			if got := w.Header().Get(http.TrailerPrefix+"X-Ungzip-Debug") != ""; got != tc.wantTrailer {
+				t.Errorf("got debug trailer: %v, want %v", got, tc.wantTrailer)
+			}
+			if req.URL.RawQuery == "" {
+				t.Error("the caller's request was changed")
+			}
+		})
+	}
+}
@@ -0,0 +1,135 @@
+package ungzip
+
+import (
+	"math/rand/v2"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// logDecision logs what the handler did with the response to req, and
+// why. Decisions are logged at debug level, except for a sample of
+// them, at log_sample_rate, which is logged at info level.
+func (r ResponseUngzip) logDecision(req *http.Request, action, reason string) {
+	r.decisions.add(req, action, reason)
+	r.noteDebug(req, action, reason)
+	level := zapcore.DebugLevel
+	if r.LogSampleRate > 0 && rand.Float64() < r.LogSampleRate {
+		level = zapcore.InfoLevel
+	}
+	if ce := r.logger.Check(level, "handled response"); ce != nil {
+		ce.Write(
+			zap.String("uri", req.RequestURI),
+			zap.String("upstream", upstreamHostport(req)),
+			zap.String("action", action),
+			zap.String("reason", reason),
+		)
+	}
+	if action == "decompressed" {
+		r.observeUpstream(req, action)
+	}
+}
+
+// observeUpstream counts a response to req with result for the
+// reverse_proxy upstream that sent it, if any did.
+func (r ResponseUngzip) observeUpstream(req *http.Request, result string) {
+	if upstream := upstreamHostport(req); upstream != "" {
+		r.metrics.observeUpstream(r.metricsLabel(req), upstream, result)
+	}
+}
+
+// observeIdentity counts, for ensure_identity, whether the final
+// response to req with status and header came as identity, as asked, or
+// compressed, needing the fallback to decompression.
+func (r ResponseUngzip) observeIdentity(req *http.Request, status int, header http.Header) {
+	if status < 200 {
+		return
+	}
+	result := "identity"
+	if r.headerCodings(header) != nil {
+		result = "fallback"
+	}
+	r.metrics.observeIdentity(r.metricsLabel(req), result)
+}
+
+// upstreamHostport returns the address of the reverse_proxy upstream
+// that served req, or "" if the response did not come from one.
+func upstreamHostport(req *http.Request) string {
+	repl, ok := req.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+	if !ok {
+		return ""
+	}
+	hostport, _ := repl.GetString("http.reverse_proxy.upstream.hostport")
+	return hostport
+}
+
+// passthrough sends the response held by rec as it is, logging reason
+// as the cause.
+func (r ResponseUngzip) passthrough(req *http.Request, rec caddyhttp.ResponseRecorder, reason string) error {
+	r.logDecision(req, "passthrough", reason)
+	return rec.WriteResponse()
+}
+
+// decision is a record of how a response was handled.
+type decision struct {
+	Time     time.Time `json:"time"`
+	Method   string    `json:"method"`
+	Host     string    `json:"host"`
+	URI      string    `json:"uri"`
+	Action   string    `json:"action"`
+	Reason   string    `json:"reason,omitempty"`
+	Upstream string    `json:"upstream,omitempty"`
+}
+
+// decisionRing keeps the most recent decisions of a handler.
+type decisionRing struct {
+	mu      sync.Mutex
+	entries []decision
+	next    int
+	full    bool
+}
+
+func newDecisionRing(size int) *decisionRing {
+	return &decisionRing{entries: make([]decision, size)}
+}
+
+func (d *decisionRing) add(req *http.Request, action, reason string) {
+	if d == nil {
+		return
+	}
+	entry := decision{
+		Time:     time.Now().UTC(),
+		Method:   req.Method,
+		Host:     req.Host,
+		URI:      req.RequestURI,
+		Action:   action,
+		Reason:   reason,
+		Upstream: upstreamHostport(req),
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.entries[d.next] = entry
+	d.next = (d.next + 1) % len(d.entries)
+	if d.next == 0 {
+		d.full = true
+	}
+}
+
+// list returns the recorded decisions, oldest first.
+func (d *decisionRing) list() []decision {
+	if d == nil {
+		return []decision{}
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !d.full {
+		return append([]decision{}, d.entries[:d.next]...)
+	}
+	return append(append([]decision{}, d.entries[d.next:]...), d.entries[:d.next]...)
+}
@@ -0,0 +1,201 @@
+package ungzip
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func init() {
+	caddy.RegisterModule(Decode{})
+	httpcaddyfile.RegisterHandlerDirective("decode", parseDecodeCaddyfile)
+}
+
+// Decode implements an HTTP handler that decompresses request bodies,
+// response bodies or both with one configuration. For the options that
+// are specific to one direction, use request_ungzip or response_ungzip
+type Decode struct {
+	// Which bodies to decode: "request", "response" or "both"
+	// Default: "both"
+	Direction string `json:"direction,omitempty"`
+
+	// Content codings to decode, as Content-Encoding tokens
+	// Default: ["gzip"] for responses, ["gzip", "zstd"] for requests
+	Encodings []string `json:"encodings,omitempty"`
+
+	// Maximum size of bodies to decompress (in bytes): compressed for
+	// responses, decompressed for requests
+	// Default: 10MB
+	MaxSize int64 `json:"max_size,omitempty"`
+
+	// Maximum number of content codings to decode from one body
+	// Default: 3
+	MaxEncodingLayers int `json:"max_encoding_layers,omitempty"`
+
+	request  *RequestUngzip
+	response *ResponseUngzip
+}
+
+// CaddyModule returns the Caddy module information.
+func (Decode) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.handlers.decode",
+		New: func() caddy.Module { return new(Decode) },
+	}
+}
+
+// UnmarshalCaddyfile implements caddyfile.Unmarshaler.
+func (dec *Decode) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		for d.NextBlock(0) {
+			switch d.Val() {
+			case "direction":
+				if err := enumArg(d, &dec.Direction, "request", "response", "both"); err != nil {
+					return err
+				}
+
+			case "encodings":
+				dec.Encodings = d.RemainingArgs()
+				if len(dec.Encodings) == 0 {
+					return d.ArgErr()
+				}
+				for _, enc := range dec.Encodings {
+					if _, ok := decoders[enc]; !ok {
+						return d.Errf("unsupported encoding %q; it may need to be compiled in", enc)
+					}
+				}
+
+			case "max_size":
+				if err := sizeArg(d, &dec.MaxSize); err != nil {
+					return err
+				}
+
+			case "max_encoding_layers":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				layers, err := strconv.Atoi(d.Val())
+				if err != nil {
+					return d.Errf("invalid max_encoding_layers: %v", err)
+				}
+				dec.MaxEncodingLayers = layers
+
+			default:
+				return d.Errf("unknown subdirective %s", d.Val())
+			}
+		}
+	}
+	return nil
+}
+
+// Provision implements caddy.Provisioner. Options left unset stay so on
+// the handlers for each direction, which fill in their defaults.
+func (dec *Decode) Provision(ctx caddy.Context) error {
+	if dec.Direction != "response" {
+		dec.request = &RequestUngzip{
+			Encodings:         dec.Encodings,
+			MaxSize:           dec.MaxSize,
+			MaxEncodingLayers: dec.MaxEncodingLayers,
+		}
+		if err := dec.request.Provision(ctx); err != nil {
+			return err
+		}
+	}
+	if dec.Direction != "request" {
+		dec.response = &ResponseUngzip{
+			Encodings:         dec.Encodings,
+			MaxSize:           dec.MaxSize,
+			MaxEncodingLayers: dec.MaxEncodingLayers,
+		}
+		if err := dec.response.Provision(ctx); err != nil {
+			return err
+		}
+	}
+	// listed as part of dec rather than on their own
+	if dec.request != nil {
+		unregisterConfig(dec.request)
+	}
+	if dec.response != nil {
+		unregisterConfig(dec.response)
+	}
+	registerConfig(dec)
+	return nil
+}
+
+// Cleanup implements caddy.CleanerUpper.
+func (dec *Decode) Cleanup() error {
+	unregisterConfig(dec)
+	var errs []error
+	if dec.request != nil {
+		errs = append(errs, dec.request.Cleanup())
+	}
+	if dec.response != nil {
+		errs = append(errs, dec.response.Cleanup())
+	}
+	return errors.Join(errs...)
+}
+
+// Validate implements caddy.Validator.
+func (dec *Decode) Validate() error {
+	switch dec.Direction {
+	case "", "both", "request", "response":
+	default:
+		return fmt.Errorf("invalid direction %q", dec.Direction)
+	}
+	if dec.request != nil {
+		if err := dec.request.Validate(); err != nil {
+			return err
+		}
+	}
+	if dec.response != nil {
+		if err := dec.response.Validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (dec Decode) ServeHTTP(w http.ResponseWriter, req *http.Request, next caddyhttp.Handler) error {
+	if dec.response != nil {
+		inner := next
+		next = caddyhttp.HandlerFunc(func(w http.ResponseWriter, req *http.Request) error {
+			return dec.response.ServeHTTP(w, req, inner)
+		})
+	}
+	if dec.request != nil {
+		return dec.request.ServeHTTP(w, req, next)
+	}
+	return next.ServeHTTP(w, req)
+}
+
+func parseDecodeCaddyfile(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error) {
+	// the options decode shares with ungzip default to the global
+	// option's, as they do for ungzip directives
+	var defaults ResponseUngzip
+	if err := applyGlobalDefaults(h, &defaults); err != nil {
+		return nil, err
+	}
+	handler := &Decode{
+		Encodings:         defaults.Encodings,
+		MaxSize:           defaults.MaxSize,
+		MaxEncodingLayers: defaults.MaxEncodingLayers,
+	}
+	err := handler.UnmarshalCaddyfile(h.Dispenser)
+	return handler, err
+}
+
+// Interface guards
+var (
+	_ caddy.Module                = (*Decode)(nil)
+	_ caddy.Provisioner           = (*Decode)(nil)
+	_ caddy.Validator             = (*Decode)(nil)
+	_ caddy.CleanerUpper          = (*Decode)(nil)
+	_ caddyhttp.MiddlewareHandler = (*Decode)(nil)
+	_ caddyfile.Unmarshaler       = (*Decode)(nil)
+)
@@ -0,0 +1,29 @@
+package ungzip
+
+import (
+	"context"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func TestDecodeDefaults(t *testing.T) {
+	t.Setenv(envMaxSize, "1MiB")
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	dec := &Decode{}
+	if err := dec.Provision(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer dec.Cleanup()
+
+	if dec.response.MaxSize != 1<<20 {
+		t.Errorf("got response max_size %d, want %s from the environment", dec.response.MaxSize, envMaxSize)
+	}
+	if dec.request.MaxSize != 10<<20 {
+		t.Errorf("got request max_size %d, want the default", dec.request.MaxSize)
+	}
+	if len(dec.response.Encodings) != 1 || len(dec.request.Encodings) != 2 {
+		t.Errorf("got encodings %v and %v, want the defaults of each direction", dec.response.Encodings, dec.request.Encodings)
+	}
+}
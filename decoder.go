@@ -0,0 +1,257 @@
+package ungzip
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// Decoder is a content coding that the handler can decode.
+type Decoder struct {
+	// Magic is the prefix every stream in the coding starts with, if
+	// any. It is used to recognize responses that are labeled with
+	// the wrong encoding.
+	Magic []byte
+
+	// NewReader returns a reader that decodes src.
+	NewReader func(src io.Reader) (io.ReadCloser, error)
+}
+
+// decoders holds the content codings that can be enabled with the
+// encodings option, keyed by their Content-Encoding token.
+//
+// Only gzip and zstd are always available. To keep builds small, less
+// common codecs are compiled in on request, with a build tag for those
+// in this package:
+//
+//	ungzip_bzip2     bzip2
+//	ungzip_compress  compress
+//	ungzip_snappy    x-snappy-framed
+//
+// or a module of their own for those needing extra dependencies:
+//
+//	github.com/danielballan/caddy-ungzip/brotli  br
+//	github.com/danielballan/caddy-ungzip/lz4     lz4
+//	github.com/danielballan/caddy-ungzip/xz      xz
+//
+// With xcaddy, build tags are set with XCADDY_GO_BUILD_FLAGS="-tags=...".
+var decoders = map[string]Decoder{
+	"gzip": {
+		Magic:     []byte{0x1f, 0x8b},
+		NewReader: func(src io.Reader) (io.ReadCloser, error) { return gzip.NewReader(src) },
+	},
+	"zstd": {
+		Magic:     []byte{0x28, 0xb5, 0x2f, 0xfd},
+		NewReader: func(src io.Reader) (io.ReadCloser, error) { return newZstdReader(src, nil) },
+	},
+}
+
+// RegisterDecoder makes d available to the encodings option under
+// name, which is the Content-Encoding token it decodes. It is meant
+// to be called from the init function of packages providing extra
+// codecs, and panics if name is already registered.
+func RegisterDecoder(name string, d Decoder) {
+	name = strings.ToLower(name)
+	if _, ok := decoders[name]; ok {
+		panic(fmt.Sprintf("decoder %q already registered", name))
+	}
+	decoders[name] = d
+}
+
+var errTooManyLayers = errors.New("too many content encodings applied")
+
+var errUnknownEncoding = errors.New("unknown content encoding")
+
+// registeredCodings are the content codings in the IANA HTTP Content
+// Coding Registry, which clients may know even where no decoder is
+// registered for them here.
+var registeredCodings = []string{"aes128gcm", "br", "compress", "dcb", "dcz", "deflate", "exi", "gzip", "pack200-gzip", "zstd"}
+
+// unknownCoding returns the first content coding in header that is
+// neither registered with IANA nor has a decoder, such as sdch or a
+// custom token, or "" if there is none.
+func unknownCoding(header http.Header) string {
+	for _, coding := range contentEncodings(header) {
+		if isUnknownCoding(coding) {
+			return coding
+		}
+	}
+	return ""
+}
+
+func isUnknownCoding(coding string) bool {
+	_, ok := decoders[coding]
+	return !ok && !slices.Contains(registeredCodings, coding)
+}
+
+// stripUnknownCodings removes the codings unknownCoding reports from
+// the Content-Encoding in header.
+func stripUnknownCodings(header http.Header) {
+	if unknownCoding(header) == "" {
+		return
+	}
+	codings := slices.DeleteFunc(contentEncodings(header), isUnknownCoding)
+	if len(codings) == 0 {
+		header.Del("Content-Encoding")
+		return
+	}
+	header.Set("Content-Encoding", strings.Join(codings, ", "))
+}
+
+// codingsOf returns the content codings a response with the given
+// header and body is compressed with, in the order they were applied,
+// or nil if any of them is not enabled, so that the header is never
+// stripped while one of them remains. If the body starts with the
+// magic bytes of a different enabled encoding than the outermost one
+// it is labeled with, that one is used instead.
+func (r ResponseUngzip) codingsOf(header http.Header, body []byte) ([]string, error) {
+	codings := r.headerCodings(header)
+	if codings == nil {
+		return nil, nil
+	}
+	if len(codings) > r.MaxEncodingLayers {
+		return nil, fmt.Errorf("%w: %d", errTooManyLayers, len(codings))
+	}
+	outer := &codings[len(codings)-1]
+	if !hasMagic(*outer, body) {
+		for _, enc := range r.Encodings {
+			if hasMagic(enc, body) {
+				*outer = enc
+				break
+			}
+		}
+	}
+	return codings, nil
+}
+
+// headerCodings returns the codings header names for the response, or
+// nil if it names none or any that this handler is not configured for.
+func (r ResponseUngzip) headerCodings(header http.Header) []string {
+	codings := contentEncodings(header)
+	for _, name := range r.encodingHeaders() {
+		if len(codings) > 0 {
+			break
+		}
+		codings = codingList(header.Values(name))
+	}
+	for _, coding := range codings {
+		if !slices.Contains(r.Encodings, coding) {
+			return nil
+		}
+	}
+	return codings
+}
+
+// encodingHeaders returns the headers other than Content-Encoding
+// that name the codings of responses, in the order to consult them.
+func (r ResponseUngzip) encodingHeaders() []string {
+	if r.HintHeader == "" {
+		return r.MetadataHeaders
+	}
+	return append([]string{r.HintHeader}, r.MetadataHeaders...)
+}
+
+// contentEncodings returns the content codings listed in header in the
+// order they were applied, lowercased, with identity left out and the
+// x-gzip and x-compress aliases resolved (RFC 9110, section 8.4.1).
+func contentEncodings(header http.Header) []string {
+	return codingList(header.Values("Content-Encoding"))
+}
+
+// codingList parses values that list content codings like
+// Content-Encoding does.
+func codingList(values []string) []string {
+	var codings []string
+	for _, value := range values {
+		for _, token := range strings.Split(value, ",") {
+			token = strings.ToLower(strings.TrimSpace(token))
+			switch token {
+			case "", "identity":
+				continue
+			case "x-gzip":
+				token = "gzip"
+			case "x-compress":
+				token = "compress"
+			}
+			codings = append(codings, token)
+		}
+	}
+	return codings
+}
+
+func hasMagic(enc string, body []byte) bool {
+	magic := decoders[enc].Magic
+	return len(magic) > 0 && bytes.HasPrefix(body, magic)
+}
+
+// newReader returns a reader that decodes src, compressed with codings
+// in the order given, within the limits of r.
+func (r ResponseUngzip) newReader(codings []string, src io.Reader) (io.ReadCloser, error) {
+	return newLimitedDecoder(codings, bufferedReader(src, r.ReadBufferSize), r.zstdDicts, r.decodeLimits())
+}
+
+// bufferedReader returns src read through a buffer of size bytes, or src
+// itself if size is zero.
+func bufferedReader(src io.Reader, size int) io.Reader {
+	if size <= 0 {
+		return src
+	}
+	return bufio.NewReaderSize(src, size)
+}
+
+// copyChunked copies src to dst like io.Copy, but in chunks of size
+// bytes if size is not zero. io.Copy lets dst or src pick the chunk
+// size if they can, so they are hidden from it.
+func copyChunked(dst io.Writer, src io.Reader, size int) (int64, error) {
+	if size <= 0 {
+		return io.Copy(dst, src)
+	}
+	return io.CopyBuffer(struct{ io.Writer }{dst}, struct{ io.Reader }{src}, make([]byte, size))
+}
+
+// newDecoder returns a reader that decodes src, compressed with codings
+// in the order given, using zstdDicts for zstd.
+func newDecoder(codings []string, src io.Reader, zstdDicts [][]byte) (io.ReadCloser, error) {
+	var readers chainedReader
+	reader := src
+	for i := len(codings) - 1; i >= 0; i-- {
+		var (
+			rc  io.ReadCloser
+			err error
+		)
+		if codings[i] == "zstd" {
+			rc, err = newZstdReader(reader, zstdDicts)
+		} else {
+			rc, err = decoders[codings[i]].NewReader(reader)
+		}
+		if err != nil {
+			readers.Close()
+			return nil, err
+		}
+		readers = append(readers, rc)
+		reader = rc
+	}
+	return readers, nil
+}
+
+// chainedReader reads from the last of a chain of decoders, each of
+// which reads from the one before it, and closes all of them.
+type chainedReader []io.ReadCloser
+
+func (c chainedReader) Read(p []byte) (int, error) {
+	return c[len(c)-1].Read(p)
+}
+
+func (c chainedReader) Close() error {
+	var errs []error
+	for _, rc := range c {
+		errs = append(errs, rc.Close())
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,17 @@
+//go:build ungzip_bzip2
+
+package ungzip
+
+import (
+	"compress/bzip2"
+	"io"
+)
+
+func init() {
+	RegisterDecoder("bzip2", Decoder{
+		Magic: []byte("BZh"),
+		NewReader: func(src io.Reader) (io.ReadCloser, error) {
+			return io.NopCloser(bzip2.NewReader(src)), nil
+		},
+	})
+}
@@ -0,0 +1,183 @@
+//go:build ungzip_compress
+
+package ungzip
+
+import (
+	"bufio"
+	"errors"
+	"io"
+)
+
+func init() {
+	RegisterDecoder("compress", Decoder{
+		Magic:     []byte{0x1f, 0x9d},
+		NewReader: newCompressReader,
+	})
+}
+
+// The compress(1) format is LZW, but not the variant implemented by
+// compress/lzw: there is no end code, the clear code is optional, and
+// whenever the code width changes the rest of the current group of
+// eight codes is padding, a leftover of the original implementation.
+const (
+	compressInitBits = 9
+	compressMaxBits  = 16
+	compressClear    = 256
+)
+
+var errCompressCorrupt = errors.New("compress: corrupt stream")
+
+// compressReader decodes a compress(1) (.Z) stream.
+type compressReader struct {
+	src *bufio.Reader
+	err error
+
+	bits, nbits uint32 // bit buffer, least significant first
+	width       uint   // current code width
+	maxBits     uint
+	blockMode   bool
+	groupCodes  int // codes read at the current width
+
+	maxCode, freeEnt int
+	oldCode          int
+	finChar          byte
+	prefix           [1 << compressMaxBits]uint16
+	suffix           [1 << compressMaxBits]byte
+
+	stack []byte // decoded bytes not yet returned, in reverse
+}
+
+func newCompressReader(src io.Reader) (io.ReadCloser, error) {
+	var header [3]byte
+	if _, err := io.ReadFull(src, header[:]); err != nil {
+		return nil, err
+	}
+	if header[0] != 0x1f || header[1] != 0x9d {
+		return nil, errors.New("compress: invalid header")
+	}
+	maxBits := uint(header[2] & 0x1f)
+	if maxBits < compressInitBits || maxBits > compressMaxBits {
+		return nil, errors.New("compress: unsupported code width")
+	}
+	z := &compressReader{
+		src:       bufio.NewReader(src),
+		width:     compressInitBits,
+		maxBits:   maxBits,
+		blockMode: header[2]&0x80 != 0,
+		maxCode:   1<<compressInitBits - 1,
+		freeEnt:   256,
+		oldCode:   -1,
+	}
+	if z.blockMode {
+		z.freeEnt = compressClear + 1
+	}
+	return z, nil
+}
+
+func (z *compressReader) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		if len(z.stack) > 0 {
+			for n < len(p) && len(z.stack) > 0 {
+				p[n] = z.stack[len(z.stack)-1]
+				z.stack = z.stack[:len(z.stack)-1]
+				n++
+			}
+			continue
+		}
+		if z.err != nil {
+			return n, z.err
+		}
+		z.err = z.decode()
+	}
+	return n, nil
+}
+
+// decode reads the next code and pushes its expansion onto the stack.
+func (z *compressReader) decode() error {
+	if z.freeEnt > z.maxCode && z.width < z.maxBits {
+		if err := z.skipGroup(); err != nil {
+			return err
+		}
+		z.width++
+		z.maxCode = 1<<z.width - 1
+	}
+	code, err := z.readCode()
+	if err != nil {
+		return err
+	}
+
+	if z.oldCode == -1 {
+		if code >= 256 {
+			return errCompressCorrupt
+		}
+		z.oldCode = code
+		z.finChar = byte(code)
+		z.stack = append(z.stack, z.finChar)
+		return nil
+	}
+	if code == compressClear && z.blockMode {
+		if err := z.skipGroup(); err != nil {
+			return err
+		}
+		z.freeEnt = compressClear
+		z.width = compressInitBits
+		z.maxCode = 1<<z.width - 1
+		return nil
+	}
+
+	inCode := code
+	if code >= z.freeEnt {
+		// the code being defined by this very step (KwKwK)
+		if code > z.freeEnt {
+			return errCompressCorrupt
+		}
+		z.stack = append(z.stack, z.finChar)
+		code = z.oldCode
+	}
+	for code >= 256 {
+		z.stack = append(z.stack, z.suffix[code])
+		code = int(z.prefix[code])
+	}
+	z.finChar = byte(code)
+	z.stack = append(z.stack, z.finChar)
+
+	if z.freeEnt < 1<<z.maxBits {
+		z.prefix[z.freeEnt] = uint16(z.oldCode)
+		z.suffix[z.freeEnt] = z.finChar
+		z.freeEnt++
+	}
+	z.oldCode = inCode
+	return nil
+}
+
+// readCode returns the next code of the current width. The stream
+// simply ends at a code boundary, so io.EOF there is not an error.
+func (z *compressReader) readCode() (int, error) {
+	for z.nbits < uint32(z.width) {
+		b, err := z.src.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		z.bits |= uint32(b) << z.nbits
+		z.nbits += 8
+	}
+	code := int(z.bits & (1<<z.width - 1))
+	z.bits >>= z.width
+	z.nbits -= uint32(z.width)
+	z.groupCodes++
+	return code, nil
+}
+
+// skipGroup discards the padding up to the end of the current group.
+func (z *compressReader) skipGroup() error {
+	for z.groupCodes%8 != 0 {
+		if _, err := z.readCode(); err != nil {
+			return err
+		}
+	}
+	z.groupCodes = 0
+	return nil
+}
+
+func (z *compressReader) Close() error { return nil }
@@ -0,0 +1,213 @@
+//go:build ungzip_compress
+
+package ungzip
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+// compressZ encodes data in the compress(1) format with codes of up
+// to maxBits, clearing the table after every clearEvery codes if that
+// is not zero, which needs block mode.
+func compressZ(data []byte, maxBits uint, blockMode bool, clearEvery int) []byte {
+	z := &zWriter{width: compressInitBits, maxBits: maxBits, decFree: 256}
+	flags := byte(maxBits)
+	if blockMode {
+		flags |= 0x80
+		z.decFree = compressClear + 1
+	}
+	z.out.Write([]byte{0x1f, 0x9d, flags})
+
+	reset := func() (map[string]int, int) {
+		if blockMode {
+			return map[string]int{}, compressClear + 1
+		}
+		return map[string]int{}, 256
+	}
+	dict, next := reset()
+	code := func(s string) int {
+		if len(s) == 1 {
+			return int(s[0])
+		}
+		return dict[s]
+	}
+	codes := 0
+	var w string
+	for i := range data {
+		c := string(data[i : i+1])
+		if _, ok := dict[w+c]; ok || w == "" {
+			w += c
+			continue
+		}
+		z.code(code(w))
+		codes++
+		if clearEvery > 0 && codes%clearEvery == 0 {
+			z.clear()
+			dict, next = reset()
+		} else if next < 1<<maxBits {
+			dict[w+c] = next
+			next++
+		}
+		w = c
+	}
+	if w != "" {
+		z.code(code(w))
+	}
+	return z.bytes()
+}
+
+// zWriter writes codes the way compress(1) does. It tracks the table
+// size of the decoder, one entry behind the encoder's, which decides
+// when the code width grows.
+type zWriter struct {
+	out            bytes.Buffer
+	bits           uint64
+	nbits          uint
+	width, maxBits uint
+	group          int
+	decFree        int
+	started        bool
+}
+
+func (z *zWriter) write(code int) {
+	z.bits |= uint64(code) << z.nbits
+	z.nbits += z.width
+	z.group++
+	for z.nbits >= 8 {
+		z.out.WriteByte(byte(z.bits))
+		z.bits >>= 8
+		z.nbits -= 8
+	}
+}
+
+func (z *zWriter) pad() {
+	for z.group%8 != 0 {
+		z.write(0)
+	}
+	z.group = 0
+}
+
+// grow widens codes once the decoder's table outgrows them.
+func (z *zWriter) grow() {
+	if z.decFree > 1<<z.width-1 && z.width < z.maxBits {
+		z.pad()
+		z.width++
+	}
+}
+
+func (z *zWriter) code(code int) {
+	z.grow()
+	z.write(code)
+	if z.started && z.decFree < 1<<z.maxBits {
+		z.decFree++
+	}
+	z.started = true
+}
+
+func (z *zWriter) clear() {
+	z.grow()
+	z.write(compressClear)
+	z.pad()
+	z.width = compressInitBits
+	z.decFree = compressClear
+}
+
+func (z *zWriter) bytes() []byte {
+	if z.nbits > 0 {
+		z.out.WriteByte(byte(z.bits))
+	}
+	return z.out.Bytes()
+}
+
+func TestCompressReader(t *testing.T) {
+	var text strings.Builder
+	for i := range 20000 {
+		text.WriteString(string(rune('a' + i*7%26)))
+		if i%11 == 0 {
+			text.WriteString(" ")
+		}
+	}
+	long := []byte(text.String())
+	tobe := []byte("TOBEORNOTTOBEORTOBEORNOT")
+
+	for _, tc := range []struct {
+		name string
+		src  []byte
+		want []byte
+		err  error
+	}{
+		{name: "empty", src: compressZ(nil, 16, true, 0), want: []byte{}},
+		{name: "one byte", src: compressZ([]byte("x"), 16, true, 0), want: []byte("x")},
+		{name: "short", src: compressZ(tobe, 16, true, 0), want: tobe},
+		{name: "code defined by its own use", src: compressZ(bytes.Repeat([]byte("a"), 100), 16, true, 0), want: bytes.Repeat([]byte("a"), 100)},
+		{name: "all byte values", src: compressZ(allBytes(), 16, true, 0), want: allBytes()},
+		{name: "code width growing", src: compressZ(long, 16, true, 0), want: long},
+		{name: "not block mode", src: compressZ(long, 16, false, 0), want: long},
+		{name: "smallest table", src: compressZ(long, 9, false, 0), want: long},
+		{name: "full table", src: compressZ(long, 12, true, 0), want: long},
+		{name: "clear codes", src: compressZ(long, 16, true, 300), want: long},
+		{name: "clear after the first code", src: compressZ(tobe, 16, true, 1), want: tobe},
+		{name: "bad magic", src: []byte{0x1f, 0x8b, 0x90, 0}, err: errors.New("compress: invalid header")},
+		{name: "truncated header", src: []byte{0x1f, 0x9d}, err: io.ErrUnexpectedEOF},
+		{name: "no header", src: nil, err: io.EOF},
+		{name: "code width too small", src: []byte{0x1f, 0x9d, 0x88}, err: errors.New("compress: unsupported code width")},
+		{name: "code width too large", src: []byte{0x1f, 0x9d, 0x91}, err: errors.New("compress: unsupported code width")},
+		// the first code must be a literal: 300 in 9 bits
+		{name: "first code not a literal", src: []byte{0x1f, 0x9d, 0x90, 0x2c, 0x01}, err: errCompressCorrupt},
+		// 'A' and then 400, past the next code to be defined
+		{name: "code not yet defined", src: []byte{0x1f, 0x9d, 0x90, 0x41, 0x20, 0x03}, err: errCompressCorrupt},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			zr, err := newCompressReader(bytes.NewReader(tc.src))
+			var got []byte
+			if err == nil {
+				got, err = io.ReadAll(zr)
+			}
+			if tc.err != nil {
+				if err == nil || err.Error() != tc.err.Error() {
+					t.Fatalf("got %v, want %v", err, tc.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, tc.want) {
+				t.Errorf("got %d bytes, want %d", len(got), len(tc.want))
+			}
+		})
+	}
+}
+
+// TestCompressReaderTruncated checks that a stream cut short decodes to
+// a prefix of its content: the format has no end marker or length, so
+// that is all a decoder can do.
+func TestCompressReaderTruncated(t *testing.T) {
+	data := bytes.Repeat([]byte("truncated compress stream "), 200)
+	src := compressZ(data, 16, true, 0)
+	for n := 3; n < len(src); n += 37 {
+		zr, err := newCompressReader(bytes.NewReader(src[:n]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := io.ReadAll(zr)
+		if err != nil {
+			t.Fatalf("truncated to %d bytes: got %v", n, err)
+		}
+		if !bytes.HasPrefix(data, got) {
+			t.Errorf("truncated to %d bytes: got %d bytes that are not a prefix", n, len(got))
+		}
+	}
+}
+
+func allBytes() []byte {
+	b := make([]byte, 256)
+	for i := range b {
+		b[i] = byte(i)
+	}
+	return b
+}
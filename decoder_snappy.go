@@ -0,0 +1,19 @@
+//go:build ungzip_snappy
+
+package ungzip
+
+import (
+	"io"
+
+	"github.com/klauspost/compress/s2"
+)
+
+func init() {
+	// s2 reads the snappy framing format as well as its own
+	RegisterDecoder("x-snappy-framed", Decoder{
+		Magic: []byte("\xff\x06\x00\x00sNaPpY"),
+		NewReader: func(src io.Reader) (io.ReadCloser, error) {
+			return io.NopCloser(s2.NewReader(src)), nil
+		},
+	})
+}
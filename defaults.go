@@ -0,0 +1,100 @@
+package ungzip
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+)
+
+func init() {
+	httpcaddyfile.RegisterGlobalOption("ungzip", parseGlobalOption)
+}
+
+// parseGlobalOption parses the ungzip global option, which takes the
+// same arguments and subdirectives as the directive and sets defaults
+// for every ungzip directive in the Caddyfile, and for the encodings,
+// max_size and max_encoding_layers of decode directives:
+//
+//	{
+//		ungzip {
+//			max_size 20971520
+//			encodings gzip zstd
+//		}
+//	}
+//
+// The tokens are kept and parsed again in front of each directive's, so
+// directives merge with the defaults as they do with repeated blocks,
+// and need only give what differs for their site. A directive with the
+// no_inherit subdirective starts from the built-in defaults instead.
+func parseGlobalOption(d *caddyfile.Dispenser, existing any) (any, error) {
+	if noInherit(d) {
+		return nil, d.Err("no_inherit only applies to ungzip directives")
+	}
+	d.Reset()
+	if err := new(ResponseUngzip).UnmarshalCaddyfile(d); err != nil {
+		return nil, err
+	}
+	d.Reset()
+	defaults, _ := existing.([]*caddyfile.Dispenser)
+	return append(defaults, d), nil
+}
+
+// noInherit reports whether the block in d has the no_inherit
+// subdirective, leaving d past the block.
+func noInherit(d *caddyfile.Dispenser) bool {
+	for d.Next() {
+		for d.NextBlock(0) {
+			if d.Nesting() == 1 && d.Val() == "no_inherit" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// applyGlobalDefaults parses the ungzip global options into r.
+func applyGlobalDefaults(h httpcaddyfile.Helper, r *ResponseUngzip) error {
+	defaults, _ := h.Option("ungzip").([]*caddyfile.Dispenser)
+	for _, d := range defaults {
+		d.Reset()
+		if err := r.UnmarshalCaddyfile(d); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Environment variables that set defaults for options the config
+// leaves unset. The config, including the ungzip global option, takes
+// precedence over them; they take precedence over built-in defaults.
+const (
+	envMaxSize           = "CADDY_UNGZIP_MAX_SIZE"
+	envEncodings         = "CADDY_UNGZIP_ENCODINGS"
+	envMaxEncodingLayers = "CADDY_UNGZIP_MAX_ENCODING_LAYERS"
+)
+
+// applyEnvDefaults fills in options left unset from the environment.
+func (r *ResponseUngzip) applyEnvDefaults() error {
+	if v := os.Getenv(envMaxSize); v != "" && r.MaxSize == 0 && r.MaxSizeFrom == "" {
+		size, err := parseSize(v)
+		if err != nil {
+			return fmt.Errorf("invalid %s: %v", envMaxSize, err)
+		}
+		r.MaxSize = size
+	}
+	if v := os.Getenv(envEncodings); v != "" && len(r.Encodings) == 0 {
+		r.Encodings = strings.FieldsFunc(v, func(c rune) bool { return c == ',' || c == ' ' })
+	}
+	if v := os.Getenv(envMaxEncodingLayers); v != "" && r.MaxEncodingLayers == 0 {
+		layers, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("invalid %s: %v", envMaxEncodingLayers, err)
+		}
+		r.MaxEncodingLayers = layers
+	}
+	return nil
+}
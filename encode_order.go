@@ -0,0 +1,224 @@
+package ungzip
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+
+	"go.uber.org/zap"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// encodeOrder returns where an encode handler runs relative to the
+// response_ungzip handler being provisioned with ctx: "before" if one
+// wraps it, and so compresses decompressed responses again, "after" if
+// one is wrapped by it, and so compresses upstream responses only for
+// them to be decompressed, or "" if neither or it can't be told.
+//
+// Only the chain of routes the handler is in is walked: the handlers
+// that precede it in its route, and those of the routes before it, at
+// every level of subroutes, wrap it; those that follow, up to a
+// terminal route, are wrapped by it. Routes with matchers or in a
+// group may not run, so their handlers are not taken into account,
+// except in the routes that hold the handler. Where a route holding it
+// has more than one subroute or response_ungzip handler, the first is
+// taken to be the one it is in.
+func encodeOrder(ctx caddy.Context) string {
+	srv, ok := ctx.Value(caddyhttp.ServerCtxKey).(*caddyhttp.Server)
+	if !ok {
+		return ""
+	}
+	lists := []caddyhttp.RouteList{srv.Routes}
+	if srv.Errors != nil && provisioning(srv.Routes) < 0 {
+		lists[0] = srv.Errors.Routes
+	}
+	for _, mod := range ctx.Modules() {
+		if sub, ok := mod.(*caddyhttp.Subroute); ok {
+			lists = append(lists, sub.Routes)
+		}
+	}
+	return encodeOrderIn(lists)
+}
+
+// encodeOrderIn is encodeOrder for the route lists the handler is in,
+// outermost first, while they are being provisioned.
+func encodeOrderIn(lists []caddyhttp.RouteList) string {
+	// the position of the handler in each list, outermost first
+	type position struct {
+		routes  []orderRoute
+		route   int
+		handler int
+	}
+	path := make([]position, len(lists))
+	for i, list := range lists {
+		name := "subroute"
+		if i == len(lists)-1 {
+			name = "response_ungzip"
+		}
+		route := provisioning(list)
+		if route < 0 {
+			return ""
+		}
+		routes := orderRoutes(list)
+		handler := slices.IndexFunc(routes[route].handlers, func(h orderHandler) bool {
+			return h.name == name
+		})
+		if handler < 0 {
+			return ""
+		}
+		path[i] = position{routes, route, handler}
+	}
+
+	for _, p := range path {
+		if slices.ContainsFunc(p.routes[p.route].handlers[:p.handler], orderHandler.encodes) {
+			return "before"
+		}
+		for _, route := range p.routes[:p.route] {
+			if !route.conditional && slices.ContainsFunc(route.handlers, orderHandler.encodes) {
+				return "before"
+			}
+		}
+	}
+	for i := len(path) - 1; i >= 0; i-- {
+		p := path[i]
+		if slices.ContainsFunc(p.routes[p.route].handlers[p.handler+1:], orderHandler.encodes) {
+			return "after"
+		}
+		if p.routes[p.route].terminal {
+			return ""
+		}
+		encodes, terminal := encodesIn(p.routes[p.route+1:])
+		if encodes {
+			return "after"
+		}
+		if terminal {
+			return ""
+		}
+	}
+	return ""
+}
+
+// provisioning returns the index of the route of routes whose handlers
+// are being provisioned, or -1 if there is none: routes are provisioned
+// in order, and loading their handlers clears their raw config.
+func provisioning(routes caddyhttp.RouteList) int {
+	return slices.IndexFunc(routes, func(route caddyhttp.Route) bool {
+		return len(route.HandlersRaw) > 0
+	})
+}
+
+// orderRoute is a route as far as encodeOrder is concerned.
+type orderRoute struct {
+	conditional bool
+	terminal    bool
+	handlers    []orderHandler
+}
+
+// orderHandler is a handler as far as encodeOrder is concerned.
+type orderHandler struct {
+	name   string
+	routes []orderRoute // of subroutes
+}
+
+// encodes reports whether h is or surely runs an encode handler.
+func (h orderHandler) encodes() bool {
+	encodes, _ := encodesIn(h.routes)
+	return h.name == "encode" || encodes
+}
+
+// encodesIn reports whether routes surely run an encode handler, and
+// whether they surely end with a terminal route otherwise.
+func encodesIn(routes []orderRoute) (encodes, terminal bool) {
+	for _, route := range routes {
+		if route.conditional {
+			continue
+		}
+		if slices.ContainsFunc(route.handlers, orderHandler.encodes) {
+			return true, false
+		}
+		if route.terminal {
+			return false, true
+		}
+	}
+	return false, false
+}
+
+// orderRoutes returns routes as encodeOrder sees them. The routes are
+// being provisioned: those done so far have their handlers, the others
+// only their raw config.
+func orderRoutes(routes caddyhttp.RouteList) []orderRoute {
+	out := make([]orderRoute, len(routes))
+	for i, route := range routes {
+		out[i] = orderRoute{
+			conditional: len(route.MatcherSetsRaw) > 0 || len(route.MatcherSets) > 0 || route.Group != "",
+			terminal:    route.Terminal,
+		}
+		for _, raw := range route.HandlersRaw {
+			out[i].handlers = append(out[i].handlers, rawOrderHandler(raw))
+		}
+		for _, h := range route.Handlers {
+			if sub, ok := h.(*caddyhttp.Subroute); ok {
+				out[i].handlers = append(out[i].handlers, orderHandler{name: "subroute", routes: orderRoutes(sub.Routes)})
+			} else if mod, ok := h.(caddy.Module); ok {
+				out[i].handlers = append(out[i].handlers, orderHandler{name: mod.CaddyModule().ID.Name()})
+			}
+		}
+	}
+	return out
+}
+
+// rawOrderHandler is orderRoutes for a handler not provisioned yet.
+func rawOrderHandler(raw json.RawMessage) orderHandler {
+	var handler struct {
+		Handler string `json:"handler"`
+		Routes  []struct {
+			Match    []json.RawMessage `json:"match"`
+			Group    string            `json:"group"`
+			Handle   []json.RawMessage `json:"handle"`
+			Terminal bool              `json:"terminal"`
+		} `json:"routes"`
+	}
+	if err := json.Unmarshal(raw, &handler); err != nil {
+		return orderHandler{}
+	}
+	h := orderHandler{name: handler.Handler}
+	if handler.Handler != "subroute" {
+		return h
+	}
+	for _, route := range handler.Routes {
+		r := orderRoute{
+			conditional: len(route.Match) > 0 || route.Group != "",
+			terminal:    route.Terminal,
+		}
+		for _, raw := range route.Handle {
+			r.handlers = append(r.handlers, rawOrderHandler(raw))
+		}
+		h.routes = append(h.routes, r)
+	}
+	return h
+}
+
+// checkEncodeOrder applies the encode_order policy to the config being
+// loaded with ctx.
+func (r *ResponseUngzip) checkEncodeOrder(ctx caddy.Context) error {
+	if r.EncodeOrder == "ignore" {
+		return nil
+	}
+	var problem string
+	switch encodeOrder(ctx) {
+	case "before":
+		problem = "an encode handler runs before response_ungzip and compresses decompressed responses again"
+	case "after":
+		problem = "an encode handler runs after response_ungzip and compresses responses only for them to be decompressed"
+	default:
+		return nil
+	}
+	if r.EncodeOrder == "error" {
+		return fmt.Errorf("%s; order ungzip before encode, or set encode_order ignore if this is intended", problem)
+	}
+	r.logger.Warn(problem,
+		zap.String("hint", "order ungzip before encode, or set encode_order ignore if this is intended"))
+	return nil
+}
@@ -0,0 +1,124 @@
+package ungzip
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/encode"
+)
+
+func TestEncodeOrder(t *testing.T) {
+	// handlers not provisioned yet, as the routes from the one being
+	// provisioned on still have them
+	raw := func(handlers ...string) []json.RawMessage {
+		var out []json.RawMessage
+		for _, h := range handlers {
+			out = append(out, json.RawMessage(h))
+		}
+		return out
+	}
+	const (
+		ungzip = `{"handler":"response_ungzip","encode_order":"error"}`
+		enc    = `{"handler":"encode","encodings":{"gzip":{}}}`
+	)
+	subroute := func(handlers ...string) string {
+		routes := `[`
+		for i, h := range handlers {
+			if i > 0 {
+				routes += `,`
+			}
+			routes += `{"handle":[` + h + `]}`
+		}
+		return `{"handler":"subroute","routes":` + routes + `]}`
+	}
+	host := func(name string) caddyhttp.RawMatcherSets {
+		return caddyhttp.RawMatcherSets{{"host": json.RawMessage(`["` + name + `"]`)}}
+	}
+	encoder := []caddyhttp.MiddlewareHandler{new(encode.Encode)}
+
+	for _, tc := range []struct {
+		name  string
+		lists []caddyhttp.RouteList
+		want  string
+	}{
+		{
+			name: "alone",
+			lists: []caddyhttp.RouteList{
+				{{MatcherSetsRaw: host("a"), HandlersRaw: raw(subroute(ungzip)), Terminal: true}},
+				{{HandlersRaw: raw(ungzip)}},
+			},
+		},
+		{
+			name: "before",
+			lists: []caddyhttp.RouteList{
+				{{MatcherSetsRaw: host("a"), HandlersRaw: raw(subroute(enc, ungzip)), Terminal: true}},
+				{{Handlers: encoder}, {HandlersRaw: raw(ungzip)}},
+			},
+			want: "before",
+		},
+		{
+			name: "after",
+			lists: []caddyhttp.RouteList{
+				{{MatcherSetsRaw: host("a"), HandlersRaw: raw(subroute(ungzip, enc)), Terminal: true}},
+				{{HandlersRaw: raw(ungzip)}, {HandlersRaw: raw(enc)}},
+			},
+			want: "after",
+		},
+		{
+			name: "after in the same route",
+			lists: []caddyhttp.RouteList{
+				{{HandlersRaw: raw(ungzip, enc)}},
+			},
+			want: "after",
+		},
+		{
+			name: "wrapping the site",
+			lists: []caddyhttp.RouteList{
+				{{Handlers: encoder}, {MatcherSetsRaw: host("a"), HandlersRaw: raw(subroute(ungzip)), Terminal: true}},
+				{{HandlersRaw: raw(ungzip)}},
+			},
+			want: "before",
+		},
+		{
+			name: "in another site",
+			lists: []caddyhttp.RouteList{
+				{
+					{MatcherSets: caddyhttp.MatcherSets{{caddyhttp.MatchHost{"a"}}}, Handlers: []caddyhttp.MiddlewareHandler{
+						&caddyhttp.Subroute{Routes: caddyhttp.RouteList{{Handlers: encoder}}},
+					}, Terminal: true},
+					{MatcherSetsRaw: host("b"), HandlersRaw: raw(subroute(ungzip)), Terminal: true},
+				},
+				{{HandlersRaw: raw(ungzip)}},
+			},
+		},
+		{
+			name: "in another site after",
+			lists: []caddyhttp.RouteList{
+				{
+					{MatcherSetsRaw: host("b"), HandlersRaw: raw(subroute(ungzip)), Terminal: true},
+					{MatcherSetsRaw: host("a"), HandlersRaw: raw(subroute(enc)), Terminal: true},
+				},
+				{{HandlersRaw: raw(ungzip)}},
+			},
+		},
+		{
+			name: "behind a matcher",
+			lists: []caddyhttp.RouteList{
+				{{MatcherSetsRaw: host("a"), HandlersRaw: raw(subroute(`{"handler":"subroute","routes":[{"match":[{"path":["/x"]}],"handle":[`+enc+`]}]}`, ungzip)), Terminal: true}},
+				{
+					{Handlers: []caddyhttp.MiddlewareHandler{&caddyhttp.Subroute{Routes: caddyhttp.RouteList{
+						{MatcherSets: caddyhttp.MatcherSets{{caddyhttp.MatchPath{"/x"}}}, Handlers: encoder},
+					}}}},
+					{HandlersRaw: raw(ungzip)},
+				},
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := encodeOrderIn(tc.lists); got != tc.want {
+				t.Errorf("got %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,77 @@
+package ungzip
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// The classes of decode failure. When on_error is "error", or for
+// request bodies, the failure is returned as a caddyhttp.HandlerError
+// whose error matches its class with errors.Is, and the class code is
+// set in the ungzip_error variable, so that handle_errors routes can
+// branch on {http.vars.ungzip_error}.
+var (
+	// ErrTooLarge is the class of bodies past max_size,
+	// max_decompressed_size or the input limit. Code: too_large
+	ErrTooLarge = errors.New("body too large")
+
+	// ErrBadStream is the class of bodies that cannot be decoded, such
+	// as corrupt or truncated streams. Code: bad_stream
+	ErrBadStream = errors.New("undecodable body")
+
+	// ErrRatioExceeded is the class of bodies that expand by more than
+	// max_ratio. Code: ratio_exceeded
+	ErrRatioExceeded = errors.New("expansion ratio exceeded")
+
+	// ErrTimeout is the class of decodes past decode_timeout. Code: timeout
+	ErrTimeout = errors.New("decode timed out")
+)
+
+// errorCodes are the ungzip_error values of the error classes.
+var errorCodes = map[error]string{
+	ErrTooLarge:      "too_large",
+	ErrBadStream:     "bad_stream",
+	ErrRatioExceeded: "ratio_exceeded",
+	ErrTimeout:       "timeout",
+}
+
+// errorClass returns the class of err, ErrBadStream if it is none of
+// the others.
+func errorClass(err error) error {
+	for _, class := range []error{ErrTooLarge, ErrRatioExceeded, ErrTimeout} {
+		if errors.Is(err, class) {
+			return class
+		}
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return ErrTimeout
+	}
+	return ErrBadStream
+}
+
+// classifiedError returns err as a caddyhttp.HandlerError wrapping its
+// class, setting the ungzip_error variable of req to the class code.
+// The status is that of err if it is a caddyhttp.HandlerError already,
+// else status, else that of the class if status is 0.
+func classifiedError(req *http.Request, status int, err error) error {
+	var handlerErr caddyhttp.HandlerError
+	if errors.As(err, &handlerErr) {
+		status, err = handlerErr.StatusCode, handlerErr.Err
+	}
+	class := errorClass(err)
+	if !errors.Is(err, class) {
+		err = fmt.Errorf("%w: %w", class, err)
+	}
+	if status == 0 {
+		status = http.StatusBadGateway
+		if class == ErrTimeout {
+			status = http.StatusGatewayTimeout
+		}
+	}
+	caddyhttp.SetVar(req.Context(), "ungzip_error", errorCodes[class])
+	return caddyhttp.Error(status, err)
+}
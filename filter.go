@@ -0,0 +1,119 @@
+package ungzip
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+)
+
+// ErrSkip may be returned by a Filter or Inspector to abandon the
+// transformation and serve the original, still compressed, response.
+var ErrSkip = errors.New("skip transformation")
+
+// BlockError may be returned by a Filter to replace the response with
+// a page of its own, such as when the content must not reach the
+// client. Unlike other errors it is not subject to the on_error policy.
+type BlockError struct {
+	Status      int
+	ContentType string
+	Body        []byte
+
+	// Reason is used for the error message
+	Reason string
+}
+
+func (e *BlockError) Error() string {
+	return fmt.Sprintf("response blocked (%d): %s", e.Status, e.Reason)
+}
+
+// inspectSize is the amount of decompressed data handed to Inspectors.
+const inspectSize = 4096
+
+// Filter is implemented by modules in the
+// http.handlers.response_ungzip.filters namespace. Filters run in
+// order on the fully decompressed body and return the body to pass on
+// to the next filter. They may modify header, which holds the
+// response headers that will be sent to the client.
+type Filter interface {
+	Filter(req *http.Request, header http.Header, body []byte) ([]byte, error)
+}
+
+// Inspector may be implemented by filters that can decide from the
+// start of a body alone that it should not be transformed, such as when
+// it is not in the format the filter expects. Inspect is called with
+// up to the first 4KB of decompressed data before the rest is inflated.
+// Returning ErrSkip serves the original response without doing that
+// work; any other error is handled like a decoding failure.
+type Inspector interface {
+	Inspect(req *http.Request, header http.Header, chunk []byte) error
+}
+
+// inspect runs the configured Inspectors on the start of src, which is
+// compressed with codings.
+func (r ResponseUngzip) inspect(req *http.Request, header http.Header, codings []string, src []byte) (err error) {
+	defer r.recoverPanic(&err)
+
+	var inspectors []Inspector
+	for _, f := range r.filters {
+		if in, ok := f.(Inspector); ok {
+			inspectors = append(inspectors, in)
+		}
+	}
+	if len(inspectors) == 0 {
+		return nil
+	}
+
+	reader, err := r.newReader(codings, bytes.NewReader(src))
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	chunk := make([]byte, inspectSize)
+	n, err := io.ReadFull(reader, chunk)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return err
+	}
+	for _, in := range inspectors {
+		if err := in.Inspect(req, header, chunk[:n]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// filter runs the configured filters over the decompressed body in buf,
+// leaving the result in buf.
+func (r ResponseUngzip) filter(req *http.Request, header http.Header, buf *bytes.Buffer) (err error) {
+	if len(r.filters) == 0 {
+		return nil
+	}
+	defer r.recoverPanic(&err)
+
+	body := buf.Bytes()
+	for _, f := range r.filters {
+		if body, err = f.Filter(req, header, body); err != nil {
+			return err
+		}
+	}
+	buf.Reset()
+	buf.Write(body)
+	return nil
+}
+
+// block replaces the response with the page described by b.
+func (r ResponseUngzip) block(w http.ResponseWriter, b *BlockError) error {
+	h := w.Header()
+	for _, field := range []string{"Content-Encoding", "Etag", "Last-Modified", "Accept-Ranges", "Trailer"} {
+		h.Del(field)
+	}
+	h.Set("Content-Type", b.ContentType)
+	h.Set("Content-Length", strconv.Itoa(len(b.Body)))
+	h.Set("Cache-Control", "no-store")
+	w.WriteHeader(b.Status)
+	_, err := w.Write(b.Body)
+	return err
+}
@@ -0,0 +1,237 @@
+package ungzip
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyevents"
+)
+
+func init() {
+	caddy.RegisterModule(ClamAV{})
+}
+
+// ClamAV is a filter that streams decompressed bodies to clamd with the
+// INSTREAM command. When clamd reports a detection, the response is
+// replaced with a block page, the detection is logged and an
+// ungzip_malware_detected event is emitted. If clamd can't be reached
+// or fails, the error is handled by the handler's on_error policy.
+type ClamAV struct {
+	// Address of clamd, such as localhost:3310 or
+	// unix//run/clamav/clamd.ctl
+	Address string `json:"address"`
+
+	// Maximum time to wait for a scan
+	// Default: 10s
+	Timeout caddy.Duration `json:"timeout,omitempty"`
+
+	// Status code of the block page
+	// Default: 403
+	BlockStatus int `json:"block_status,omitempty"`
+
+	// Body of the block page
+	// Default: "Forbidden"
+	BlockBody string `json:"block_body,omitempty"`
+
+	// Content-Type of the block page
+	// Default: text/plain; charset=utf-8
+	BlockContentType string `json:"block_content_type,omitempty"`
+
+	addr   caddy.NetworkAddress
+	ctx    caddy.Context
+	events *caddyevents.App
+	logger *zap.Logger
+}
+
+// CaddyModule returns the Caddy module information.
+func (ClamAV) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.handlers.response_ungzip.filters.clamav",
+		New: func() caddy.Module { return new(ClamAV) },
+	}
+}
+
+// UnmarshalCaddyfile implements caddyfile.Unmarshaler.
+//
+//	filter clamav <address> {
+//		timeout <duration>
+//		block_status <code>
+//		block_body <text>
+//		block_content_type <type>
+//	}
+func (c *ClamAV) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // consume filter name
+	if !d.Args(&c.Address) {
+		return d.ArgErr()
+	}
+	for d.NextBlock(0) {
+		switch d.Val() {
+		case "timeout":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			dur, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return d.Errf("invalid timeout: %v", err)
+			}
+			c.Timeout = caddy.Duration(dur)
+		case "block_status":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			status, err := strconv.Atoi(d.Val())
+			if err != nil {
+				return d.Errf("invalid block_status: %v", err)
+			}
+			c.BlockStatus = status
+		case "block_body":
+			if !d.Args(&c.BlockBody) {
+				return d.ArgErr()
+			}
+		case "block_content_type":
+			if !d.Args(&c.BlockContentType) {
+				return d.ArgErr()
+			}
+		default:
+			return d.Errf("unknown subdirective %s", d.Val())
+		}
+	}
+	return nil
+}
+
+// Provision implements caddy.Provisioner.
+func (c *ClamAV) Provision(ctx caddy.Context) error {
+	c.ctx = ctx
+	c.logger = ctx.Logger()
+	eventsApp, err := ctx.App("events")
+	if err != nil {
+		return fmt.Errorf("getting events app: %v", err)
+	}
+	c.events = eventsApp.(*caddyevents.App)
+
+	c.addr, err = caddy.ParseNetworkAddress(c.Address)
+	if err != nil {
+		return fmt.Errorf("invalid address: %v", err)
+	}
+	if c.Timeout == 0 {
+		c.Timeout = caddy.Duration(10 * time.Second)
+	}
+	if c.BlockStatus == 0 {
+		c.BlockStatus = http.StatusForbidden
+	}
+	if c.BlockBody == "" {
+		c.BlockBody = http.StatusText(c.BlockStatus)
+	}
+	if c.BlockContentType == "" {
+		c.BlockContentType = "text/plain; charset=utf-8"
+	}
+	return nil
+}
+
+// Validate implements caddy.Validator.
+func (c *ClamAV) Validate() error {
+	if c.Address == "" {
+		return fmt.Errorf("address is required")
+	}
+	if c.BlockStatus < 100 || c.BlockStatus > 999 {
+		return fmt.Errorf("invalid block_status %d", c.BlockStatus)
+	}
+	return nil
+}
+
+// Filter implements Filter.
+func (c *ClamAV) Filter(req *http.Request, header http.Header, body []byte) ([]byte, error) {
+	signature, err := c.scan(req.Context(), body)
+	if err != nil {
+		return nil, fmt.Errorf("clamav scan: %v", err)
+	}
+	if signature == "" {
+		return body, nil
+	}
+
+	c.logger.Warn("malware detected",
+		zap.String("uri", req.RequestURI),
+		zap.String("signature", signature))
+	c.events.Emit(c.ctx, "ungzip_malware_detected", map[string]any{
+		"uri":       req.RequestURI,
+		"host":      req.Host,
+		"signature": signature,
+	})
+
+	return nil, &BlockError{
+		Status:      c.BlockStatus,
+		ContentType: c.BlockContentType,
+		Body:        []byte(c.BlockBody),
+		Reason:      "malware detected: " + signature,
+	}
+}
+
+// scan sends body to clamd and returns the name of the signature it
+// matched, or an empty string if it is clean.
+func (c *ClamAV) scan(ctx context.Context, body []byte) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(c.Timeout))
+	defer cancel()
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, c.addr.Network, c.addr.JoinHostPort(0))
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+
+	w := bufio.NewWriter(conn)
+	w.WriteString("zINSTREAM\x00")
+	const chunkSize = 64 * 1024
+	var size [4]byte
+	for len(body) > 0 {
+		n := min(len(body), chunkSize)
+		binary.BigEndian.PutUint32(size[:], uint32(n))
+		w.Write(size[:])
+		w.Write(body[:n])
+		body = body[n:]
+	}
+	binary.BigEndian.PutUint32(size[:], 0)
+	w.Write(size[:])
+	if err := w.Flush(); err != nil {
+		return "", err
+	}
+
+	reply, err := bufio.NewReader(conn).ReadBytes(0)
+	if err != nil && len(reply) == 0 {
+		return "", err
+	}
+	result := strings.TrimSpace(string(bytes.TrimRight(reply, "\x00")))
+	result = strings.TrimPrefix(result, "stream: ")
+
+	switch {
+	case strings.HasSuffix(result, " FOUND"):
+		return strings.TrimSuffix(result, " FOUND"), nil
+	case result == "OK":
+		return "", nil
+	default:
+		return "", fmt.Errorf("clamd: %s", result)
+	}
+}
+
+// Interface guards
+var (
+	_ caddy.Provisioner     = (*ClamAV)(nil)
+	_ caddy.Validator       = (*ClamAV)(nil)
+	_ caddyfile.Unmarshaler = (*ClamAV)(nil)
+	_ Filter                = (*ClamAV)(nil)
+)
@@ -0,0 +1,261 @@
+package ungzip
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+func init() {
+	caddy.RegisterModule(DLP{})
+}
+
+// DLP is a filter that scans decompressed textual bodies for sensitive
+// data, such as identity or card numbers or internal code names, and
+// logs, redacts or blocks what it finds. Matches are counted in the
+// caddy_http_ungzip_dlp_matches_total metric by rule and action; the
+// matched text itself is never logged.
+type DLP struct {
+	Rules []DLPRule `json:"rules,omitempty"`
+
+	// Status code of the block page
+	// Default: 403
+	BlockStatus int `json:"block_status,omitempty"`
+
+	// Body of the block page
+	// Default: "Forbidden"
+	BlockBody string `json:"block_body,omitempty"`
+
+	patterns []*regexp.Regexp
+	matches  *prometheus.CounterVec
+	logger   *zap.Logger
+}
+
+// DLPRule describes sensitive content and what to do when it is found.
+type DLPRule struct {
+	// Name of the rule, used in logs and metrics
+	Name string `json:"name"`
+
+	// Regular expression to search for
+	Pattern string `json:"pattern,omitempty"`
+
+	// Literal strings to search for, in addition to pattern
+	Keywords []string `json:"keywords,omitempty"`
+
+	// "log" only records matches, "redact" replaces them with
+	// replacement, "block" replaces the whole response with the
+	// block page
+	// Default: log
+	Action string `json:"action,omitempty"`
+
+	// Text that replaces redacted matches
+	// Default: [REDACTED]
+	Replacement string `json:"replacement,omitempty"`
+}
+
+// CaddyModule returns the Caddy module information.
+func (DLP) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.handlers.response_ungzip.filters.dlp",
+		New: func() caddy.Module { return new(DLP) },
+	}
+}
+
+// UnmarshalCaddyfile implements caddyfile.Unmarshaler.
+//
+//	filter dlp {
+//		rule <name> {
+//			pattern <regexp>
+//			keywords <words...>
+//			action log|redact|block
+//			replacement <text>
+//		}
+//		block_status <code>
+//		block_body <text>
+//	}
+func (f *DLP) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // consume filter name
+	for d.NextBlock(0) {
+		switch d.Val() {
+		case "rule":
+			var rule DLPRule
+			if !d.Args(&rule.Name) {
+				return d.ArgErr()
+			}
+			for nesting := d.Nesting(); d.NextBlock(nesting); {
+				switch d.Val() {
+				case "pattern":
+					if !d.Args(&rule.Pattern) {
+						return d.ArgErr()
+					}
+					if _, err := regexp.Compile(rule.Pattern); err != nil {
+						return d.Errf("invalid pattern: %v", err)
+					}
+				case "keywords":
+					args := d.RemainingArgs()
+					if len(args) == 0 {
+						return d.ArgErr()
+					}
+					rule.Keywords = append(rule.Keywords, args...)
+				case "action":
+					if !d.Args(&rule.Action) {
+						return d.ArgErr()
+					}
+				case "replacement":
+					if !d.Args(&rule.Replacement) {
+						return d.ArgErr()
+					}
+				default:
+					return d.Errf("unknown rule subdirective %s", d.Val())
+				}
+			}
+			f.Rules = append(f.Rules, rule)
+		case "block_status":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			status, err := strconv.Atoi(d.Val())
+			if err != nil {
+				return d.Errf("invalid block_status: %v", err)
+			}
+			f.BlockStatus = status
+		case "block_body":
+			if !d.Args(&f.BlockBody) {
+				return d.ArgErr()
+			}
+		default:
+			return d.Errf("unknown subdirective %s", d.Val())
+		}
+	}
+	return nil
+}
+
+// Provision implements caddy.Provisioner.
+func (f *DLP) Provision(ctx caddy.Context) error {
+	f.logger = ctx.Logger()
+	if f.BlockStatus == 0 {
+		f.BlockStatus = http.StatusForbidden
+	}
+	if f.BlockBody == "" {
+		f.BlockBody = http.StatusText(f.BlockStatus)
+	}
+
+	for i := range f.Rules {
+		rule := &f.Rules[i]
+		if rule.Action == "" {
+			rule.Action = "log"
+		}
+		if rule.Replacement == "" {
+			rule.Replacement = "[REDACTED]"
+		}
+		var alternatives []string
+		if rule.Pattern != "" {
+			alternatives = append(alternatives, rule.Pattern)
+		}
+		for _, kw := range rule.Keywords {
+			alternatives = append(alternatives, regexp.QuoteMeta(kw))
+		}
+		re, err := regexp.Compile(strings.Join(alternatives, "|"))
+		if err != nil {
+			return fmt.Errorf("rule %s: %v", rule.Name, err)
+		}
+		f.patterns = append(f.patterns, re)
+	}
+
+	f.matches = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "dlp_matches_total",
+		Help:      "Number of sensitive data matches found in decompressed bodies.",
+	}, []string{"rule", "action"})
+	if registry := ctx.GetMetricsRegistry(); registry != nil {
+		f.matches = register(registry, f.matches)
+	}
+	return nil
+}
+
+// Validate implements caddy.Validator.
+func (f *DLP) Validate() error {
+	for _, rule := range f.Rules {
+		if rule.Name == "" {
+			return fmt.Errorf("rules must have a name")
+		}
+		if rule.Pattern == "" && len(rule.Keywords) == 0 {
+			return fmt.Errorf("rule %s: pattern or keywords required", rule.Name)
+		}
+		switch rule.Action {
+		case "log", "redact", "block":
+		default:
+			return fmt.Errorf("rule %s: invalid action %q", rule.Name, rule.Action)
+		}
+	}
+	return nil
+}
+
+// Filter implements Filter.
+func (f *DLP) Filter(req *http.Request, header http.Header, body []byte) ([]byte, error) {
+	if !isTextual(header.Get("Content-Type")) {
+		return body, nil
+	}
+
+	for i, rule := range f.Rules {
+		re := f.patterns[i]
+		found := re.FindAllIndex(body, -1)
+		if len(found) == 0 {
+			continue
+		}
+		f.matches.WithLabelValues(rule.Name, rule.Action).Add(float64(len(found)))
+		f.logger.Warn("sensitive data found",
+			zap.String("rule", rule.Name),
+			zap.String("action", rule.Action),
+			zap.Int("matches", len(found)),
+			zap.String("uri", req.RequestURI))
+
+		switch rule.Action {
+		case "redact":
+			body = re.ReplaceAllLiteral(body, []byte(rule.Replacement))
+		case "block":
+			return nil, &BlockError{
+				Status:      f.BlockStatus,
+				ContentType: "text/plain; charset=utf-8",
+				Body:        []byte(f.BlockBody),
+				Reason:      "sensitive data matched rule " + rule.Name,
+			}
+		}
+	}
+	return body, nil
+}
+
+// isTextual reports whether contentType describes text that can be
+// safely searched and edited as such.
+func isTextual(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	switch {
+	case strings.HasPrefix(mediaType, "text/"),
+		isJSON(contentType), isXML(contentType),
+		mediaType == "application/javascript",
+		mediaType == "application/x-www-form-urlencoded":
+		return true
+	}
+	return false
+}
+
+// Interface guards
+var (
+	_ caddy.Provisioner     = (*DLP)(nil)
+	_ caddy.Validator       = (*DLP)(nil)
+	_ caddyfile.Unmarshaler = (*DLP)(nil)
+	_ Filter                = (*DLP)(nil)
+)
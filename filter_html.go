@@ -0,0 +1,448 @@
+package ungzip
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"golang.org/x/net/html"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+func init() {
+	caddy.RegisterModule(HTMLRewrite{})
+}
+
+// HTMLRewrite is a filter that rewrites decompressed text/html bodies
+// with rules that target elements by CSS selector. The document is
+// processed token by token, so markup that isn't touched by a rule is
+// passed through byte for byte. Like other filters, it is given the
+// whole decompressed body rather than a stream, so responses it
+// applies to are buffered in full; the csp option needs the whole
+// body anyway, to add the hashes of what was injected to the headers.
+//
+// Selectors support type, #id, .class, [attr] and [attr=value]
+// simple selectors, combined into compound selectors and joined by
+// the descendant combinator (whitespace).
+type HTMLRewrite struct {
+	Rules []HTMLRule `json:"rules,omitempty"`
+
+	// Make the <script> and <style> elements that rules prepend or
+	// append pass the response's Content-Security-Policy: they get the
+	// nonce the policy allows them with, and inline ones the policy
+	// would still block have their hashes added to it. Report-only
+	// policies are kept to the same way. External scripts without a
+	// nonce to use are left as they are
+	CSP bool `json:"csp,omitempty"`
+
+	selectors [][]compoundSelector
+}
+
+// HTMLRule is a rewrite applied to every element matching Selector.
+type HTMLRule struct {
+	// CSS selector for the elements to rewrite
+	Selector string `json:"selector"`
+
+	// Attributes to set on matching elements
+	SetAttributes map[string]string `json:"set_attributes,omitempty"`
+
+	// Remove matching elements and their content
+	Remove bool `json:"remove,omitempty"`
+
+	// HTML to insert right after the start tag of matching elements
+	Prepend string `json:"prepend,omitempty"`
+
+	// HTML to insert right before the end tag of matching elements
+	Append string `json:"append,omitempty"`
+}
+
+// CaddyModule returns the Caddy module information.
+func (HTMLRewrite) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.handlers.response_ungzip.filters.html_rewrite",
+		New: func() caddy.Module { return new(HTMLRewrite) },
+	}
+}
+
+// UnmarshalCaddyfile implements caddyfile.Unmarshaler.
+//
+//	filter html_rewrite {
+//		csp
+//		rule <selector> {
+//			set_attr <name> <value>
+//			remove
+//			prepend <html>
+//			append <html>
+//		}
+//	}
+func (h *HTMLRewrite) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // consume filter name
+	for d.NextBlock(0) {
+		if d.Val() == "csp" {
+			h.CSP = true
+			continue
+		}
+		if d.Val() != "rule" {
+			return d.Errf("unknown subdirective %s", d.Val())
+		}
+		if !d.NextArg() {
+			return d.ArgErr()
+		}
+		if _, err := parseSelector(d.Val()); err != nil {
+			return d.Errf("invalid selector %q: %v", d.Val(), err)
+		}
+		rule := HTMLRule{Selector: d.Val()}
+		for nesting := d.Nesting(); d.NextBlock(nesting); {
+			switch d.Val() {
+			case "set_attr":
+				var name, value string
+				if !d.Args(&name, &value) {
+					return d.ArgErr()
+				}
+				if rule.SetAttributes == nil {
+					rule.SetAttributes = make(map[string]string)
+				}
+				rule.SetAttributes[name] = value
+			case "remove":
+				rule.Remove = true
+			case "prepend":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				rule.Prepend = d.Val()
+			case "append":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				rule.Append = d.Val()
+			default:
+				return d.Errf("unknown rule subdirective %s", d.Val())
+			}
+		}
+		h.Rules = append(h.Rules, rule)
+	}
+	return nil
+}
+
+// Provision implements caddy.Provisioner.
+func (h *HTMLRewrite) Provision(ctx caddy.Context) error {
+	for _, rule := range h.Rules {
+		sel, err := parseSelector(rule.Selector)
+		if err != nil {
+			return fmt.Errorf("rule %q: %v", rule.Selector, err)
+		}
+		h.selectors = append(h.selectors, sel)
+	}
+	return nil
+}
+
+// htmlElement is an open element on the rewriter's stack.
+type htmlElement struct {
+	tag     string
+	id      string
+	classes []string
+	attrs   []html.Attribute
+	rules   []int // indexes of the rules that matched
+}
+
+// Filter implements Filter.
+func (h *HTMLRewrite) Filter(req *http.Request, header http.Header, body []byte) ([]byte, error) {
+	if !strings.HasPrefix(header.Get("Content-Type"), "text/html") {
+		return body, nil
+	}
+
+	var out bytes.Buffer
+	out.Grow(len(body))
+	z := html.NewTokenizer(bytes.NewReader(body))
+	var stack []*htmlElement
+	removing := 0 // depth of the element being removed, if any
+	inject := func(s string) string { return s }
+	if h.CSP {
+		csp := newCSPInjector(header)
+		defer csp.apply()
+		inject = csp.fragment
+	}
+
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			if z.Err() == io.EOF {
+				break
+			}
+			return nil, z.Err()
+		}
+		// Token and TagName normalize the tokenizer's buffer in place
+		raw := bytes.Clone(z.Raw())
+
+		switch tt {
+		case html.StartTagToken, html.SelfClosingTagToken:
+			tok := z.Token()
+			el := newHTMLElement(tok)
+			for i, sel := range h.selectors {
+				if matchSelector(sel, el, stack) {
+					el.rules = append(el.rules, i)
+				}
+			}
+			void := tt == html.SelfClosingTagToken || voidElements[tok.Data]
+			if !void {
+				stack = append(stack, el)
+			}
+			if removing > 0 {
+				continue
+			}
+			if h.removes(el) {
+				if !void {
+					removing = len(stack)
+				}
+				continue
+			}
+			if set := h.attributes(el); len(set) > 0 {
+				tok.Attr = setAttributes(tok.Attr, set)
+				out.WriteString(tok.String())
+			} else {
+				out.Write(raw)
+			}
+			if !void {
+				for _, i := range el.rules {
+					out.WriteString(inject(h.Rules[i].Prepend))
+				}
+			}
+
+		case html.EndTagToken:
+			name, _ := z.TagName()
+			idx := -1
+			for i := len(stack) - 1; i >= 0; i-- {
+				if stack[i].tag == string(name) {
+					idx = i
+					break
+				}
+			}
+			if idx < 0 {
+				if removing == 0 {
+					out.Write(raw)
+				}
+				continue
+			}
+			el := stack[idx]
+			stack = stack[:idx]
+			if removing > 0 {
+				if idx+1 <= removing {
+					removing = 0
+				}
+				continue
+			}
+			for _, i := range el.rules {
+				out.WriteString(inject(h.Rules[i].Append))
+			}
+			out.Write(raw)
+
+		default:
+			if removing == 0 {
+				out.Write(raw)
+			}
+		}
+	}
+
+	return out.Bytes(), nil
+}
+
+func (h *HTMLRewrite) removes(el *htmlElement) bool {
+	for _, i := range el.rules {
+		if h.Rules[i].Remove {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *HTMLRewrite) attributes(el *htmlElement) map[string]string {
+	var set map[string]string
+	for _, i := range el.rules {
+		for k, v := range h.Rules[i].SetAttributes {
+			if set == nil {
+				set = make(map[string]string)
+			}
+			set[k] = v
+		}
+	}
+	return set
+}
+
+func setAttributes(attrs []html.Attribute, set map[string]string) []html.Attribute {
+	for i := range attrs {
+		if v, ok := set[attrs[i].Key]; ok {
+			attrs[i].Val = v
+			delete(set, attrs[i].Key)
+		}
+	}
+	for k, v := range set {
+		attrs = append(attrs, html.Attribute{Key: k, Val: v})
+	}
+	return attrs
+}
+
+func newHTMLElement(tok html.Token) *htmlElement {
+	el := &htmlElement{tag: tok.Data, attrs: tok.Attr}
+	for _, a := range tok.Attr {
+		switch a.Key {
+		case "id":
+			el.id = a.Val
+		case "class":
+			el.classes = strings.Fields(a.Val)
+		}
+	}
+	return el
+}
+
+var voidElements = map[string]bool{
+	"area": true, "base": true, "br": true, "col": true, "embed": true,
+	"hr": true, "img": true, "input": true, "link": true, "meta": true,
+	"source": true, "track": true, "wbr": true,
+}
+
+// compoundSelector is a sequence of simple selectors that must all
+// match the same element, such as div.note[data-x=1].
+type compoundSelector struct {
+	tag     string
+	id      string
+	classes []string
+	attrs   []attrSelector
+}
+
+type attrSelector struct {
+	key      string
+	value    string
+	hasValue bool
+}
+
+func parseSelector(s string) ([]compoundSelector, error) {
+	parts := strings.Fields(s)
+	if len(parts) == 0 {
+		return nil, fmt.Errorf("empty selector")
+	}
+	sel := make([]compoundSelector, 0, len(parts))
+	for _, part := range parts {
+		c, err := parseCompound(part)
+		if err != nil {
+			return nil, err
+		}
+		sel = append(sel, c)
+	}
+	return sel, nil
+}
+
+func parseCompound(s string) (compoundSelector, error) {
+	var c compoundSelector
+	name, rest := splitName(s)
+	if name != "*" {
+		c.tag = strings.ToLower(name)
+	}
+	for rest != "" {
+		switch rest[0] {
+		case '#':
+			c.id, rest = splitName(rest[1:])
+			if c.id == "" {
+				return c, fmt.Errorf("empty id in %q", s)
+			}
+		case '.':
+			var class string
+			class, rest = splitName(rest[1:])
+			if class == "" {
+				return c, fmt.Errorf("empty class in %q", s)
+			}
+			c.classes = append(c.classes, class)
+		case '[':
+			end := strings.IndexByte(rest, ']')
+			if end < 0 {
+				return c, fmt.Errorf("unterminated attribute selector in %q", s)
+			}
+			key, value, hasValue := strings.Cut(rest[1:end], "=")
+			if key == "" {
+				return c, fmt.Errorf("empty attribute name in %q", s)
+			}
+			c.attrs = append(c.attrs, attrSelector{
+				key:      strings.ToLower(key),
+				value:    strings.Trim(value, `"'`),
+				hasValue: hasValue,
+			})
+			rest = rest[end+1:]
+		default:
+			return c, fmt.Errorf("unsupported selector %q", s)
+		}
+	}
+	return c, nil
+}
+
+// splitName splits a leading identifier (or *) off s.
+func splitName(s string) (string, string) {
+	i := strings.IndexAny(s, "#.[")
+	if i < 0 {
+		return s, ""
+	}
+	return s[:i], s[i:]
+}
+
+func (c compoundSelector) matches(el *htmlElement) bool {
+	if c.tag != "" && c.tag != el.tag {
+		return false
+	}
+	if c.id != "" && c.id != el.id {
+		return false
+	}
+	for _, class := range c.classes {
+		found := false
+		for _, have := range el.classes {
+			if have == class {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	for _, as := range c.attrs {
+		found := false
+		for _, a := range el.attrs {
+			if a.Key == as.key && (!as.hasValue || a.Val == as.value) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// matchSelector reports whether el, whose open ancestors are in stack,
+// matches sel.
+func matchSelector(sel []compoundSelector, el *htmlElement, stack []*htmlElement) bool {
+	last := len(sel) - 1
+	if !sel[last].matches(el) {
+		return false
+	}
+	i := len(stack) - 1
+	for j := last - 1; j >= 0; j-- {
+		for i >= 0 && !sel[j].matches(stack[i]) {
+			i--
+		}
+		if i < 0 {
+			return false
+		}
+		i--
+	}
+	return true
+}
+
+// Interface guards
+var (
+	_ caddy.Provisioner     = (*HTMLRewrite)(nil)
+	_ caddyfile.Unmarshaler = (*HTMLRewrite)(nil)
+	_ Filter                = (*HTMLRewrite)(nil)
+)
@@ -0,0 +1,250 @@
+package ungzip
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// cspDirectives are the directives that govern <script> and <style>
+// elements, most specific first, as each falls back to the next.
+var cspDirectives = map[string][]string{
+	"script": {"script-src-elem", "script-src", "default-src"},
+	"style":  {"style-src-elem", "style-src", "default-src"},
+}
+
+// cspHeaders are the headers that carry policies, enforced first. The
+// report-only ones are kept to as well, so that injected elements do not
+// show up in violation reports, which are often watched more closely
+// than the policy is enforced.
+var cspHeaders = []string{"Content-Security-Policy", "Content-Security-Policy-Report-Only"}
+
+// cspInjector makes the HTML injected by rules pass the Content-Security-
+// Policy of a response. Injected elements get the nonce the policy
+// allows; inline ones are hashed where there is none, and the hashes
+// added to every policy that would block them.
+type cspInjector struct {
+	header   http.Header
+	policies map[string][][]cspPolicy // per header, then header value
+	nonces   map[string]string
+	hashes   map[string][]string
+	done     map[string]string
+	nonced   bool
+}
+
+// cspPolicy is a single policy, as its directives in order, each being
+// the directive name followed by its sources.
+type cspPolicy [][]string
+
+func newCSPInjector(header http.Header) *cspInjector {
+	c := &cspInjector{
+		header:   header,
+		policies: make(map[string][][]cspPolicy),
+		nonces:   make(map[string]string),
+		hashes:   make(map[string][]string),
+		done:     make(map[string]string),
+	}
+	for _, name := range cspHeaders {
+		for _, value := range header.Values(name) {
+			var policies []cspPolicy
+			for _, text := range strings.Split(value, ",") {
+				var policy cspPolicy
+				for _, directive := range strings.Split(text, ";") {
+					if fields := strings.Fields(directive); len(fields) > 0 {
+						fields[0] = strings.ToLower(fields[0])
+						policy = append(policy, fields)
+					}
+				}
+				policies = append(policies, policy)
+			}
+			c.policies[name] = append(c.policies[name], policies)
+		}
+	}
+	for kind := range cspDirectives {
+		c.nonces[kind] = c.nonce(kind)
+	}
+	return c
+}
+
+// nonce returns the first nonce a policy allows elements of kind with,
+// preferring those of enforced policies.
+func (c *cspInjector) nonce(kind string) string {
+	for _, name := range cspHeaders {
+		for _, policies := range c.policies[name] {
+			for _, policy := range policies {
+				for _, source := range policy.sources(kind) {
+					if nonce, ok := strings.CutPrefix(source, "'nonce-"); ok && strings.HasSuffix(nonce, "'") {
+						return strings.TrimSuffix(nonce, "'")
+					}
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// sources returns the sources of the directive governing elements of
+// kind, or nil if none does.
+func (p cspPolicy) sources(kind string) []string {
+	for _, name := range cspDirectives[kind] {
+		for _, directive := range p {
+			if directive[0] == name {
+				return directive[1:]
+			}
+		}
+	}
+	return nil
+}
+
+// allows reports whether p allows an inline element of kind with the
+// given nonce and hash source.
+func (p cspPolicy) allows(kind, nonce, hash string) bool {
+	var governed bool
+	for _, name := range cspDirectives[kind] {
+		if slices.ContainsFunc(p, func(d []string) bool { return d[0] == name }) {
+			governed = true
+			break
+		}
+	}
+	if !governed {
+		return true
+	}
+	sources := p.sources(kind)
+	if nonce != "" && slices.Contains(sources, "'nonce-"+nonce+"'") || slices.Contains(sources, hash) {
+		return true
+	}
+	// 'unsafe-inline' is ignored once a policy lists nonces or hashes
+	for _, source := range sources {
+		if strings.HasPrefix(source, "'nonce-") || strings.HasPrefix(source, "'sha") {
+			return false
+		}
+	}
+	return slices.Contains(sources, "'unsafe-inline'")
+}
+
+// fragment returns the injected HTML s with the nonce set on its
+// <script> and <style> elements, noting the hashes of those that still
+// need them.
+func (c *cspInjector) fragment(s string) string {
+	if len(c.policies) == 0 || s == "" {
+		return s
+	}
+	if out, ok := c.done[s]; ok {
+		return out
+	}
+	var out bytes.Buffer
+	z := html.NewTokenizer(strings.NewReader(s))
+	var kind string // of the element whose content is being read
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			if z.Err() != io.EOF {
+				// leave what the tokenizer cannot read as it is
+				return s
+			}
+			break
+		}
+		// Token normalizes the tokenizer's buffer in place
+		raw := bytes.Clone(z.Raw())
+		switch tt {
+		case html.StartTagToken, html.SelfClosingTagToken:
+			kind = ""
+			tok := z.Token()
+			if _, ok := cspDirectives[tok.Data]; ok {
+				if tt == html.StartTagToken {
+					kind = tok.Data
+				}
+				if nonce := c.nonces[tok.Data]; nonce != "" {
+					tok.Attr = setAttributes(tok.Attr, map[string]string{"nonce": nonce})
+					c.nonced = true
+					out.WriteString(tok.String())
+					continue
+				}
+			}
+			out.Write(raw)
+		case html.TextToken:
+			if kind != "" {
+				c.hash(kind, raw)
+			}
+			out.Write(raw)
+		default:
+			kind = ""
+			out.Write(raw)
+		}
+	}
+	c.done[s] = out.String()
+	return c.done[s]
+}
+
+// hash notes the hash of the content of an inline element of kind, for
+// the policies that would not allow it otherwise.
+func (c *cspInjector) hash(kind string, content []byte) {
+	sum := sha256.Sum256(content)
+	source := "'sha256-" + base64.StdEncoding.EncodeToString(sum[:]) + "'"
+	for _, values := range c.policies {
+		for _, policies := range values {
+			for _, policy := range policies {
+				if !policy.allows(kind, c.nonces[kind], source) {
+					c.hashes[kind] = appendUnique(c.hashes[kind], source)
+					return
+				}
+			}
+		}
+	}
+}
+
+// apply adds the hashes noted to the policies in the header that need
+// them. A body carrying a nonce is made for this response only, so its
+// validators are dropped, as the templates filter does.
+func (c *cspInjector) apply() {
+	if c.nonced {
+		c.header.Del("Last-Modified")
+		c.header.Del("Etag")
+	}
+	if len(c.hashes) == 0 {
+		return
+	}
+	for name, policyValues := range c.policies {
+		values := make([]string, len(policyValues))
+		for i, policies := range policyValues {
+			texts := make([]string, len(policies))
+			for j, policy := range policies {
+				for kind, hashes := range c.hashes {
+					for _, hash := range hashes {
+						if policy.allows(kind, c.nonces[kind], hash) {
+							continue
+						}
+						policy.add(kind, hash)
+					}
+				}
+				directives := make([]string, len(policy))
+				for k, directive := range policy {
+					directives[k] = strings.Join(directive, " ")
+				}
+				texts[j] = strings.Join(directives, "; ")
+			}
+			values[i] = strings.Join(texts, ", ")
+		}
+		c.header[name] = values
+	}
+}
+
+// add adds source to the directive governing elements of kind.
+func (p cspPolicy) add(kind, source string) {
+	for _, name := range cspDirectives[kind] {
+		for i, directive := range p {
+			if directive[0] == name {
+				// 'none' cannot be combined with other sources
+				sources := slices.DeleteFunc(slices.Clone(directive[1:]), func(s string) bool { return s == "'none'" })
+				p[i] = append(append([]string{name}, sources...), source)
+				return
+			}
+		}
+	}
+}
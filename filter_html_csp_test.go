@@ -0,0 +1,154 @@
+package ungzip
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func TestHTMLRewriteCSP(t *testing.T) {
+	sum := sha256.Sum256([]byte("run()"))
+	hash := "'sha256-" + base64.StdEncoding.EncodeToString(sum[:]) + "'"
+
+	for _, tc := range []struct {
+		name       string
+		csp        string
+		reportOnly string
+		inject     string
+		// what the injected element and the headers come out as, with
+		// {hash} for the hash of its content
+		wantElement    string
+		wantCSP        string
+		wantReportOnly string
+		wantETag       bool
+	}{
+		{
+			name:        "nonce reused",
+			csp:         "script-src 'nonce-abc'",
+			inject:      "<script>run()</script>",
+			wantElement: `<script nonce="abc">run()</script>`,
+			wantCSP:     "script-src 'nonce-abc'",
+		},
+		{
+			name:        "hash added",
+			csp:         "default-src 'self'; script-src 'self'",
+			inject:      "<script>run()</script>",
+			wantElement: "<script>run()</script>",
+			wantCSP:     "default-src 'self'; script-src 'self' {hash}",
+			wantETag:    true,
+		},
+		{
+			name:        "hash replaces 'none'",
+			csp:         "default-src 'none'",
+			inject:      "<script>run()</script>",
+			wantElement: "<script>run()</script>",
+			wantCSP:     "default-src {hash}",
+			wantETag:    true,
+		},
+		{
+			name:        "'unsafe-inline' allows it",
+			csp:         "script-src 'self' 'unsafe-inline'",
+			inject:      "<script>run()</script>",
+			wantElement: "<script>run()</script>",
+			wantCSP:     "script-src 'self' 'unsafe-inline'",
+			wantETag:    true,
+		},
+		{
+			name:        "'unsafe-inline' ignored next to a hash",
+			csp:         "script-src 'unsafe-inline' 'sha256-AAAA'",
+			inject:      "<script>run()</script>",
+			wantElement: "<script>run()</script>",
+			wantCSP:     "script-src 'unsafe-inline' 'sha256-AAAA' {hash}",
+			wantETag:    true,
+		},
+		{
+			name:        "'strict-dynamic' with a nonce",
+			csp:         "script-src 'nonce-abc' 'strict-dynamic' 'unsafe-inline' https:",
+			inject:      "<script>run()</script>",
+			wantElement: `<script nonce="abc">run()</script>`,
+			wantCSP:     "script-src 'nonce-abc' 'strict-dynamic' 'unsafe-inline' https:",
+		},
+		{
+			name:        "'strict-dynamic' with hashes",
+			csp:         "script-src 'strict-dynamic' 'sha256-AAAA'",
+			inject:      "<script>run()</script>",
+			wantElement: "<script>run()</script>",
+			wantCSP:     "script-src 'strict-dynamic' 'sha256-AAAA' {hash}",
+			wantETag:    true,
+		},
+		{
+			name:        "each policy of a header",
+			csp:         "script-src 'nonce-abc', default-src 'self'",
+			inject:      "<script>run()</script>",
+			wantElement: `<script nonce="abc">run()</script>`,
+			wantCSP:     "script-src 'nonce-abc', default-src 'self' {hash}",
+		},
+		{
+			name:           "report-only",
+			reportOnly:     "script-src 'self'",
+			inject:         "<script>run()</script>",
+			wantElement:    "<script>run()</script>",
+			wantReportOnly: "script-src 'self' {hash}",
+			wantETag:       true,
+		},
+		{
+			name:           "enforced nonce and report-only hash",
+			csp:            "script-src 'nonce-abc'",
+			reportOnly:     "script-src 'self'",
+			inject:         "<script>run()</script>",
+			wantElement:    `<script nonce="abc">run()</script>`,
+			wantCSP:        "script-src 'nonce-abc'",
+			wantReportOnly: "script-src 'self' {hash}",
+		},
+		{
+			name:        "no policy",
+			inject:      "<script>run()</script>",
+			wantElement: "<script>run()</script>",
+			wantETag:    true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+			defer cancel()
+			h := &HTMLRewrite{CSP: true, Rules: []HTMLRule{{Selector: "body", Append: tc.inject}}}
+			if err := h.Provision(ctx); err != nil {
+				t.Fatal(err)
+			}
+
+			header := http.Header{"Content-Type": []string{"text/html"}, "Etag": []string{`"v1"`}}
+			if tc.csp != "" {
+				header.Set("Content-Security-Policy", tc.csp)
+			}
+			if tc.reportOnly != "" {
+				header.Set("Content-Security-Policy-Report-Only", tc.reportOnly)
+			}
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			got, err := h.Filter(req, header, []byte("<html><body><p>page</p></body></html>"))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			want := "<html><body><p>page</p>" + tc.wantElement + "</body></html>"
+			if string(got) != want {
+				t.Errorf("got body %s, want %s", got, want)
+			}
+			wantCSP := strings.ReplaceAll(tc.wantCSP, "{hash}", hash)
+			if got := header.Get("Content-Security-Policy"); got != wantCSP {
+				t.Errorf("got Content-Security-Policy %q, want %q", got, wantCSP)
+			}
+			wantReportOnly := strings.ReplaceAll(tc.wantReportOnly, "{hash}", hash)
+			if got := header.Get("Content-Security-Policy-Report-Only"); got != wantReportOnly {
+				t.Errorf("got Content-Security-Policy-Report-Only %q, want %q", got, wantReportOnly)
+			}
+			if got := header.Get("Etag") != ""; got != tc.wantETag {
+				t.Errorf("got ETag %q, want it kept: %v", header.Get("Etag"), tc.wantETag)
+			}
+		})
+	}
+}
@@ -0,0 +1,31 @@
+package ungzip
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func TestHTMLRewritePassesUntouchedMarkup(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	h := &HTMLRewrite{Rules: []HTMLRule{{Selector: "p", SetAttributes: map[string]string{"class": "x"}}}}
+	if err := h.Provision(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	header := http.Header{"Content-Type": []string{"text/html"}}
+	body := `<A HREF="/x?a=1&amp;b=2">link</A><p>text</p>`
+	got, err := h.Filter(req, header, []byte(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `<A HREF="/x?a=1&amp;b=2">link</A><p class="x">text</p>`
+	if string(got) != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,262 @@
+package ungzip
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+func init() {
+	caddy.RegisterModule(Index{})
+}
+
+// Index is a filter that hands decompressed textual bodies to a sink,
+// such as a site-search indexer, for content that the origin only has
+// compressed. Bodies pass through unchanged.
+//
+// Each body is sent as a JSON object with the time, host, uri,
+// content_type, body and whether the body was truncated. The sink is
+// one of:
+//
+//   - an http:// or https:// URL, which each object is POSTed to
+//   - unix/<path>, a unix socket each object is written to, followed by
+//     a newline, over a connection of its own
+//   - a file path, which objects are appended to as JSON lines
+//
+// Objects are queued and sent in the background; when the queue is
+// full, new ones are dropped.
+type Index struct {
+	// Where to send bodies
+	Sink string `json:"sink"`
+
+	// Fraction of bodies to send, between 0 and 1
+	// Default: 1
+	SampleRate float64 `json:"sample_rate,omitempty"`
+
+	// Bodies are truncated to this many bytes
+	// Default: 1MB
+	MaxSize int64 `json:"max_size,omitempty"`
+
+	// Maximum number of bodies waiting to be sent
+	// Default: 100
+	QueueSize int `json:"queue_size,omitempty"`
+
+	queue  chan indexRecord
+	quit   chan struct{}
+	client *http.Client
+	file   *os.File
+	logger *zap.Logger
+}
+
+// indexRecord is what is sent to the sink for each body.
+type indexRecord struct {
+	Time        time.Time `json:"time"`
+	Host        string    `json:"host"`
+	URI         string    `json:"uri"`
+	ContentType string    `json:"content_type"`
+	Truncated   bool      `json:"truncated"`
+	Body        string    `json:"body"`
+}
+
+// CaddyModule returns the Caddy module information.
+func (Index) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.handlers.response_ungzip.filters.index",
+		New: func() caddy.Module { return new(Index) },
+	}
+}
+
+// UnmarshalCaddyfile implements caddyfile.Unmarshaler.
+//
+//	filter index <sink> {
+//		sample_rate <fraction>
+//		max_size <bytes>
+//		queue_size <n>
+//	}
+func (ix *Index) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // consume filter name
+	if !d.Args(&ix.Sink) {
+		return d.ArgErr()
+	}
+	for d.NextBlock(0) {
+		switch d.Val() {
+		case "sample_rate":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			rate, err := strconv.ParseFloat(d.Val(), 64)
+			if err != nil {
+				return d.Errf("invalid sample_rate: %v", err)
+			}
+			ix.SampleRate = rate
+		case "max_size":
+			if err := sizeArg(d, &ix.MaxSize); err != nil {
+				return err
+			}
+		case "queue_size":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			size, err := strconv.Atoi(d.Val())
+			if err != nil {
+				return d.Errf("invalid queue_size: %v", err)
+			}
+			ix.QueueSize = size
+		default:
+			return d.Errf("unknown subdirective %s", d.Val())
+		}
+	}
+	return nil
+}
+
+// Provision implements caddy.Provisioner.
+func (ix *Index) Provision(ctx caddy.Context) error {
+	ix.logger = ctx.Logger()
+	if ix.SampleRate == 0 {
+		ix.SampleRate = 1
+	}
+	if ix.MaxSize == 0 {
+		ix.MaxSize = 1024 * 1024 // 1MB default
+	}
+	if ix.QueueSize == 0 {
+		ix.QueueSize = 100
+	}
+	switch {
+	case strings.HasPrefix(ix.Sink, "http://"), strings.HasPrefix(ix.Sink, "https://"):
+		ix.client = &http.Client{Timeout: 10 * time.Second}
+	case strings.HasPrefix(ix.Sink, "unix/"):
+	default:
+		f, err := os.OpenFile(ix.Sink, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+		if err != nil {
+			return fmt.Errorf("opening sink: %v", err)
+		}
+		ix.file = f
+	}
+	ix.queue = make(chan indexRecord, ix.QueueSize)
+	ix.quit = make(chan struct{})
+	go ix.run()
+	return nil
+}
+
+// Cleanup implements caddy.CleanerUpper.
+func (ix *Index) Cleanup() error {
+	if ix.quit != nil {
+		close(ix.quit)
+	}
+	if ix.file != nil {
+		return ix.file.Close()
+	}
+	return nil
+}
+
+// Validate implements caddy.Validator.
+func (ix *Index) Validate() error {
+	if ix.Sink == "" {
+		return fmt.Errorf("sink is required")
+	}
+	if ix.SampleRate < 0 || ix.SampleRate > 1 {
+		return fmt.Errorf("sample_rate must be between 0 and 1")
+	}
+	if ix.MaxSize < 0 || ix.QueueSize < 0 {
+		return fmt.Errorf("max_size and queue_size cannot be negative")
+	}
+	return nil
+}
+
+// Filter implements Filter.
+func (ix *Index) Filter(req *http.Request, header http.Header, body []byte) ([]byte, error) {
+	contentType := header.Get("Content-Type")
+	if !isTextual(contentType) || rand.Float64() >= ix.SampleRate {
+		return body, nil
+	}
+	record := indexRecord{
+		Time:        time.Now().UTC(),
+		Host:        req.Host,
+		URI:         req.RequestURI,
+		ContentType: contentType,
+	}
+	if int64(len(body)) > ix.MaxSize {
+		record.Body = string(body[:ix.MaxSize])
+		record.Truncated = true
+	} else {
+		record.Body = string(body)
+	}
+	select {
+	case ix.queue <- record:
+	default:
+		ix.logger.Debug("index queue full; dropping body", zap.String("uri", req.RequestURI))
+	}
+	return body, nil
+}
+
+func (ix *Index) run() {
+	for {
+		select {
+		case record := <-ix.queue:
+			if err := ix.send(record); err != nil {
+				ix.logger.Warn("sending body to index sink",
+					zap.String("uri", record.URI),
+					zap.Error(err))
+			}
+		case <-ix.quit:
+			return
+		}
+	}
+}
+
+func (ix *Index) send(record indexRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	switch {
+	case ix.client != nil:
+		resp, err := ix.client.Post(ix.Sink, "application/json", bytes.NewReader(data))
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			return fmt.Errorf("sink responded with status %d", resp.StatusCode)
+		}
+		return nil
+	case ix.file != nil:
+		_, err := ix.file.Write(data)
+		return err
+	default:
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		conn, err := new(net.Dialer).DialContext(ctx, "unix", strings.TrimPrefix(ix.Sink, "unix/"))
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		_ = conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+		_, err = conn.Write(data)
+		return err
+	}
+}
+
+// Interface guards
+var (
+	_ caddy.Provisioner     = (*Index)(nil)
+	_ caddy.CleanerUpper    = (*Index)(nil)
+	_ caddy.Validator       = (*Index)(nil)
+	_ caddyfile.Unmarshaler = (*Index)(nil)
+	_ Filter                = (*Index)(nil)
+)
@@ -0,0 +1,131 @@
+package ungzip
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+func init() {
+	caddy.RegisterModule(JSONFormat{})
+}
+
+// JSONFormat is a filter that reformats decompressed JSON bodies,
+// either indented for reading or compacted for the wire. Bodies that
+// are not valid JSON are left as they are.
+type JSONFormat struct {
+	// "pretty" or "compact"
+	// Default: pretty
+	Mode string `json:"mode,omitempty"`
+
+	// Indentation used by pretty mode
+	// Default: two spaces
+	Indent string `json:"indent,omitempty"`
+
+	// Bodies larger than this many bytes are left as they are
+	// Default: 1MB
+	MaxSize int64 `json:"max_size,omitempty"`
+}
+
+// CaddyModule returns the Caddy module information.
+func (JSONFormat) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.handlers.response_ungzip.filters.json_format",
+		New: func() caddy.Module { return new(JSONFormat) },
+	}
+}
+
+// UnmarshalCaddyfile implements caddyfile.Unmarshaler.
+//
+//	filter json_format [pretty|compact] {
+//		indent <string>
+//		max_size <bytes>
+//	}
+func (j *JSONFormat) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // consume filter name
+	if d.NextArg() {
+		j.Mode = d.Val()
+	}
+	for d.NextBlock(0) {
+		switch d.Val() {
+		case "indent":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			j.Indent = d.Val()
+		case "max_size":
+			if err := sizeArg(d, &j.MaxSize); err != nil {
+				return err
+			}
+		default:
+			return d.Errf("unknown subdirective %s", d.Val())
+		}
+	}
+	return nil
+}
+
+// Provision implements caddy.Provisioner.
+func (j *JSONFormat) Provision(ctx caddy.Context) error {
+	if j.Mode == "" {
+		j.Mode = "pretty"
+	}
+	if j.Indent == "" {
+		j.Indent = "  "
+	}
+	if j.MaxSize == 0 {
+		j.MaxSize = 1024 * 1024 // 1MB default
+	}
+	return nil
+}
+
+// Validate implements caddy.Validator.
+func (j *JSONFormat) Validate() error {
+	if j.Mode != "pretty" && j.Mode != "compact" {
+		return fmt.Errorf("invalid mode %q", j.Mode)
+	}
+	return nil
+}
+
+// Filter implements Filter.
+func (j *JSONFormat) Filter(req *http.Request, header http.Header, body []byte) ([]byte, error) {
+	if !isJSON(header.Get("Content-Type")) || int64(len(body)) > j.MaxSize {
+		return body, nil
+	}
+
+	var out bytes.Buffer
+	var err error
+	if j.Mode == "compact" {
+		err = json.Compact(&out, body)
+	} else {
+		err = json.Indent(&out, body, "", j.Indent)
+		out.WriteByte('\n')
+	}
+	if err != nil {
+		return body, nil
+	}
+	return out.Bytes(), nil
+}
+
+// isJSON reports whether contentType is application/json or a
+// +json structured syntax type.
+func isJSON(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+}
+
+// Interface guards
+var (
+	_ caddy.Provisioner     = (*JSONFormat)(nil)
+	_ caddy.Validator       = (*JSONFormat)(nil)
+	_ caddyfile.Unmarshaler = (*JSONFormat)(nil)
+	_ Filter                = (*JSONFormat)(nil)
+)
@@ -0,0 +1,180 @@
+package ungzip
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"go.uber.org/zap"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func init() {
+	caddy.RegisterModule(JSONFields{})
+}
+
+// JSONFields is a filter that extracts values from decompressed JSON
+// bodies, to add them to the access log entry of the request and set
+// them as the ungzip_json.<name> vars. Bodies pass through unchanged.
+//
+// Paths are dot-separated object keys and array indexes, optionally
+// starting with "$.", such as "$.data.items.0.id". Values that are not
+// strings, numbers or booleans are logged as JSON.
+type JSONFields struct {
+	// Paths of the values to extract, by field name
+	Fields map[string]string `json:"fields"`
+
+	// Fraction of bodies to extract values from, between 0 and 1
+	// Default: 1
+	SampleRate float64 `json:"sample_rate,omitempty"`
+
+	// Bodies larger than this many bytes are skipped
+	// Default: 1MB
+	MaxSize int64 `json:"max_size,omitempty"`
+
+	paths map[string][]string
+}
+
+// CaddyModule returns the Caddy module information.
+func (JSONFields) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.handlers.response_ungzip.filters.json_fields",
+		New: func() caddy.Module { return new(JSONFields) },
+	}
+}
+
+// UnmarshalCaddyfile implements caddyfile.Unmarshaler.
+//
+//	filter json_fields {
+//		field <name> <path>
+//		sample_rate <fraction>
+//		max_size <bytes>
+//	}
+func (j *JSONFields) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // consume filter name
+	for d.NextBlock(0) {
+		switch d.Val() {
+		case "field":
+			var name, path string
+			if !d.Args(&name, &path) {
+				return d.ArgErr()
+			}
+			if j.Fields == nil {
+				j.Fields = make(map[string]string)
+			}
+			j.Fields[name] = path
+		case "sample_rate":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			rate, err := strconv.ParseFloat(d.Val(), 64)
+			if err != nil {
+				return d.Errf("invalid sample_rate: %v", err)
+			}
+			j.SampleRate = rate
+		case "max_size":
+			if err := sizeArg(d, &j.MaxSize); err != nil {
+				return err
+			}
+		default:
+			return d.Errf("unknown subdirective %s", d.Val())
+		}
+	}
+	return nil
+}
+
+// Provision implements caddy.Provisioner.
+func (j *JSONFields) Provision(ctx caddy.Context) error {
+	if j.SampleRate == 0 {
+		j.SampleRate = 1
+	}
+	if j.MaxSize == 0 {
+		j.MaxSize = 1024 * 1024 // 1MB default
+	}
+	j.paths = make(map[string][]string, len(j.Fields))
+	for name, path := range j.Fields {
+		path = strings.TrimPrefix(strings.TrimPrefix(path, "$"), ".")
+		j.paths[name] = strings.Split(path, ".")
+	}
+	return nil
+}
+
+// Validate implements caddy.Validator.
+func (j *JSONFields) Validate() error {
+	if len(j.Fields) == 0 {
+		return fmt.Errorf("at least one field is required")
+	}
+	if j.SampleRate < 0 || j.SampleRate > 1 {
+		return fmt.Errorf("sample_rate must be between 0 and 1")
+	}
+	return nil
+}
+
+// Filter implements Filter.
+func (j *JSONFields) Filter(req *http.Request, header http.Header, body []byte) ([]byte, error) {
+	if !isJSON(header.Get("Content-Type")) || int64(len(body)) > j.MaxSize || rand.Float64() >= j.SampleRate {
+		return body, nil
+	}
+	var doc any
+	if err := json.Unmarshal(body, &doc); err != nil {
+		return body, nil
+	}
+
+	extra, _ := req.Context().Value(caddyhttp.ExtraLogFieldsCtxKey).(*caddyhttp.ExtraLogFields)
+	for name, path := range j.paths {
+		value, ok := lookupJSON(doc, path)
+		if !ok {
+			continue
+		}
+		caddyhttp.SetVar(req.Context(), "ungzip_json."+name, value)
+		if extra != nil {
+			extra.Set(zap.Any(name, value))
+		}
+	}
+	return body, nil
+}
+
+// lookupJSON returns the value at path in doc, as decoded by
+// encoding/json. Objects and arrays are returned as JSON text.
+func lookupJSON(doc any, path []string) (any, bool) {
+	for _, key := range path {
+		switch v := doc.(type) {
+		case map[string]any:
+			var ok bool
+			if doc, ok = v[key]; !ok {
+				return nil, false
+			}
+		case []any:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(v) {
+				return nil, false
+			}
+			doc = v[i]
+		default:
+			return nil, false
+		}
+	}
+	switch doc.(type) {
+	case map[string]any, []any:
+		text, err := json.Marshal(doc)
+		if err != nil {
+			return nil, false
+		}
+		return string(text), true
+	}
+	return doc, true
+}
+
+// Interface guards
+var (
+	_ caddy.Provisioner     = (*JSONFields)(nil)
+	_ caddy.Validator       = (*JSONFields)(nil)
+	_ caddyfile.Unmarshaler = (*JSONFields)(nil)
+	_ Filter                = (*JSONFields)(nil)
+)
@@ -0,0 +1,227 @@
+package ungzip
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+	"text/template"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/templates"
+)
+
+func init() {
+	caddy.RegisterModule(Templates{})
+}
+
+// Templates is a filter that executes decompressed bodies as templates,
+// like the templates handler does for content served by Caddy itself.
+// This enables server-side includes and placeholder substitution in
+// content that only arrives gzipped from the origin.
+//
+// Templates are executed with the templates handler's context, so the
+// same actions and functions are available, except for env, expandenv,
+// getHostByName and httpInclude, and placeholder and ph leave env
+// placeholders empty: bodies come from upstreams, which may not be
+// trusted with the proxy's environment, its resolver or requests to its
+// own routes. Files included from the root are held to the same.
+// Files are only read from the root, which must be set.
+type Templates struct {
+	// Root for include, readFile and the other file functions.
+	// Placeholders are expanded. Required
+	FileRoot string `json:"file_root,omitempty"`
+
+	// Media types of bodies to execute as templates
+	// Default: text/html, text/plain, text/markdown
+	MIMETypes []string `json:"mime_types,omitempty"`
+
+	// Template action delimiters of bodies. Included files use the
+	// default delimiters
+	// Default: {{ and }}
+	Delimiters []string `json:"delimiters,omitempty"`
+}
+
+// CaddyModule returns the Caddy module information.
+func (Templates) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.handlers.response_ungzip.filters.templates",
+		New: func() caddy.Module { return new(Templates) },
+	}
+}
+
+// UnmarshalCaddyfile implements caddyfile.Unmarshaler.
+//
+//	filter templates {
+//		root <path>
+//		mime <types...>
+//		between <open_delim> <close_delim>
+//	}
+func (t *Templates) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // consume filter name
+	for d.NextBlock(0) {
+		switch d.Val() {
+		case "root":
+			if !d.Args(&t.FileRoot) {
+				return d.ArgErr()
+			}
+		case "mime":
+			t.MIMETypes = d.RemainingArgs()
+			if len(t.MIMETypes) == 0 {
+				return d.ArgErr()
+			}
+		case "between":
+			t.Delimiters = d.RemainingArgs()
+			if len(t.Delimiters) != 2 {
+				return d.ArgErr()
+			}
+		default:
+			return d.Errf("unknown subdirective %s", d.Val())
+		}
+	}
+	return nil
+}
+
+// Provision implements caddy.Provisioner.
+func (t *Templates) Provision(ctx caddy.Context) error {
+	if len(t.MIMETypes) == 0 {
+		t.MIMETypes = []string{"text/html", "text/plain", "text/markdown"}
+	}
+	return nil
+}
+
+// Validate implements caddy.Validator.
+func (t *Templates) Validate() error {
+	if t.FileRoot == "" {
+		return fmt.Errorf("templates filter requires a root")
+	}
+	if len(t.Delimiters) != 0 && len(t.Delimiters) != 2 {
+		return fmt.Errorf("delimiters must consist of exactly two elements: opening and closing")
+	}
+	return nil
+}
+
+// Filter implements Filter.
+func (t *Templates) Filter(req *http.Request, header http.Header, body []byte) ([]byte, error) {
+	mediaType, _, _ := mime.ParseMediaType(header.Get("Content-Type"))
+	matched := false
+	for _, mt := range t.MIMETypes {
+		if mediaType == mt {
+			matched = true
+			break
+		}
+	}
+	if !matched {
+		return body, nil
+	}
+
+	repl := req.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+	root := repl.ReplaceAll(t.FileRoot, "")
+	if root == "" {
+		return nil, fmt.Errorf("templates root %q is empty for this request", t.FileRoot)
+	}
+	tctx := &templates.TemplateContext{
+		Root:       http.Dir(root),
+		Req:        req,
+		RespHeader: templates.WrappedHeader{Header: header},
+	}
+	tpl := newBodyTemplate(tctx, req.URL.Path)
+	if len(t.Delimiters) == 2 {
+		tpl.Delims(t.Delimiters[0], t.Delimiters[1])
+	}
+	if _, err := tpl.Parse(string(body)); err != nil {
+		return nil, err
+	}
+	var out bytes.Buffer
+	if err := tpl.Execute(&out, tctx); err != nil {
+		return nil, err
+	}
+
+	// like the templates handler, we can't describe dynamic content
+	// with validators or serve ranges of it
+	header.Del("Accept-Ranges")
+	header.Del("Last-Modified")
+	header.Del("Etag")
+
+	return out.Bytes(), nil
+}
+
+// newBodyTemplate returns a template named name for tctx, with the
+// templates handler's functions less those that reach the proxy's
+// environment, network or routes.
+func newBodyTemplate(tctx *templates.TemplateContext, name string) *template.Template {
+	tpl := tctx.NewTemplate(name)
+	tpl.Funcs(template.FuncMap{
+		"env":           funcUnavailable("env"),
+		"expandenv":     funcUnavailable("expandenv"),
+		"getHostByName": funcUnavailable("getHostByName"),
+		"httpInclude":   funcUnavailable("httpInclude"),
+		"include":       funcInclude(tctx),
+		"placeholder":   funcPlaceholder(tctx.Req),
+		"ph":            funcPlaceholder(tctx.Req),
+	})
+	return tpl
+}
+
+// funcInclude returns the include template function for tctx. It works
+// like the templates handler's, except that the included file gets the
+// same functions as the body: the handler's own include would give
+// it back all of them.
+func funcInclude(tctx *templates.TemplateContext) func(string, ...any) (string, error) {
+	return func(filename string, args ...any) (string, error) {
+		file, err := tctx.Root.Open(filename)
+		if err != nil {
+			return "", err
+		}
+		defer file.Close()
+		src, err := io.ReadAll(file)
+		if err != nil {
+			return "", err
+		}
+
+		included := *tctx
+		included.Args = args
+		tpl := newBodyTemplate(&included, filename)
+		if _, err := tpl.Parse(string(src)); err != nil {
+			return "", err
+		}
+		var out bytes.Buffer
+		if err := tpl.Execute(&out, &included); err != nil {
+			return "", err
+		}
+		return out.String(), nil
+	}
+}
+
+// funcUnavailable returns a template function that fails with an error
+// naming the function name it replaces.
+func funcUnavailable(name string) func(...any) (string, error) {
+	return func(...any) (string, error) {
+		return "", fmt.Errorf("%s is not available to response bodies", name)
+	}
+}
+
+// funcPlaceholder returns the placeholder template function for req,
+// which, like the templates handler's, can't read files, and unlike
+// it, can't read the environment either.
+func funcPlaceholder(req *http.Request) func(string) string {
+	return func(name string) string {
+		if strings.HasPrefix(name, "env.") {
+			return ""
+		}
+		repl := req.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer).WithoutFile()
+		value, _ := repl.GetString(name)
+		return value
+	}
+}
+
+// Interface guards
+var (
+	_ caddy.Provisioner     = (*Templates)(nil)
+	_ caddy.Validator       = (*Templates)(nil)
+	_ caddyfile.Unmarshaler = (*Templates)(nil)
+	_ Filter                = (*Templates)(nil)
+)
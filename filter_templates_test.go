@@ -0,0 +1,95 @@
+package ungzip
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func TestTemplatesPlaceholderWithoutEnv(t *testing.T) {
+	t.Setenv("UNGZIP_TEST_SECRET", "hunter2")
+
+	req := httptest.NewRequest(http.MethodGet, "/page", nil)
+	req = caddyhttp.PrepareRequest(req, caddyhttp.NewTestReplacer(req), nil, nil)
+	header := http.Header{"Content-Type": []string{"text/html"}}
+	tpl := &Templates{FileRoot: t.TempDir()}
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	if err := tpl.Provision(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	for body, want := range map[string]string{
+		`[{{ph "env.UNGZIP_TEST_SECRET"}}]`:          "[]",
+		`[{{placeholder "env.UNGZIP_TEST_SECRET"}}]`: "[]",
+		`[{{ph "http.request.uri.path"}}]`:           "[/page]",
+	} {
+		got, err := tpl.Filter(req, header.Clone(), []byte(body))
+		if err != nil {
+			t.Fatalf("%s: %v", body, err)
+		}
+		if string(got) != want {
+			t.Errorf("%s: got %q, want %q", body, got, want)
+		}
+	}
+}
+
+func TestTemplatesWithoutEnvironment(t *testing.T) {
+	t.Setenv("UNGZIP_TEST_SECRET", "hunter2")
+
+	root := t.TempDir()
+	for name, content := range map[string]string{
+		"plain.html":     `[{{index .Args 0}}]`,
+		"env.html":       `{{env "UNGZIP_TEST_SECRET"}}`,
+		"expandenv.html": `{{expandenv "$UNGZIP_TEST_SECRET"}}`,
+		"nested.html":    `{{include "expandenv.html"}}`,
+		"define.html":    `{{define "secret"}}{{expandenv "$UNGZIP_TEST_SECRET"}}{{end}}`,
+	} {
+		if err := os.WriteFile(filepath.Join(root, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/page", nil)
+	req = caddyhttp.PrepareRequest(req, caddyhttp.NewTestReplacer(req), nil, nil)
+	header := http.Header{"Content-Type": []string{"text/html"}}
+	tpl := &Templates{FileRoot: root}
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	if err := tpl.Provision(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := tpl.Filter(req, header.Clone(), []byte(`{{include "plain.html" "included"}}`))
+	if err != nil || string(got) != "[included]" {
+		t.Errorf("include: got %q, %v", got, err)
+	}
+
+	for name, body := range map[string]string{
+		"env":                     `{{env "UNGZIP_TEST_SECRET"}}`,
+		"expandenv":               `{{expandenv "$UNGZIP_TEST_SECRET"}}`,
+		"getHostByName":           `{{getHostByName "localhost"}}`,
+		"httpInclude":             `{{httpInclude "/secret"}}`,
+		"env in an include":       `{{include "env.html"}}`,
+		"expandenv in an include": `{{include "expandenv.html"}}`,
+		"expandenv in two levels": `{{include "nested.html"}}`,
+		"expandenv in an import":  `{{import "define.html"}}{{template "secret"}}`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			got, err := tpl.Filter(req, header.Clone(), []byte(body))
+			if err == nil || !strings.Contains(err.Error(), "not available to response bodies") {
+				t.Errorf("got %q, %v", got, err)
+			}
+			if strings.Contains(string(got), "hunter2") {
+				t.Errorf("leaked the environment: %q", got)
+			}
+		})
+	}
+}
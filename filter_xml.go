@@ -0,0 +1,202 @@
+package ungzip
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+func init() {
+	caddy.RegisterModule(XMLToJSON{})
+}
+
+// XMLToJSON is a filter that converts decompressed XML bodies to JSON
+// and sets the Content-Type to application/json.
+//
+// Each element becomes an object keyed by the names of its children;
+// children that repeat become arrays. Elements with neither attributes
+// nor children become strings. Documents that fail to parse are left
+// as they are.
+type XMLToJSON struct {
+	// How to represent attributes: "prefix" stores them in the
+	// element's object under attribute_prefix + name, "drop" omits them
+	// Default: prefix
+	Attributes string `json:"attributes,omitempty"`
+
+	// Prefix for attribute keys
+	// Default: @
+	AttributePrefix string `json:"attribute_prefix,omitempty"`
+
+	// Key for the text content of elements that also have attributes
+	// or children
+	// Default: #text
+	TextKey string `json:"text_key,omitempty"`
+}
+
+// CaddyModule returns the Caddy module information.
+func (XMLToJSON) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.handlers.response_ungzip.filters.xml_to_json",
+		New: func() caddy.Module { return new(XMLToJSON) },
+	}
+}
+
+// UnmarshalCaddyfile implements caddyfile.Unmarshaler.
+//
+//	filter xml_to_json {
+//		attributes prefix|drop
+//		attribute_prefix <string>
+//		text_key <string>
+//	}
+func (x *XMLToJSON) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // consume filter name
+	for d.NextBlock(0) {
+		var target *string
+		switch d.Val() {
+		case "attributes":
+			target = &x.Attributes
+		case "attribute_prefix":
+			target = &x.AttributePrefix
+		case "text_key":
+			target = &x.TextKey
+		default:
+			return d.Errf("unknown subdirective %s", d.Val())
+		}
+		if !d.NextArg() {
+			return d.ArgErr()
+		}
+		*target = d.Val()
+	}
+	return nil
+}
+
+// Provision implements caddy.Provisioner.
+func (x *XMLToJSON) Provision(ctx caddy.Context) error {
+	if x.Attributes == "" {
+		x.Attributes = "prefix"
+	}
+	if x.AttributePrefix == "" {
+		x.AttributePrefix = "@"
+	}
+	if x.TextKey == "" {
+		x.TextKey = "#text"
+	}
+	return nil
+}
+
+// Validate implements caddy.Validator.
+func (x *XMLToJSON) Validate() error {
+	if x.Attributes != "prefix" && x.Attributes != "drop" {
+		return fmt.Errorf("invalid attributes %q", x.Attributes)
+	}
+	return nil
+}
+
+// Filter implements Filter.
+func (x *XMLToJSON) Filter(req *http.Request, header http.Header, body []byte) ([]byte, error) {
+	if !isXML(header.Get("Content-Type")) {
+		return body, nil
+	}
+
+	doc, err := x.convert(xml.NewDecoder(bytes.NewReader(body)))
+	if err != nil {
+		return body, nil
+	}
+	out, err := json.Marshal(doc)
+	if err != nil {
+		return body, nil
+	}
+	header.Set("Content-Type", "application/json")
+	return out, nil
+}
+
+// convert reads the root element from d.
+func (x *XMLToJSON) convert(d *xml.Decoder) (map[string]any, error) {
+	for {
+		tok, err := d.Token()
+		if err == io.EOF {
+			return nil, fmt.Errorf("no root element")
+		}
+		if err != nil {
+			return nil, err
+		}
+		if start, ok := tok.(xml.StartElement); ok {
+			value, err := x.element(d, start)
+			if err != nil {
+				return nil, err
+			}
+			return map[string]any{start.Name.Local: value}, nil
+		}
+	}
+}
+
+// element converts the element opened by start, consuming tokens up to
+// and including its end tag.
+func (x *XMLToJSON) element(d *xml.Decoder, start xml.StartElement) (any, error) {
+	obj := make(map[string]any)
+	if x.Attributes == "prefix" {
+		for _, a := range start.Attr {
+			obj[x.AttributePrefix+a.Name.Local] = a.Value
+		}
+	}
+
+	var text strings.Builder
+	for {
+		tok, err := d.Token()
+		if err != nil {
+			return nil, err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			child, err := x.element(d, t)
+			if err != nil {
+				return nil, err
+			}
+			name := t.Name.Local
+			switch existing := obj[name].(type) {
+			case nil:
+				obj[name] = child
+			case []any:
+				obj[name] = append(existing, child)
+			default:
+				obj[name] = []any{existing, child}
+			}
+		case xml.CharData:
+			text.Write(t)
+		case xml.EndElement:
+			s := strings.TrimSpace(text.String())
+			if len(obj) == 0 {
+				return s, nil
+			}
+			if s != "" {
+				obj[x.TextKey] = s
+			}
+			return obj, nil
+		}
+	}
+}
+
+// isXML reports whether contentType is an XML media type.
+func isXML(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return mediaType == "application/xml" || mediaType == "text/xml" || strings.HasSuffix(mediaType, "+xml")
+}
+
+// Interface guards
+var (
+	_ caddy.Provisioner     = (*XMLToJSON)(nil)
+	_ caddy.Validator       = (*XMLToJSON)(nil)
+	_ caddyfile.Unmarshaler = (*XMLToJSON)(nil)
+	_ Filter                = (*XMLToJSON)(nil)
+)
@@ -2,15 +2,28 @@ package ungzip
 
 import (
 	"bytes"
-	"compress/gzip"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"math"
+	"net"
 	"net/http"
+	"os"
+	"regexp"
+	"slices"
 	"strconv"
 	"strings"
-	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/klauspost/compress/zstd"
+	"go.uber.org/zap"
 
 	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig"
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
 	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
@@ -21,12 +34,416 @@ type ResponseUngzip struct {
 	// Only process responses from these paths
 	Paths []string `json:"paths,omitempty"`
 
+	// Always decompress responses from these paths, whatever their
+	// content type, content disposition, protocol, region or rollout
+	// cohort, for health checks, metrics scrapers and other monitoring
+	// agents that send no Accept-Encoding and cannot inflate. They are
+	// processed even when paths leaves them out. Upstreams can still
+	// have a response passed on as it is with the control header
+	ForcePaths []string `json:"force_paths,omitempty"`
+
 	// Only process responses with these content types
 	ContentTypes []string `json:"content_types,omitempty"`
 
+	// Only process responses to requests made over these protocols:
+	// "http/1.0", "http/1.1", "h2" or "h3". For example, only HTTP/1.0
+	// clients, which often predate gzip support, can be served
+	// decompressed responses, while others get them as they are
+	Protocols []string `json:"protocols,omitempty"`
+
+	// Placeholder giving the region of the client, as set by a GeoIP
+	// module, such as {geoip2.country_code}. Responses then depend on
+	// something Vary cannot express, so shared caches should be kept
+	// out of the way, such as with cache_control
+	RegionFrom string `json:"region_from,omitempty"`
+
+	// Only process responses to clients in these regions. Requires
+	// region_from
+	Regions []string `json:"regions,omitempty"`
+
+	// Regions whose clients always get decompressed responses as
+	// identity, never recompressed, such as those behind a partner CDN
+	// that cannot handle compressed responses. Requires region_from
+	IdentityRegions []string `json:"identity_regions,omitempty"`
+
+	// Only process this percentage of requests, between 0 and 100, to
+	// roll decompression out gradually. Requests left out are counted
+	// in the holdout cohort of the rollout_requests_total metric, the
+	// others in the rollout cohort
+	// Default: 0 (all requests)
+	RolloutPercent float64 `json:"rollout_percent,omitempty"`
+
+	// Placeholder whose value decides, by a stable hash, which requests
+	// are in the rollout, such as {http.vars.client_ip} or
+	// {http.request.header.X-User-Id}, so that clients stay in their
+	// cohort
+	// Default: pick requests at random
+	RolloutKey string `json:"rollout_key,omitempty"`
+
 	// Maximum size of response to decompress (in bytes)
 	// Default: 10MB
 	MaxSize int64 `json:"max_size,omitempty"`
+
+	// Placeholder to take the maximum size from for each request, such
+	// as {http.vars.max_size}. max_size applies when it is not a number
+	MaxSizeFrom string `json:"max_size_from,omitempty"`
+
+	// Maximum size of a decompressed body (in bytes). Decoding fails
+	// past it, and the error policy applies. 0 means no limit
+	MaxDecompressedSize int64 `json:"max_decompressed_size,omitempty"`
+
+	// Maximum time decoding a single body may take. Decoding fails past
+	// it, and the error policy applies. 0 means no limit
+	DecodeTimeout caddy.Duration `json:"decode_timeout,omitempty"`
+
+	// Content codings to decode, as Content-Encoding tokens
+	// Default: ["gzip"]
+	Encodings []string `json:"encodings,omitempty"`
+
+	// Accept-Encoding to send upstream in place of the client's, such
+	// as "identity", so that upstreams able to serve responses as they
+	// are skip compressing them, and this handler skips decompressing
+	// them. Responses compressed anyway are still decompressed. The
+	// client's Accept-Encoding is kept for recompress
+	UpstreamAcceptEncoding string `json:"upstream_accept_encoding,omitempty"`
+
+	// How to treat responses with a Content-Encoding that is neither
+	// in the IANA registry nor has a decoder, such as sdch or a custom
+	// token, which clients are unlikely to understand: "passthrough"
+	// sends them as they are, "error" answers with a 502, and "strip"
+	// drops the unknown tokens from Content-Encoding, for upstreams
+	// that label bodies with codings they did not actually apply
+	// Default: "passthrough"
+	UnknownEncoding string `json:"unknown_encoding,omitempty"`
+
+	// Make sure clients get identity responses: ask upstreams for them,
+	// as upstream_accept_encoding identity does, and decompress those
+	// that come compressed anyway. The identity_responses_total metric
+	// counts how often the upstream obliged, and how often this
+	// handler had to fall back to decompressing
+	EnsureIdentity bool `json:"ensure_identity,omitempty"`
+
+	// Response headers that mark responses to pass on as they are,
+	// without buffering them, such as those of caching layers that
+	// serve content already decompressed. Each is a header name, or a
+	// name and a value it must contain, like "Cache-Status: hit".
+	// Responses reporting a cache hit in Cache-Status (RFC 9211) without
+	// a Content-Encoding are always passed on this way
+	SkipHeaders []string `json:"skip_headers,omitempty"`
+
+	// Response header that upstreams which cannot set Content-Encoding
+	// use to name the codings of the body instead, such as
+	// "X-Decompress: zstd". It only applies to responses without a
+	// Content-Encoding, and is removed from those that are decompressed
+	HintHeader string `json:"hint_header,omitempty"`
+
+	// Object store metadata headers that carry the Content-Encoding of
+	// stored objects, such as "x-amz-meta-content-encoding" for S3 and
+	// MinIO setups that only keep it there. Like hint_header, they are
+	// consulted in order for responses without a Content-Encoding, and
+	// removed from those that are decompressed
+	MetadataHeaders []string `json:"metadata_headers,omitempty"`
+
+	// Dictionaries for decoding and re-encoding zstd responses
+	ZstdDictionaries []ZstdDictionary `json:"zstd_dictionaries,omitempty"`
+
+	// Maximum number of content codings to decode from one response
+	// Default: 3
+	MaxEncodingLayers int `json:"max_encoding_layers,omitempty"`
+
+	// Size of the buffer decoders read compressed bodies through, in
+	// bytes. Bodies are held in memory, so by default decoders read
+	// them directly
+	ReadBufferSize int `json:"read_buffer_size,omitempty"`
+
+	// Size of the chunks decompressed bodies are copied out in, in
+	// bytes. Smaller chunks use less memory, larger ones fewer writes
+	// Default: whatever io.Copy picks, typically 32KiB
+	CopyBufferSize int `json:"copy_buffer_size,omitempty"`
+
+	// Number of blocks of BGZF (bgzip) responses to decompress at once.
+	// BGZF splits data into independently compressed blocks, which
+	// makes large files much faster to decompress on several cores.
+	// Gzip responses that are not BGZF are decompressed as usual
+	// Default: 0 (one block at a time)
+	BGZFWorkers int `json:"bgzf_workers,omitempty"`
+
+	// Value of the route label on this handler's metrics, to tell
+	// routes or sites apart. May contain placeholders, which should
+	// only expand to a small set of values
+	MetricsLabel string `json:"metrics_label,omitempty"`
+
+	// Fraction of decisions, between 0 and 1, logged at info level
+	// rather than debug level. Failures are always logged
+	// Default: 0
+	LogSampleRate float64 `json:"log_sample_rate,omitempty"`
+
+	// Fail the decode of responses once they have expanded by more than
+	// this ratio, past the first 1MiB of output, as decompression bombs
+	// Default: 0 (disabled)
+	MaxRatio float64 `json:"max_ratio,omitempty"`
+
+	// Count and log responses that expand by more than this ratio, as
+	// possible decompression bombs. They are still decompressed
+	// Default: 0 (disabled)
+	SuspiciousRatio float64 `json:"suspicious_ratio,omitempty"`
+
+	// Placeholder to take the suspicious ratio from for each request.
+	// suspicious_ratio applies when it is not a number
+	SuspiciousRatioFrom string `json:"suspicious_ratio_from,omitempty"`
+
+	// Report the handler as degraded on the admin API's /ungzip/health
+	// when more than this fraction of recent responses failed to decompress
+	// Default: 0.5
+	FailureRateThreshold float64 `json:"failure_rate_threshold,omitempty"`
+
+	// Number of recent handling decisions to keep for the admin API's
+	// /ungzip/decisions endpoint
+	// Default: 0 (none)
+	DecisionHistory int `json:"decision_history,omitempty"`
+
+	// Attribute decompression cost to a label taken from the request,
+	// for the decompressed_bytes_total and decompress_seconds_total metrics.
+	// One of "path_prefix", "host", "upstream" (the reverse_proxy
+	// upstream's host:port) or "header:<name>"
+	CostLabel string `json:"cost_label,omitempty"`
+
+	// Record every decompressed response to the
+	// http.handlers.response_ungzip.audit logger
+	AuditLog bool `json:"audit_log,omitempty"`
+
+	// Write compressed bodies that fail to decompress to this directory,
+	// along with a JSON file describing the request
+	QuarantineDir string `json:"quarantine_dir,omitempty"`
+
+	// Maximum number of compressed bytes to keep per quarantined body
+	// Default: 1MB
+	QuarantineMaxSize int64 `json:"quarantine_max_size,omitempty"`
+
+	// What to do when a response cannot be decompressed: "passthrough"
+	// sends the original response, "error" fails the request with 502
+	// Default: passthrough
+	OnError string `json:"on_error,omitempty"`
+
+	// Stream the decompressed body to the client while it is being
+	// inflated, instead of inflating it fully before sending. The
+	// response is sent without a Content-Length, and a failure part
+	// way through aborts the response rather than falling back
+	Stream bool `json:"stream,omitempty"`
+
+	// Number of goroutines that perform decompression. When set,
+	// buffered responses are inflated on this pool rather than on the
+	// request goroutine. The pool is shared by all handlers with the
+	// same workers and worker_queue, and kept across config reloads
+	// Default: 0 (disabled)
+	Workers int `json:"workers,omitempty"`
+
+	// Number of decompression jobs that may wait for a free worker
+	// Default: same as workers
+	WorkerQueue int `json:"worker_queue,omitempty"`
+
+	// How long to wait for room in the queue before giving up
+	// Default: 0 (don't wait)
+	WorkerTimeout caddy.Duration `json:"worker_timeout,omitempty"`
+
+	// What to do when the worker pool can't accept a job or
+	// max_inflight_bytes is reached: "passthrough" sends the original
+	// compressed response, "reject" responds with 503 and Retry-After
+	// Default: passthrough
+	OnOverload string `json:"on_overload,omitempty"`
+
+	// Degrade while the Go heap is larger than this many bytes
+	// Default: 0 (disabled)
+	MemoryLimit int64 `json:"memory_limit,omitempty"`
+
+	// How to degrade under memory pressure: "passthrough" stops
+	// buffering responses entirely, "stream" keeps decompressing but
+	// without buffering the decompressed body
+	// Default: passthrough
+	MemoryDegrade string `json:"memory_degrade,omitempty"`
+
+	// Maximum rate, in bytes per second, at which each decompressed
+	// response is written to the client
+	// Default: 0 (unlimited)
+	MaxOutputRate int64 `json:"max_output_rate,omitempty"`
+
+	// Maximum number of bytes that may be held in response buffers by
+	// all ungzip handlers in the process at once. Once reached, new
+	// requests are handled according to on_overload
+	// Default: 0 (unlimited)
+	MaxInflightBytes int64 `json:"max_inflight_bytes,omitempty"`
+
+	// How often to flush streamed output to the client. A negative
+	// value flushes after every write, which keeps latency low on
+	// HTTP/2 and HTTP/3 where writes are otherwise buffered.
+	// Default: 0 (flush only at the end of the response)
+	FlushInterval caddy.Duration `json:"flush_interval,omitempty"`
+
+	// Instead of decompressing responses, inflate only their first
+	// preview_size bytes into the ungzip_preview variable and serve the
+	// original compressed body. Later handlers can then inspect the
+	// content through {http.vars.ungzip_preview}
+	// Default: 0 (disabled)
+	PreviewSize int64 `json:"preview_size,omitempty"`
+
+	// Copy the first capture_size bytes of decompressed bodies into the
+	// ungzip_body variable, so that handlers wrapping this one, such as
+	// custom auth or WAF plugins, can inspect plaintext content through
+	// {http.vars.ungzip_body} once the response has been written
+	// Default: 0 (disabled)
+	CaptureSize int64 `json:"capture_size,omitempty"`
+
+	// Decompress responses only to check that they are well formed,
+	// and serve the compressed original either way. Broken upstream
+	// compression is logged and counted in the verified_responses_total
+	// metric, making this a canary to run before decompressing for real
+	VerifyOnly bool `json:"verify_only,omitempty"`
+
+	// Fraction of decompressed responses, between 0 and 1, to check
+	// once they are sent: a recompressed body must decode back to the
+	// decompressed one, and a JSON body must parse. Divergences are
+	// logged and counted in the comparisons_total metric, to build
+	// confidence before a full rollout
+	// Default: 0 (no checks)
+	CompareSampleRate float64 `json:"compare_sample_rate,omitempty"`
+
+	// How to treat responses with a Content-Disposition of attachment,
+	// which are often .gz files the user wants as they are: "skip"
+	// leaves them compressed, "only" decompresses nothing else
+	// Default: decompress them like any other response
+	Attachments string `json:"attachments,omitempty"`
+
+	// Also decompress responses that look like .gz files served with a
+	// Content-Encoding of gzip by mistake, by a Content-Type of
+	// application/gzip or a path ending in .gz or .tgz. Clients
+	// downloading those expect the archive itself, so they are left
+	// compressed unless this is set
+	DecodeArchives bool `json:"decode_archives,omitempty"`
+
+	// What to do with encoded responses that have no body: those to HEAD
+	// requests, 204 and 304 responses and empty responses to OPTIONS.
+	// "adjust" changes their headers as if the body had been
+	// decompressed, so that they agree with full responses; "keep"
+	// passes them on as they are
+	// Default: "adjust"
+	Bodiless string `json:"bodiless,omitempty"`
+
+	// What to do when the config has an encode handler running before
+	// this one, compressing decompressed responses again, or after it,
+	// compressing responses only for them to be decompressed: "warn"
+	// logs it when the config loads, "error" fails loading the config,
+	// "ignore" allows it, for deliberately re-encoding with what
+	// clients accept
+	// Default: "warn"
+	EncodeOrder string `json:"encode_order,omitempty"`
+
+	// Correct the Content-Length of compressed responses whose declared
+	// length doesn't match the body the upstream actually sent, such as
+	// upstreams that declare the decoded size of an encoded body. Without
+	// this, mismatches are only logged and counted
+	FixContentLength bool `json:"fix_content_length,omitempty"`
+
+	// Verify a digest or signature of the compressed body before
+	// decoding it, rejecting responses that fail
+	Verify *Verify `json:"verify,omitempty"`
+
+	// Let trusted clients ask how their response was handled with a
+	// query parameter
+	DebugParam *DebugParam `json:"debug_param,omitempty"`
+
+	// Inject decode failures and latency, to test alerting and
+	// fallbacks. Not for production
+	Chaos *Chaos `json:"chaos,omitempty"`
+
+	// Rewrite Cache-Control on responses that were decompressed
+	CacheControl *CacheControl `json:"cache_control,omitempty"`
+
+	// What to do with the ETag and Last-Modified of responses that were
+	// decompressed: "weak" marks the ETag weak, so it is never used for
+	// ranges; "strip" removes both; "keep" leaves the origin's as they
+	// are, for the decompressed form to be treated as the same
+	// representation
+	// Default: derive a strong ETag of the decompressed form
+	Validators string `json:"validators,omitempty"`
+
+	// Response header to carry the SHA-256 digest of the body as sent,
+	// which is the decompressed body unless it is recompressed, so that
+	// downstream systems can verify it end to end. Repr-Digest and
+	// Content-Digest get the form of RFC 9530, other headers lowercase
+	// hex. Streamed responses send it as a trailer
+	DigestHeader string `json:"digest_header,omitempty"`
+
+	// Response headers to remove from transformed responses, such as
+	// the X-Compressed-By or CF-Cache-Status left by the origin's
+	// compression stack
+	HideHeaders []string `json:"hide_headers,omitempty"`
+
+	// Response headers to add to transformed responses. Values may
+	// contain placeholders
+	AddHeaders http.Header `json:"add_headers,omitempty"`
+
+	// Rewrites of the Location, Content-Location and Link URLs of
+	// transformed responses, applied in order
+	LinkRewrites []*LinkRewrite `json:"link_rewrites,omitempty"`
+
+	// Send a copy of decompressed responses to another service
+	Shadow *Shadow `json:"shadow,omitempty"`
+
+	// Encodings to re-encode transformed responses with, in order of
+	// preference, when the client accepts them: "gzip" and/or "zstd"
+	Recompress []string `json:"recompress,omitempty"`
+
+	// Maximum total size of re-encoded variants to cache, in bytes
+	// Default: 0 (no caching)
+	RecompressCacheSize int64 `json:"recompress_cache_size,omitempty"`
+
+	// Maximum total size of gzip member indexes to keep, in bytes. For
+	// gzip files made of independent members, like those of bgzip, an
+	// index lets range requests for the decompressed form be served by
+	// asking the upstream for just the members that hold the range.
+	// Indexes are built from responses to range requests, and need a
+	// strong ETag and an upstream that serves ranges. The indexes are
+	// shared by all handlers with the same range_index_size, and kept
+	// across config reloads
+	// Default: 0 (no indexes)
+	RangeIndexSize int64 `json:"range_index_size,omitempty"`
+
+	// Maximum total size of decompressed responses to cache, in bytes.
+	// Cached responses also serve Range requests for their
+	// decompressed form. Cached responses would not go through filters,
+	// so this cannot be combined with them
+	// Default: 0 (no caching)
+	CacheSize int64 `json:"cache_size,omitempty"`
+
+	// Filters applied to decompressed bodies, in order. Filters need
+	// the whole body, so they cannot be combined with stream.
+	FiltersRaw []json.RawMessage `json:"filters,omitempty" caddy:"namespace=http.handlers.response_ungzip.filters inline_key=filter"`
+
+	// Predicates that must all allow a response for it to be
+	// transformed
+	PredicatesRaw []json.RawMessage `json:"predicates,omitempty" caddy:"namespace=http.handlers.response_ungzip.predicates inline_key=predicate"`
+
+	filtersRaw      []json.RawMessage // FiltersRaw, which loading clears
+	predicatesRaw   []json.RawMessage // PredicatesRaw, likewise
+	filters         []Filter
+	predicates      []Predicate
+	zstdEncoder     *zstd.Encoder
+	zstdDicts       [][]byte
+	recompressCache *lruCache
+	cache           *lruCache
+	rangeIndex      *lruCache
+	logger          *zap.Logger
+	auditLogger     *zap.Logger
+	metrics         *ungzipMetrics
+	pool            *workerPool
+	memory          *memoryMonitor
+	healthStats     *healthTracker
+	decisions       *decisionRing
+	shouldBuffer    caddyhttp.ShouldBufferFunc
+	sharedKeys      []string
+
+	// the Caddyfile adapter's, for parsing routes while adapting
+	helper *httpcaddyfile.Helper
 }
 
 // CaddyModule returns the Caddy module information.
@@ -37,149 +454,1875 @@ func (ResponseUngzip) CaddyModule() caddy.ModuleInfo {
 	}
 }
 
-// UnmarshalCaddyfile implements caddyfile.Unmarshaler.
+// UnmarshalCaddyfile implements caddyfile.Unmarshaler. Repeated
+// ungzip blocks, and repeated subdirectives within one, merge: path,
+// content_type, encodings and recompress values accumulate without
+// duplicates, filters and predicates accumulate in order,
+// zstd_dictionary, shadow and cache_control blocks for the same target
+// combine, and any other option takes the last value given.
+//
+// The preset subdirective brings in one of the option bundles in
+// presets, such as api_json, as if its options were written in its
+// place, so that options after it refine it.
+//
+// For the common case, content types and a maximum size can be given
+// inline, with a path matcher in front as usual:
+//
+//	ungzip /api/* application/json 20MB
 func (r *ResponseUngzip) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 	for d.Next() {
+		for d.NextArg() {
+			if strings.Contains(d.Val(), "/") {
+				r.ContentTypes = appendUnique(r.ContentTypes, d.Val())
+				continue
+			}
+			size, err := parseSize(d.Val())
+			if err != nil {
+				return d.Errf("invalid argument %s: expected a content type or a size", d.Val())
+			}
+			r.MaxSize = size
+		}
 		for d.NextBlock(0) {
 			switch d.Val() {
+			case "preset":
+				if err := r.applyPreset(d); err != nil {
+					return err
+				}
+
+			case "no_inherit":
+				// handled by parseCaddyfile, before the defaults apply
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+
 			case "path":
+				paths := d.RemainingArgs()
+				if len(paths) == 0 {
+					return d.ArgErr()
+				}
+				r.Paths = appendUnique(r.Paths, paths...)
+
+			case "force_path":
+				paths := d.RemainingArgs()
+				if len(paths) == 0 {
+					paths = monitoringPaths
+				}
+				r.ForcePaths = appendUnique(r.ForcePaths, paths...)
+
+			case "protocols":
+				protocols := d.RemainingArgs()
+				if len(protocols) == 0 {
+					return d.ArgErr()
+				}
+				for _, protocol := range protocols {
+					if !slices.Contains(protocolNames, protocol) {
+						return d.Errf("invalid protocol %q; must be one of %s", protocol, strings.Join(protocolNames, ", "))
+					}
+				}
+				r.Protocols = appendUnique(r.Protocols, protocols...)
+
+			case "region_from":
 				if !d.NextArg() {
 					return d.ArgErr()
 				}
-				r.Paths = append(r.Paths, d.Val())
-				for d.NextArg() {
-					r.Paths = append(r.Paths, d.Val())
+				r.RegionFrom = d.Val()
+
+			case "regions":
+				regions := d.RemainingArgs()
+				if len(regions) == 0 {
+					return d.ArgErr()
 				}
+				r.Regions = appendUnique(r.Regions, regions...)
 
-			case "content_type":
+			case "identity_regions":
+				regions := d.RemainingArgs()
+				if len(regions) == 0 {
+					return d.ArgErr()
+				}
+				r.IdentityRegions = appendUnique(r.IdentityRegions, regions...)
+
+			case "rollout_percent":
 				if !d.NextArg() {
 					return d.ArgErr()
 				}
-				r.ContentTypes = append(r.ContentTypes, d.Val())
-				for d.NextArg() {
-					r.ContentTypes = append(r.ContentTypes, d.Val())
+				percent, err := strconv.ParseFloat(strings.TrimSuffix(d.Val(), "%"), 64)
+				if err != nil || percent <= 0 || percent > 100 {
+					return d.Errf("invalid rollout_percent %s: must be more than 0 and at most 100", d.Val())
+				}
+				r.RolloutPercent = percent
+				if d.NextArg() {
+					r.RolloutKey = d.Val()
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+
+			case "content_type":
+				types := d.RemainingArgs()
+				if len(types) == 0 {
+					return d.ArgErr()
 				}
+				r.ContentTypes = appendUnique(r.ContentTypes, types...)
 
 			case "max_size":
 				if !d.NextArg() {
 					return d.ArgErr()
 				}
-				size, err := strconv.ParseInt(d.Val(), 10, 64)
+				if strings.HasPrefix(d.Val(), "{") {
+					r.MaxSizeFrom = d.Val()
+					break
+				}
+				size, err := parseSize(d.Val())
 				if err != nil {
 					return d.Errf("invalid max_size: %v", err)
 				}
 				r.MaxSize = size
 
-			default:
-				return d.Errf("unknown subdirective %s", d.Val())
-			}
-		}
-	}
+			case "max_decompressed_size":
+				if err := sizeArg(d, &r.MaxDecompressedSize); err != nil {
+					return err
+				}
 
-	// Set default max size if not specified
-	if r.MaxSize == 0 {
-		r.MaxSize = 10 * 1024 * 1024 // 10MB default
-	}
+			case "decode_timeout":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				dur, err := caddy.ParseDuration(d.Val())
+				if err != nil {
+					return d.Errf("invalid decode_timeout: %v", err)
+				}
+				r.DecodeTimeout = caddy.Duration(dur)
 
-	return nil
-}
+			case "max_encoding_layers":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				layers, err := strconv.Atoi(d.Val())
+				if err != nil {
+					return d.Errf("invalid max_encoding_layers: %v", err)
+				}
+				r.MaxEncodingLayers = layers
 
-// Provision implements caddy.Provisioner.
-func (r *ResponseUngzip) Provision(ctx caddy.Context) error {
-	return nil
-}
+			case "metrics_label":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				r.MetricsLabel = d.Val()
 
-// Validate implements caddy.Validator.
-func (r *ResponseUngzip) Validate() error {
-	if r.MaxSize < 0 {
-		return fmt.Errorf("max_size cannot be negative")
-	}
-	return nil
-}
+			case "log_sample_rate":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				rate, err := strconv.ParseFloat(d.Val(), 64)
+				if err != nil {
+					return d.Errf("invalid log_sample_rate: %v", err)
+				}
+				r.LogSampleRate = rate
 
-var bufPool = sync.Pool{
-	New: func() interface{} {
-		return new(bytes.Buffer)
-	},
-}
+			case "max_ratio":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				ratio, err := strconv.ParseFloat(d.Val(), 64)
+				if err != nil {
+					return d.Errf("invalid max_ratio: %v", err)
+				}
+				r.MaxRatio = ratio
 
-func (r ResponseUngzip) ServeHTTP(w http.ResponseWriter, req *http.Request, next caddyhttp.Handler) error {
-	// Check if path matches configured paths
-	if len(r.Paths) > 0 {
-		matched := false
-		for _, path := range r.Paths {
-			if strings.HasPrefix(req.URL.Path, path) {
-				matched = true
-				break
-			}
-		}
-		if !matched {
-			return next.ServeHTTP(w, req)
-		}
-	}
+			case "suspicious_ratio":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				if strings.HasPrefix(d.Val(), "{") {
+					r.SuspiciousRatioFrom = d.Val()
+					break
+				}
+				ratio, err := strconv.ParseFloat(d.Val(), 64)
+				if err != nil {
+					return d.Errf("invalid suspicious_ratio: %v", err)
+				}
+				r.SuspiciousRatio = ratio
 
-	respBuf := bufPool.Get().(*bytes.Buffer)
-	respBuf.Reset()
-	defer bufPool.Put(respBuf)
+			case "failure_rate_threshold":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				rate, err := strconv.ParseFloat(d.Val(), 64)
+				if err != nil {
+					return d.Errf("invalid failure_rate_threshold: %v", err)
+				}
+				r.FailureRateThreshold = rate
 
-	rec := caddyhttp.NewResponseRecorder(w, respBuf, func(status int, headers http.Header) bool {
-		return true
-	})
+			case "decision_history":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				size, err := strconv.Atoi(d.Val())
+				if err != nil {
+					return d.Errf("invalid decision_history: %v", err)
+				}
+				r.DecisionHistory = size
 
-	if err := next.ServeHTTP(rec, req); err != nil {
-		return err
-	}
+			case "cost_label":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				r.CostLabel = d.Val()
+				if r.CostLabel == "header" {
+					if !d.NextArg() {
+						return d.ArgErr()
+					}
+					r.CostLabel += ":" + d.Val()
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
 
-	if !isGzipped(rec.Header()) {
-		return rec.WriteResponse()
-	}
+			case "audit_log":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				r.AuditLog = true
 
-	// Check content type if configured
-	if len(r.ContentTypes) > 0 {
-		contentType := rec.Header().Get("Content-Type")
-		matched := false
-		for _, ct := range r.ContentTypes {
-			if strings.HasPrefix(contentType, ct) {
-				matched = true
-				break
-			}
-		}
-		if !matched {
-			return rec.WriteResponse()
-		}
-	}
+			case "quarantine_dir":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				r.QuarantineDir = d.Val()
 
-	if int64(rec.Buffer().Len()) > r.MaxSize {
-		return rec.WriteResponse()
-	}
+			case "quarantine_max_size":
+				if err := sizeArg(d, &r.QuarantineMaxSize); err != nil {
+					return err
+				}
 
-	reader, err := gzip.NewReader(rec.Buffer())
-	if err != nil {
-		return rec.WriteResponse()
-	}
-	defer reader.Close()
+			case "on_error":
+				if err := enumArg(d, &r.OnError, "passthrough", "error"); err != nil {
+					return err
+				}
 
-	outBuf := bufPool.Get().(*bytes.Buffer)
-	outBuf.Reset()
-	defer bufPool.Put(outBuf)
+			case "stream":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				r.Stream = true
 
-	if _, err := io.Copy(outBuf, reader); err != nil {
-		return rec.WriteResponse()
-	}
+			case "workers":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				n, err := strconv.Atoi(d.Val())
+				if err != nil {
+					return d.Errf("invalid workers: %v", err)
+				}
+				r.Workers = n
 
-	rec.Header().Del("Content-Encoding")
-	rec.Header().Set("Content-Length", strconv.Itoa(outBuf.Len()))
+			case "worker_queue":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				n, err := strconv.Atoi(d.Val())
+				if err != nil {
+					return d.Errf("invalid worker_queue: %v", err)
+				}
+				r.WorkerQueue = n
 
-	return rec.WriteResponse()
-}
+			case "worker_timeout":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				dur, err := caddy.ParseDuration(d.Val())
+				if err != nil {
+					return d.Errf("invalid worker_timeout: %v", err)
+				}
+				r.WorkerTimeout = caddy.Duration(dur)
 
-func isGzipped(header http.Header) bool {
-	return strings.Contains(strings.ToLower(header.Get("Content-Encoding")), "gzip")
-}
+			case "on_overload":
+				if err := enumArg(d, &r.OnOverload, "passthrough", "reject"); err != nil {
+					return err
+				}
 
-func parseCaddyfile(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error) {
-	handler := new(ResponseUngzip)
+			case "memory_limit":
+				if err := sizeArg(d, &r.MemoryLimit); err != nil {
+					return err
+				}
+
+			case "memory_degrade":
+				if err := enumArg(d, &r.MemoryDegrade, "passthrough", "stream"); err != nil {
+					return err
+				}
+
+			case "max_output_rate":
+				if err := sizeArg(d, &r.MaxOutputRate); err != nil {
+					return err
+				}
+
+			case "max_inflight_bytes":
+				if err := sizeArg(d, &r.MaxInflightBytes); err != nil {
+					return err
+				}
+
+			case "flush_interval":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				dur, err := caddy.ParseDuration(d.Val())
+				if err != nil {
+					return d.Errf("invalid flush_interval: %v", err)
+				}
+				r.FlushInterval = caddy.Duration(dur)
+
+			case "preview_size":
+				if err := sizeArg(d, &r.PreviewSize); err != nil {
+					return err
+				}
+
+			case "capture_size":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				size, err := parseSize(d.Val())
+				if err != nil {
+					return d.Errf("invalid capture_size: %v", err)
+				}
+				r.CaptureSize = size
+
+			case "verify_only":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				r.VerifyOnly = true
+
+			case "compare_sample_rate":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				rate, err := strconv.ParseFloat(d.Val(), 64)
+				if err != nil {
+					return d.Errf("invalid compare_sample_rate: %v", err)
+				}
+				r.CompareSampleRate = rate
+
+			case "fix_content_length":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				r.FixContentLength = true
+
+			case "decode_archives":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				r.DecodeArchives = true
+
+			case "encode_order":
+				if err := enumArg(d, &r.EncodeOrder, "warn", "error", "ignore"); err != nil {
+					return err
+				}
+
+			case "bodiless":
+				if err := enumArg(d, &r.Bodiless, "adjust", "keep"); err != nil {
+					return err
+				}
+
+			case "attachments":
+				if err := enumArg(d, &r.Attachments, "skip", "only"); err != nil {
+					return err
+				}
+
+			case "validators":
+				if err := enumArg(d, &r.Validators, "weak", "strip", "keep"); err != nil {
+					return err
+				}
+
+			case "digest_header":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				r.DigestHeader = d.Val()
+
+			case "hide_headers":
+				headers := d.RemainingArgs()
+				if len(headers) == 0 {
+					return d.ArgErr()
+				}
+				r.HideHeaders = appendUnique(r.HideHeaders, headers...)
+
+			case "link_rewrite":
+				lr := new(LinkRewrite)
+				if !d.Args(&lr.Search) {
+					return d.ArgErr()
+				}
+				d.Args(&lr.Replace)
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				if _, err := regexp.Compile(lr.Search); err != nil {
+					return d.Errf("invalid link_rewrite search: %v", err)
+				}
+				r.LinkRewrites = append(r.LinkRewrites, lr)
+
+			case "add_headers":
+				if r.AddHeaders == nil {
+					r.AddHeaders = make(http.Header)
+				}
+				if args := d.RemainingArgs(); len(args) > 0 {
+					if len(args) != 2 {
+						return d.ArgErr()
+					}
+					r.AddHeaders.Add(args[0], args[1])
+				}
+				for nesting := d.Nesting(); d.NextBlock(nesting); {
+					name := d.Val()
+					if !d.NextArg() {
+						return d.ArgErr()
+					}
+					r.AddHeaders.Add(name, d.Val())
+					if d.NextArg() {
+						return d.ArgErr()
+					}
+				}
+
+			case "cache_control":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				if r.CacheControl == nil {
+					r.CacheControl = new(CacheControl)
+				}
+				for nesting := d.Nesting(); d.NextBlock(nesting); {
+					switch d.Val() {
+					case "add":
+						args := d.RemainingArgs()
+						if len(args) == 0 {
+							return d.ArgErr()
+						}
+						r.CacheControl.Add = append(r.CacheControl.Add, args...)
+					case "remove":
+						args := d.RemainingArgs()
+						if len(args) == 0 {
+							return d.ArgErr()
+						}
+						r.CacheControl.Remove = append(r.CacheControl.Remove, args...)
+					case "max_age":
+						if !d.NextArg() {
+							return d.ArgErr()
+						}
+						dur, err := caddy.ParseDuration(d.Val())
+						if err != nil {
+							return d.Errf("invalid max_age: %v", err)
+						}
+						r.CacheControl.MaxAge = caddy.Duration(dur)
+					case "s_maxage":
+						if !d.NextArg() {
+							return d.ArgErr()
+						}
+						dur, err := caddy.ParseDuration(d.Val())
+						if err != nil {
+							return d.Errf("invalid s_maxage: %v", err)
+						}
+						r.CacheControl.SMaxAge = caddy.Duration(dur)
+					case "stale_while_revalidate":
+						if !d.NextArg() {
+							return d.ArgErr()
+						}
+						dur, err := caddy.ParseDuration(d.Val())
+						if err != nil {
+							return d.Errf("invalid stale_while_revalidate: %v", err)
+						}
+						r.CacheControl.StaleWhileRevalidate = caddy.Duration(dur)
+					default:
+						return d.Errf("unknown cache_control subdirective %s", d.Val())
+					}
+				}
+
+			case "encodings":
+				encodings := d.RemainingArgs()
+				if len(encodings) == 0 {
+					return d.ArgErr()
+				}
+				for _, enc := range encodings {
+					if _, ok := decoders[enc]; !ok {
+						return d.Errf("unsupported encoding %q; it may need to be compiled in", enc)
+					}
+				}
+				r.Encodings = appendUnique(r.Encodings, encodings...)
+
+			case "upstream_accept_encoding":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				r.UpstreamAcceptEncoding = d.Val()
+
+			case "unknown_encoding":
+				if err := enumArg(d, &r.UnknownEncoding, "passthrough", "error", "strip"); err != nil {
+					return err
+				}
+
+			case "ensure_identity":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				r.EnsureIdentity = true
+
+			case "skip_headers":
+				headers := d.RemainingArgs()
+				if len(headers) == 0 {
+					return d.ArgErr()
+				}
+				r.SkipHeaders = appendUnique(r.SkipHeaders, headers...)
+
+			case "metadata_headers":
+				headers := d.RemainingArgs()
+				if len(headers) == 0 {
+					return d.ArgErr()
+				}
+				r.MetadataHeaders = appendUnique(r.MetadataHeaders, headers...)
+
+			case "read_buffer_size", "copy_buffer_size":
+				name := d.Val()
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				size, err := parseSize(d.Val())
+				if err != nil {
+					return d.Errf("invalid %s: %v", name, err)
+				}
+				if name == "read_buffer_size" {
+					r.ReadBufferSize = int(size)
+				} else {
+					r.CopyBufferSize = int(size)
+				}
+
+			case "bgzf_workers":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				n, err := strconv.Atoi(d.Val())
+				if err != nil {
+					return d.Errf("invalid bgzf_workers: %v", err)
+				}
+				r.BGZFWorkers = n
+
+			case "hint_header":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				r.HintHeader = d.Val()
+
+			case "zstd_dictionary":
+				var zd ZstdDictionary
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				zd.File = d.Val()
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				for nesting := d.Nesting(); d.NextBlock(nesting); {
+					switch d.Val() {
+					case "paths":
+						zd.Paths = append(zd.Paths, d.RemainingArgs()...)
+					case "content_types":
+						zd.ContentTypes = append(zd.ContentTypes, d.RemainingArgs()...)
+					default:
+						return d.Errf("unknown zstd_dictionary subdirective %s", d.Val())
+					}
+				}
+				if i := slices.IndexFunc(r.ZstdDictionaries, func(other ZstdDictionary) bool { return other.File == zd.File }); i >= 0 {
+					other := &r.ZstdDictionaries[i]
+					other.Paths = appendUnique(other.Paths, zd.Paths...)
+					other.ContentTypes = appendUnique(other.ContentTypes, zd.ContentTypes...)
+					break
+				}
+				r.ZstdDictionaries = append(r.ZstdDictionaries, zd)
+
+			case "shadow":
+				if r.Shadow == nil {
+					r.Shadow = new(Shadow)
+				}
+				if d.NextArg() {
+					r.Shadow.URL = d.Val()
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				for nesting := d.Nesting(); d.NextBlock(nesting); {
+					switch d.Val() {
+					case "route":
+						if r.helper == nil {
+							return d.Err("shadow route can only be used in a site block")
+						}
+						h := *r.helper
+						h.Dispenser = d.NewFromNextSegment()
+						sub, err := httpcaddyfile.ParseSegmentAsSubroute(h)
+						if err != nil {
+							return err
+						}
+						r.Shadow.Routes = append(r.Shadow.Routes, sub.(*caddyhttp.Subroute).Routes...)
+					case "timeout":
+						if !d.NextArg() {
+							return d.ArgErr()
+						}
+						dur, err := caddy.ParseDuration(d.Val())
+						if err != nil {
+							return d.Errf("invalid shadow timeout: %v", err)
+						}
+						r.Shadow.Timeout = caddy.Duration(dur)
+					case "max_concurrent":
+						if !d.NextArg() {
+							return d.ArgErr()
+						}
+						n, err := strconv.Atoi(d.Val())
+						if err != nil {
+							return d.Errf("invalid shadow max_concurrent: %v", err)
+						}
+						r.Shadow.MaxConcurrent = n
+					default:
+						return d.Errf("unknown shadow subdirective %s", d.Val())
+					}
+				}
+
+			case "verify":
+				if r.Verify == nil {
+					r.Verify = new(Verify)
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				for nesting := d.Nesting(); d.NextBlock(nesting); {
+					switch d.Val() {
+					case "header":
+						if !d.NextArg() {
+							return d.ArgErr()
+						}
+						r.Verify.Header = d.Val()
+					case "algorithm":
+						if err := enumArg(d, &r.Verify.Algorithm, "sha-256", "hmac-sha256", "ed25519"); err != nil {
+							return err
+						}
+					case "key":
+						if !d.NextArg() {
+							return d.ArgErr()
+						}
+						r.Verify.Key = d.Val()
+					case "allow_missing":
+						r.Verify.AllowMissing = true
+					default:
+						return d.Errf("unknown verify subdirective %s", d.Val())
+					}
+				}
+
+			case "debug_param":
+				if r.DebugParam == nil {
+					r.DebugParam = new(DebugParam)
+				}
+				if d.NextArg() {
+					r.DebugParam.Name = d.Val()
+					if d.NextArg() {
+						return d.ArgErr()
+					}
+				}
+				for nesting := d.Nesting(); d.NextBlock(nesting); {
+					switch d.Val() {
+					case "trailer":
+						if !d.NextArg() {
+							return d.ArgErr()
+						}
+						r.DebugParam.Trailer = d.Val()
+					case "from":
+						ranges := d.RemainingArgs()
+						if len(ranges) == 0 {
+							return d.ArgErr()
+						}
+						r.DebugParam.From = appendUnique(r.DebugParam.From, ranges...)
+					default:
+						return d.Errf("unknown debug_param subdirective %s", d.Val())
+					}
+				}
+
+			case "chaos":
+				if r.Chaos == nil {
+					r.Chaos = new(Chaos)
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				for nesting := d.Nesting(); d.NextBlock(nesting); {
+					switch d.Val() {
+					case "failure_rate", "latency_rate":
+						name := d.Val()
+						if !d.NextArg() {
+							return d.ArgErr()
+						}
+						rate, err := strconv.ParseFloat(d.Val(), 64)
+						if err != nil {
+							return d.Errf("invalid chaos %s: %v", name, err)
+						}
+						if name == "failure_rate" {
+							r.Chaos.FailureRate = rate
+						} else {
+							r.Chaos.LatencyRate = rate
+						}
+					case "latency":
+						if !d.NextArg() {
+							return d.ArgErr()
+						}
+						dur, err := caddy.ParseDuration(d.Val())
+						if err != nil {
+							return d.Errf("invalid chaos latency: %v", err)
+						}
+						r.Chaos.Latency = caddy.Duration(dur)
+					default:
+						return d.Errf("unknown chaos subdirective %s", d.Val())
+					}
+				}
+
+			case "recompress":
+				encodings := d.RemainingArgs()
+				if len(encodings) == 0 {
+					return d.ArgErr()
+				}
+				for _, enc := range encodings {
+					if enc != "gzip" && enc != "zstd" {
+						return d.Errf("unsupported recompress encoding %q", enc)
+					}
+				}
+				r.Recompress = appendUnique(r.Recompress, encodings...)
+
+			case "recompress_cache_size":
+				if err := sizeArg(d, &r.RecompressCacheSize); err != nil {
+					return err
+				}
+
+			case "range_index_size":
+				if err := sizeArg(d, &r.RangeIndexSize); err != nil {
+					return err
+				}
+
+			case "cache_size":
+				if err := sizeArg(d, &r.CacheSize); err != nil {
+					return err
+				}
+
+			case "filter":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				name := d.Val()
+				unm, err := caddyfile.UnmarshalModule(d, "http.handlers.response_ungzip.filters."+name)
+				if err != nil {
+					return err
+				}
+				r.FiltersRaw = append(r.FiltersRaw, caddyconfig.JSONModuleObject(unm, "filter", name, nil))
+
+			case "predicate":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				name := d.Val()
+				unm, err := caddyfile.UnmarshalModule(d, "http.handlers.response_ungzip.predicates."+name)
+				if err != nil {
+					return err
+				}
+				r.PredicatesRaw = append(r.PredicatesRaw, caddyconfig.JSONModuleObject(unm, "predicate", name, nil))
+
+			default:
+				return d.Errf("unknown subdirective %s", d.Val())
+			}
+		}
+	}
+	return nil
+}
+
+// Provision implements caddy.Provisioner.
+func (r *ResponseUngzip) Provision(ctx caddy.Context) error {
+	r.logger = ctx.Logger()
+	r.metrics = newUngzipMetrics(ctx.GetMetricsRegistry())
+	if err := r.applyEnvDefaults(); err != nil {
+		return err
+	}
+	if r.MaxSize == 0 {
+		r.MaxSize = 10 * 1024 * 1024 // 10MB default
+	}
+	if r.EnsureIdentity && r.UpstreamAcceptEncoding == "" {
+		r.UpstreamAcceptEncoding = "identity"
+	}
+	if len(r.Encodings) == 0 {
+		r.Encodings = []string{"gzip"}
+	}
+	if r.MaxEncodingLayers == 0 {
+		r.MaxEncodingLayers = 3
+	}
+	if err := r.loadZstdDictionaries(); err != nil {
+		return fmt.Errorf("loading zstd dictionaries: %v", err)
+	}
+	r.filtersRaw, r.predicatesRaw = r.FiltersRaw, r.PredicatesRaw
+	if len(r.FiltersRaw) > 0 {
+		mods, err := ctx.LoadModule(r, "FiltersRaw")
+		if err != nil {
+			return fmt.Errorf("loading filters: %v", err)
+		}
+		for _, mod := range mods.([]any) {
+			r.filters = append(r.filters, mod.(Filter))
+		}
+	}
+	if len(r.PredicatesRaw) > 0 {
+		mods, err := ctx.LoadModule(r, "PredicatesRaw")
+		if err != nil {
+			return fmt.Errorf("loading predicates: %v", err)
+		}
+		for _, mod := range mods.([]any) {
+			r.predicates = append(r.predicates, mod.(Predicate))
+		}
+	}
+	if r.AuditLog {
+		r.auditLogger = r.logger.Named("audit")
+	}
+	if r.QuarantineDir != "" {
+		if r.QuarantineMaxSize == 0 {
+			r.QuarantineMaxSize = 1024 * 1024 // 1MB default
+		}
+		if err := os.MkdirAll(r.QuarantineDir, 0o700); err != nil {
+			return fmt.Errorf("creating quarantine_dir: %v", err)
+		}
+	}
+	if r.Workers > 0 {
+		if r.WorkerQueue == 0 {
+			r.WorkerQueue = r.Workers
+		}
+	}
+	if r.MemoryLimit > 0 {
+		r.memory = newMemoryMonitor(r.MemoryLimit, r.logger, r.metrics)
+	}
+	if slices.Contains(r.Recompress, "zstd") {
+		enc, err := newZstdEncoder()
+		if err != nil {
+			return fmt.Errorf("creating zstd encoder: %v", err)
+		}
+		r.zstdEncoder = enc
+	}
+	if err := r.provisionShared(); err != nil {
+		return err
+	}
+	if r.FailureRateThreshold == 0 {
+		r.FailureRateThreshold = 0.5
+	}
+	if r.Shadow != nil {
+		if err := r.Shadow.provision(ctx, r.logger); err != nil {
+			return err
+		}
+	}
+	if r.Verify != nil {
+		if err := r.Verify.provision(); err != nil {
+			return err
+		}
+	}
+	if r.DebugParam != nil {
+		if err := r.DebugParam.provision(); err != nil {
+			return err
+		}
+	}
+	for _, lr := range r.LinkRewrites {
+		if err := lr.provision(); err != nil {
+			return err
+		}
+	}
+	if r.Chaos != nil {
+		r.Chaos.provision()
+		r.logger.Warn("chaos is enabled; decoding of responses will be delayed and fail on purpose",
+			zap.Float64("failure_rate", r.Chaos.FailureRate),
+			zap.Duration("latency", time.Duration(r.Chaos.Latency)))
+	}
+	r.healthStats = new(healthTracker)
+	if err := r.checkEncodeOrder(ctx); err != nil {
+		return err
+	}
+	r.shouldBuffer = r.newShouldBuffer(http.MethodGet, r.MaxSize, false)
+	if r.DecisionHistory > 0 {
+		r.decisions = newDecisionRing(r.DecisionHistory)
+	}
+	registerInstance(r)
+	registerConfig(r)
+	return nil
+}
+
+// Cleanup implements caddy.CleanerUpper.
+func (r *ResponseUngzip) Cleanup() error {
+	unregisterInstance(r)
+	unregisterConfig(r)
+	r.cleanupShared()
+	if r.memory != nil {
+		r.memory.stop()
+	}
+	if r.zstdEncoder != nil {
+		r.zstdEncoder.Close()
+	}
+	for _, zd := range r.ZstdDictionaries {
+		if zd.encoder != nil {
+			zd.encoder.Close()
+		}
+	}
+	return nil
+}
+
+// Validate implements caddy.Validator.
+func (r *ResponseUngzip) Validate() error {
+	if r.MaxSize < 0 {
+		return fmt.Errorf("max_size cannot be negative")
+	}
+	if r.MaxDecompressedSize < 0 {
+		return fmt.Errorf("max_decompressed_size cannot be negative")
+	}
+	if r.DecodeTimeout < 0 {
+		return fmt.Errorf("decode_timeout cannot be negative")
+	}
+	if r.QuarantineMaxSize < 0 {
+		return fmt.Errorf("quarantine_max_size cannot be negative")
+	}
+	switch r.OnError {
+	case "", "passthrough", "error":
+	default:
+		return fmt.Errorf("invalid on_error %q", r.OnError)
+	}
+	switch r.EncodeOrder {
+	case "", "warn", "error", "ignore":
+	default:
+		return fmt.Errorf("invalid encode_order %q", r.EncodeOrder)
+	}
+	if r.EnsureIdentity && r.UpstreamAcceptEncoding != "" && r.UpstreamAcceptEncoding != "identity" {
+		return fmt.Errorf("ensure_identity asks upstreams for identity; it cannot be combined with upstream_accept_encoding %q", r.UpstreamAcceptEncoding)
+	}
+	switch r.Bodiless {
+	case "", "adjust", "keep":
+	default:
+		return fmt.Errorf("invalid bodiless %q", r.Bodiless)
+	}
+	switch r.UnknownEncoding {
+	case "", "passthrough", "error", "strip":
+	default:
+		return fmt.Errorf("invalid unknown_encoding %q", r.UnknownEncoding)
+	}
+	switch r.Attachments {
+	case "", "skip", "only":
+	default:
+		return fmt.Errorf("invalid attachments %q", r.Attachments)
+	}
+	switch r.Validators {
+	case "", "weak", "strip", "keep":
+	default:
+		return fmt.Errorf("invalid validators %q", r.Validators)
+	}
+	if r.Workers < 0 || r.WorkerQueue < 0 {
+		return fmt.Errorf("workers and worker_queue cannot be negative")
+	}
+	switch r.OnOverload {
+	case "", "passthrough", "reject":
+	default:
+		return fmt.Errorf("invalid on_overload %q", r.OnOverload)
+	}
+	if r.MemoryLimit < 0 {
+		return fmt.Errorf("memory_limit cannot be negative")
+	}
+	switch r.MemoryDegrade {
+	case "", "passthrough", "stream":
+	default:
+		return fmt.Errorf("invalid memory_degrade %q", r.MemoryDegrade)
+	}
+	if r.MaxOutputRate < 0 {
+		return fmt.Errorf("max_output_rate cannot be negative")
+	}
+	if r.MaxInflightBytes < 0 {
+		return fmt.Errorf("max_inflight_bytes cannot be negative")
+	}
+	if r.PreviewSize < 0 {
+		return fmt.Errorf("preview_size cannot be negative")
+	}
+	if r.CaptureSize < 0 {
+		return fmt.Errorf("capture_size cannot be negative")
+	}
+	if r.CompareSampleRate < 0 || r.CompareSampleRate > 1 {
+		return fmt.Errorf("compare_sample_rate must be between 0 and 1")
+	}
+	if r.VerifyOnly && r.PreviewSize > 0 {
+		return fmt.Errorf("verify_only cannot be combined with preview_size")
+	}
+	if r.Stream && len(r.filters) > 0 {
+		return fmt.Errorf("filters cannot be used with stream")
+	}
+	if r.LogSampleRate < 0 || r.LogSampleRate > 1 {
+		return fmt.Errorf("log_sample_rate must be between 0 and 1")
+	}
+	if r.MaxRatio < 0 {
+		return fmt.Errorf("max_ratio cannot be negative")
+	}
+	if r.SuspiciousRatio < 0 {
+		return fmt.Errorf("suspicious_ratio cannot be negative")
+	}
+	if r.FailureRateThreshold < 0 || r.FailureRateThreshold > 1 {
+		return fmt.Errorf("failure_rate_threshold must be between 0 and 1")
+	}
+	if r.DecisionHistory < 0 {
+		return fmt.Errorf("decision_history cannot be negative")
+	}
+	if r.MaxEncodingLayers < 0 {
+		return fmt.Errorf("max_encoding_layers cannot be negative")
+	}
+	for _, enc := range r.Encodings {
+		if _, ok := decoders[enc]; !ok {
+			return fmt.Errorf("unsupported encoding %q; it may need to be compiled in", enc)
+		}
+	}
+	for _, zd := range r.ZstdDictionaries {
+		if zd.File == "" {
+			return fmt.Errorf("zstd dictionary file is required")
+		}
+	}
+	for _, enc := range r.Recompress {
+		if enc != "gzip" && enc != "zstd" {
+			return fmt.Errorf("unsupported recompress encoding %q", enc)
+		}
+	}
+	if r.Verify != nil {
+		if err := r.Verify.validate(); err != nil {
+			return err
+		}
+	}
+	if r.Chaos != nil {
+		if err := r.Chaos.validate(); err != nil {
+			return err
+		}
+	}
+	if r.Shadow != nil {
+		if err := r.Shadow.validate(); err != nil {
+			return err
+		}
+		if r.Stream {
+			return fmt.Errorf("shadow cannot be used with stream")
+		}
+	}
+	if r.Stream && len(r.Recompress) > 0 {
+		return fmt.Errorf("recompress cannot be used with stream")
+	}
+	if r.RecompressCacheSize < 0 {
+		return fmt.Errorf("recompress_cache_size cannot be negative")
+	}
+	if r.CacheSize < 0 {
+		return fmt.Errorf("cache_size cannot be negative")
+	}
+	if r.Stream && r.CacheSize > 0 {
+		return fmt.Errorf("cache_size cannot be used with stream")
+	}
+	if r.ReadBufferSize < 0 || r.CopyBufferSize < 0 {
+		return fmt.Errorf("read_buffer_size and copy_buffer_size cannot be negative")
+	}
+	if r.BGZFWorkers < 0 {
+		return fmt.Errorf("bgzf_workers cannot be negative")
+	}
+	if r.RangeIndexSize < 0 {
+		return fmt.Errorf("range_index_size cannot be negative")
+	}
+	if r.RangeIndexSize > 0 && (r.Stream || len(r.filters) > 0 || len(r.Recompress) > 0) {
+		return fmt.Errorf("range_index_size cannot be used with stream, filters or recompress")
+	}
+	switch {
+	case r.CostLabel == "", r.CostLabel == "path_prefix", r.CostLabel == "host", r.CostLabel == "upstream":
+	case strings.HasPrefix(r.CostLabel, "header:") && len(r.CostLabel) > len("header:"):
+	default:
+		return fmt.Errorf("invalid cost_label %q", r.CostLabel)
+	}
+	return r.validateCombinations()
+}
+
+// validateCombinations rejects settings that are valid on their own but
+// contradict or have no effect given the others, which would otherwise
+// only show at runtime, if at all.
+func (r *ResponseUngzip) validateCombinations() error {
+	if len(r.Encodings) == 0 {
+		return fmt.Errorf("encodings cannot be empty; leave it out to decode gzip")
+	}
+	for i, enc := range r.Encodings {
+		if slices.Contains(r.Encodings[:i], enc) {
+			return fmt.Errorf("encoding %q is listed more than once", enc)
+		}
+	}
+	for _, path := range r.Paths {
+		if !strings.HasPrefix(path, "/") {
+			return fmt.Errorf("path %q never matches; paths are prefixes starting with /", path)
+		}
+	}
+	for _, path := range r.ForcePaths {
+		if !strings.HasPrefix(path, "/") {
+			return fmt.Errorf("force_path %q never matches; paths are prefixes starting with /", path)
+		}
+	}
+	for _, protocol := range r.Protocols {
+		if !slices.Contains(protocolNames, protocol) {
+			return fmt.Errorf("invalid protocol %q", protocol)
+		}
+	}
+	if r.RegionFrom == "" && (len(r.Regions) > 0 || len(r.IdentityRegions) > 0) {
+		return fmt.Errorf("regions and identity_regions require region_from")
+	}
+	if len(r.IdentityRegions) > 0 && len(r.Recompress) == 0 {
+		return fmt.Errorf("identity_regions has no effect without recompress")
+	}
+	if r.RegionFrom != "" && !strings.Contains(r.RegionFrom, "{") {
+		return fmt.Errorf("region_from %q is not a placeholder", r.RegionFrom)
+	}
+	if r.RolloutPercent < 0 || r.RolloutPercent > 100 {
+		return fmt.Errorf("rollout_percent must be between 0 and 100")
+	}
+	if r.RolloutKey != "" && !strings.Contains(r.RolloutKey, "{") {
+		return fmt.Errorf("rollout_key %q is not a placeholder", r.RolloutKey)
+	}
+	for _, from := range []string{r.MaxSizeFrom, r.SuspiciousRatioFrom} {
+		if from != "" && !strings.Contains(from, "{") {
+			return fmt.Errorf("%q is not a placeholder; set max_size or suspicious_ratio directly", from)
+		}
+	}
+	if r.QuarantineMaxSize > 0 && r.QuarantineDir == "" {
+		return fmt.Errorf("quarantine_max_size requires quarantine_dir")
+	}
+	if r.Workers == 0 && (r.WorkerQueue > 0 || r.WorkerTimeout > 0) {
+		return fmt.Errorf("worker_queue and worker_timeout require workers")
+	}
+	if r.OnOverload != "" && r.Workers == 0 && r.MaxInflightBytes == 0 {
+		return fmt.Errorf("on_overload requires workers or max_inflight_bytes")
+	}
+	if r.MemoryDegrade != "" && r.MemoryLimit == 0 {
+		return fmt.Errorf("memory_degrade requires memory_limit")
+	}
+	if r.MemoryDegrade == "stream" && (len(r.filters) > 0 || len(r.Recompress) > 0) {
+		return fmt.Errorf("memory_degrade stream cannot stream responses that go through filters or recompress; use passthrough")
+	}
+	if r.CacheSize > 0 && len(r.filters) > 0 {
+		return fmt.Errorf("cache_size cannot be used with filters, which responses served from the cache would skip")
+	}
+	if r.RecompressCacheSize > 0 && len(r.Recompress) == 0 {
+		return fmt.Errorf("recompress_cache_size requires recompress")
+	}
+	if len(r.ZstdDictionaries) > 0 && !slices.Contains(r.Encodings, "zstd") && !slices.Contains(r.Recompress, "zstd") {
+		return fmt.Errorf("zstd_dictionaries require zstd in encodings or recompress")
+	}
+	if r.PreviewSize > 0 && (len(r.filters) > 0 || len(r.Recompress) > 0 || r.Stream || r.CacheSize > 0) {
+		return fmt.Errorf("preview_size serves responses compressed, so filters, recompress, stream and cache_size have no effect with it")
+	}
+	return nil
+}
+
+// controlHeader is the response header upstreams can set to "skip" to
+// have a response passed on as it is, or to "force" to have it
+// decompressed regardless of content_types, content disposition and
+// the archive guard. Limits such as max_size still apply. The header is
+// removed either way.
+const controlHeader = "X-Caddy-Ungzip"
+
+// inflightBytes is the number of bytes currently held in response
+// buffers across all handler instances.
+var inflightBytes atomic.Int64
+
+var errInflightFull = errors.New("too many bytes buffered for decompression")
+
+func (r ResponseUngzip) ServeHTTP(w http.ResponseWriter, req *http.Request, next caddyhttp.Handler) error {
+	// Check if path matches configured paths
+	var pathPrefix string
+	var forced bool
+	for _, path := range r.ForcePaths {
+		if strings.HasPrefix(req.URL.Path, path) {
+			forced = true
+			pathPrefix = path
+			break
+		}
+	}
+	if len(r.Paths) > 0 && !forced {
+		matched := false
+		for _, path := range r.Paths {
+			if strings.HasPrefix(req.URL.Path, path) {
+				matched = true
+				pathPrefix = path
+				break
+			}
+		}
+		if !matched {
+			return next.ServeHTTP(w, req)
+		}
+	}
+	if r.DebugParam != nil && debugOf(req) == nil && r.DebugParam.requested(req) {
+		return r.serveDebug(w, req, next)
+	}
+	if !decodable(req) {
+		return next.ServeHTTP(w, req)
+	}
+	if len(r.Protocols) > 0 && !forced && !slices.Contains(r.Protocols, protocolName(req)) {
+		return next.ServeHTTP(w, req)
+	}
+	if len(r.Regions) > 0 && !forced && !r.inRegion(req, r.Regions) {
+		return next.ServeHTTP(w, req)
+	}
+	if r.RolloutPercent > 0 && !forced && !r.inRollout(req) {
+		r.logDecision(req, "skipped", "rollout")
+		return next.ServeHTTP(w, req)
+	}
+	// resolved before the recorder exists, so that requests whose
+	// response could never be decoded don't pay for buffering it
+	maxSize := r.maxSize(req)
+	if maxSize == 0 {
+		r.logDecision(req, "skipped", "max_size")
+		return next.ServeHTTP(w, req)
+	}
+
+	stream := r.Stream
+	if r.memory != nil && r.memory.degraded.Load() {
+		if r.MemoryDegrade != "stream" {
+			r.logDecision(req, "skipped", "memory_pressure")
+			return next.ServeHTTP(w, req)
+		}
+		stream = true
+	}
+
+	if r.MaxInflightBytes > 0 && inflightBytes.Load() >= r.MaxInflightBytes {
+		if r.OnOverload == "reject" {
+			r.logDecision(req, "rejected", "inflight_bytes")
+			return r.reject(w, errInflightFull)
+		}
+		r.logDecision(req, "skipped", "inflight_bytes")
+		return next.ServeHTTP(w, req)
+	}
+
+	if served, err := r.serveIndexedRange(w, req, next, forced); served {
+		return err
+	}
+
+	respBuf := bufPool.get()
+	defer bufPool.put(respBuf)
+
+	// the decision built at provision time covers the common case; other
+	// methods and request-specific max sizes need one of their own
+	shouldBuffer := r.shouldBuffer
+	if shouldBuffer == nil || maxSize != r.MaxSize || forced || req.Method == http.MethodHead || req.Method == http.MethodOptions {
+		shouldBuffer = r.newShouldBuffer(req.Method, maxSize, forced)
+	}
+	rec := caddyhttp.NewResponseRecorder(w, respBuf, shouldBuffer)
+
+	upstream := &upstreamWriter{ResponseRecorder: rec, w: w}
+	if r.PreviewSize == 0 && !r.FixContentLength {
+		// previews and fixed lengths need the whole body
+		upstream.limit = maxSize
+	}
+	if err := next.ServeHTTP(upstream, r.upstreamRequest(req)); err != nil {
+		return err
+	}
+	if r.EnsureIdentity {
+		r.observeIdentity(req, rec.Status(), rec.Header())
+	}
+	r.noteRanges(req, rec.Status(), rec.Header(), maxSize, upstream.spilled)
+	if upstream.spilled {
+		r.logDecision(req, "passthrough", "max_size")
+		return nil
+	}
+
+	// Interim responses such as 103 Early Hints are never buffered; the
+	// recorder writes them straight through to the client as they come.
+	// If no final response followed (e.g. after 101 Switching Protocols),
+	// there is nothing left for us to send.
+	if status := rec.Status(); status >= 100 && status <= 199 {
+		return nil
+	}
+	if !rec.Buffered() {
+		// the control header is gone by now, which only ever leaves
+		// upstream_skip itself undetected
+		reason := r.declineReason(req.Method, rec.Status(), rec.Header(), maxSize, forced)
+		if reason == "" {
+			reason = "upstream_skip"
+		}
+		r.logDecision(req, "passthrough", reason)
+		return nil
+	}
+
+	// the upstream's say on this response, for this handler only
+	control := rec.Header().Get(controlHeader)
+	if control != "" {
+		rec.Header().Del(controlHeader)
+	}
+	if strings.EqualFold(control, "skip") {
+		return r.passthrough(req, rec, "upstream_skip")
+	}
+	force := forced || strings.EqualFold(control, "force")
+
+	held := int64(rec.Buffer().Len())
+	inflightBytes.Add(held)
+	defer inflightBytes.Add(-held)
+
+	// a range of an encoded body cannot be decoded on its own
+	if rec.Status() == http.StatusPartialContent {
+		return r.passthrough(req, rec, "partial_content")
+	}
+
+	if r.UnknownEncoding == "error" {
+		if coding := unknownCoding(rec.Header()); coding != "" {
+			r.logDecision(req, "rejected", "unknown_encoding")
+			return classifiedError(req, 0, fmt.Errorf("%w: %s", errUnknownEncoding, coding))
+		}
+	}
+
+	codings, err := r.codingsOf(rec.Header(), rec.Buffer().Bytes())
+	if err != nil {
+		return r.fail(req, rec, err)
+	}
+	if codings == nil {
+		return r.passthrough(req, rec, "not_encoded")
+	}
+
+	if isBodiless(req, rec) {
+		return r.serveBodiless(req, rec)
+	}
+
+	if declared := rec.Header().Get("Content-Length"); declared != "" {
+		if n, err := strconv.Atoi(declared); err != nil || n != rec.Buffer().Len() {
+			actual := strconv.Itoa(rec.Buffer().Len())
+			r.metrics.observeLengthMismatch(r.metricsLabel(req))
+			r.logger.Warn("upstream Content-Length does not match encoded body",
+				zap.String("uri", req.RequestURI),
+				zap.String("declared", declared),
+				zap.String("actual", actual),
+				zap.Bool("fixed", r.FixContentLength))
+			if r.FixContentLength {
+				rec.Header().Set("Content-Length", actual)
+			}
+		}
+	}
+
+	if reason := r.headerDecline(req, rec.Header(), force); reason != "" {
+		return r.passthrough(req, rec, reason)
+	}
+
+	if r.Verify != nil {
+		if err := r.Verify.check(rec.Header(), rec.Buffer().Bytes()); err != nil {
+			r.decisions.add(req, "rejected", err.Error())
+			r.noteDebug(req, "rejected", err.Error())
+			r.logger.Warn("rejecting response",
+				zap.String("uri", req.RequestURI),
+				zap.Error(err))
+			return classifiedError(req, http.StatusBadGateway, err)
+		}
+	}
+
+	if r.PreviewSize > 0 {
+		caddyhttp.SetVar(req.Context(), "ungzip_preview", r.preview(codings, rec.Buffer().Bytes(), r.PreviewSize))
+		return r.passthrough(req, rec, "preview")
+	}
+
+	if int64(rec.Buffer().Len()) > maxSize {
+		return r.passthrough(req, rec, "max_size")
+	}
+
+	if ok, err := r.allowed(req, rec.Header()); err != nil {
+		return r.fail(req, rec, err)
+	} else if !ok {
+		return r.passthrough(req, rec, "predicate")
+	}
+
+	if err := r.inspect(req, rec.Header(), codings, rec.Buffer().Bytes()); errors.Is(err, ErrSkip) {
+		return r.passthrough(req, rec, "inspector")
+	} else if err != nil {
+		return r.fail(req, rec, err)
+	}
+
+	if r.Chaos != nil {
+		if err := r.Chaos.inject(req.Context()); err != nil {
+			return r.fail(req, rec, err)
+		}
+	}
+
+	if r.VerifyOnly {
+		return r.serveVerifyOnly(req, rec, codings)
+	}
+
+	if stream && len(r.filters) == 0 && len(r.Recompress) == 0 {
+		return r.serveStream(w, req, rec, codings, r.costLabel(req, pathPrefix))
+	}
+
+	return r.serveDecoded(w, req, rec, codings, pathPrefix)
+}
+
+// newShouldBuffer returns the recorder's buffering decision for
+// responses to requests with the given method and max size, to paths
+// forced or not, which buffers only responses that declineReason does
+// not pass on. The control header of a declined response is removed
+// before it goes out. It is built apart from ServeHTTP, since the
+// closure moves its copy of the handler to the heap.
+func (r ResponseUngzip) newShouldBuffer(method string, maxSize int64, forced bool) caddyhttp.ShouldBufferFunc {
+	return func(status int, headers http.Header) bool {
+		if status >= 100 && status <= 199 {
+			return true
+		}
+		if r.UnknownEncoding == "strip" {
+			stripUnknownCodings(headers)
+		}
+		if r.declineReason(method, status, headers, maxSize, forced) == "" {
+			return true
+		}
+		headers.Del(controlHeader)
+		return false
+	}
+}
+
+// serveDecoded decodes the buffered response in rec, compressed with
+// codings, and writes it to w. It is kept out of ServeHTTP because the
+// decode closure moves the handler copy to the heap, which only
+// responses that are actually decoded should pay for.
+func (r ResponseUngzip) serveDecoded(w http.ResponseWriter, req *http.Request, rec caddyhttp.ResponseRecorder, codings []string, pathPrefix string) error {
+	outBuf := bufPool.get()
+	defer bufPool.put(outBuf)
+
+	var err error
+	start := time.Now()
+	key := r.cacheKey(req, rec.Header())
+	cached, hit := []byte(nil), false
+	if key != "" {
+		cached, hit = r.cache.get(key)
+	}
+	process := func() error {
+		if hit {
+			outBuf.Write(cached)
+			return nil
+		}
+		if err := r.transform(outBuf, codings, rec.Buffer().Bytes()); err != nil {
+			return err
+		}
+		return r.filter(req, rec.Header(), outBuf)
+	}
+	if r.pool != nil {
+		err = r.pool.do(req.Context(), time.Duration(r.WorkerTimeout), process)
+		if errors.Is(err, errPoolFull) || errors.Is(err, errPoolCanceled) {
+			if r.OnOverload == "reject" {
+				r.logDecision(req, "rejected", "overload")
+				return r.reject(w, err)
+			}
+			return r.passthrough(req, rec, "overload")
+		}
+	} else {
+		err = process()
+	}
+	if errors.Is(err, ErrSkip) {
+		return r.passthrough(req, rec, "filter")
+	}
+	var blocked *BlockError
+	if errors.As(err, &blocked) {
+		r.logDecision(req, "blocked", blocked.Reason)
+		return r.block(w, blocked)
+	}
+	if err != nil {
+		return r.fail(req, rec, err)
+	}
+	inflightBytes.Add(int64(outBuf.Len()))
+	defer inflightBytes.Add(-int64(outBuf.Len()))
+	r.indexMembers(req, rec.Status(), rec.Header(), codings, rec.Buffer().Bytes())
+	if !hit && key != "" {
+		r.cache.put(key, bytes.Clone(outBuf.Bytes()))
+	}
+	elapsed := time.Since(start)
+	r.observeSize(req, rec.Buffer().Len(), outBuf.Len())
+	r.metrics.observeCost(r.metricsLabel(req), r.costLabel(req, pathPrefix), outBuf.Len(), elapsed)
+	if r.auditLogger != nil {
+		sum := sha256.Sum256(outBuf.Bytes())
+		r.audit(req, rec.Buffer().Len(), outBuf.Len(), sum[:], elapsed)
+	}
+	if r.CaptureSize > 0 {
+		r.capture(req, outBuf.Bytes())
+	}
+
+	rec.Header().Del("Content-Encoding")
+	r.transformedHeaders(req, rec.Header())
+	body := outBuf.Bytes()
+	if len(r.Recompress) > 0 {
+		body = r.recompress(req, rec.Header(), body)
+	}
+	if r.DigestHeader != "" {
+		sum := sha256.Sum256(body)
+		rec.Header().Set(r.DigestHeader, r.digestValue(sum[:]))
+	}
+	if r.servesRange(req, rec.Status(), rec.Header()) {
+		r.healthStats.record(true)
+		r.logDecision(req, "decompressed", "range")
+		serveRange(w, req, body)
+		r.shadow(req, rec, outBuf.Bytes())
+		return nil
+	}
+	if hasTrailers(rec.Header()) {
+		// HTTP/1.1 can only carry trailers on a chunked body
+		rec.Header().Del("Content-Length")
+	} else {
+		rec.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	}
+
+	status := rec.Status()
+	if status == 0 {
+		status = http.StatusOK
+	}
+	w.WriteHeader(status)
+	if _, err = r.output(w, req).Write(body); err != nil {
+		return err
+	}
+	r.healthStats.record(true)
+	r.logDecision(req, "decompressed", "")
+	err = flush(w)
+	r.shadow(req, rec, outBuf.Bytes())
+	if r.CompareSampleRate > 0 {
+		// once the client has the response, which must not wait for it
+		r.compare(req, rec.Header(), outBuf.Bytes(), body)
+	}
+	return err
+}
+
+// shadow sends a copy of the decompressed body of the response
+// recorded by rec, once it has been served, if shadow is set.
+func (r ResponseUngzip) shadow(req *http.Request, rec caddyhttp.ResponseRecorder, body []byte) {
+	if r.Shadow != nil {
+		r.Shadow.send(req, rec.Status(), rec.Header(), body)
+	}
+}
+
+// output returns the writer decompressed bodies should be written to.
+func (r ResponseUngzip) output(w io.Writer, req *http.Request) io.Writer {
+	if r.MaxOutputRate > 0 {
+		return newThrottledWriter(req.Context(), w, r.MaxOutputRate)
+	}
+	return w
+}
+
+// transform decompresses src, compressed with codings, into dst.
+func (r ResponseUngzip) transform(dst io.Writer, codings []string, src []byte) (err error) {
+	defer r.recoverPanic(&err)
+	return r.decompress(dst, codings, src)
+}
+
+// recoverPanic turns a panic raised by the decode or filter pipeline
+// into an error stored in err, so that a single poisoned response is
+// handled by the error policy instead of unwinding the server goroutine.
+// It must be deferred.
+func (r ResponseUngzip) recoverPanic(err *error) {
+	if rv := recover(); rv != nil {
+		*err = fmt.Errorf("panic during decompression: %v", rv)
+		r.metrics.observePanic()
+		r.logger.Error("recovered from panic", zap.Any("panic", rv), zap.Stack("stack"))
+	}
+}
+
+// reject fails the request with 503 because the handler is overloaded.
+func (r ResponseUngzip) reject(w http.ResponseWriter, err error) error {
+	w.Header().Set("Retry-After", "1")
+	return caddyhttp.Error(http.StatusServiceUnavailable, err)
+}
+
+// fail quarantines the response held by rec if configured, then
+// applies the on_error policy to it.
+func (r ResponseUngzip) fail(req *http.Request, rec caddyhttp.ResponseRecorder, err error) error {
+	r.healthStats.record(false)
+	r.decisions.add(req, "failed", err.Error())
+	r.noteDebug(req, "failed", err.Error())
+	r.observeUpstream(req, "failed")
+	r.logger.Error("decompressing response",
+		zap.String("uri", req.RequestURI),
+		zap.String("upstream", upstreamHostport(req)),
+		zap.String("on_error", r.OnError),
+		zap.Error(err))
+	if r.QuarantineDir != "" {
+		r.quarantine(req, rec, err)
+	}
+	if r.OnError == "error" {
+		return classifiedError(req, 0, err)
+	}
+	return rec.WriteResponse()
+}
+
+// decompress decodes src, compressed with codings, into dst.
+func (r ResponseUngzip) decompress(dst io.Writer, codings []string, src []byte) error {
+	if r.BGZFWorkers > 1 && slices.Equal(codings, []string{"gzip"}) {
+		if blocks, ok := bgzfBlocks(src); ok {
+			return decodeBGZF(dst, blocks, r.BGZFWorkers, r.decodeLimits())
+		}
+	}
+	reader, err := r.newReader(codings, bytes.NewReader(src))
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	_, err = copyChunked(dst, reader, r.CopyBufferSize)
+	return err
+}
+
+// preview returns up to n bytes from the start of src, compressed with
+// codings. Whatever could be decoded before an error is still returned.
+func (r ResponseUngzip) preview(codings []string, src []byte, n int64) string {
+	reader, err := r.newReader(codings, bytes.NewReader(src))
+	if err != nil {
+		return ""
+	}
+	defer reader.Close()
+
+	var buf bytes.Buffer
+	_, _ = io.Copy(&buf, io.LimitReader(reader, n))
+	return buf.String()
+}
+
+// capture sets the ungzip_body variable of req to the first
+// capture_size bytes of the decompressed body.
+func (r ResponseUngzip) capture(req *http.Request, body []byte) {
+	if int64(len(body)) > r.CaptureSize {
+		body = body[:r.CaptureSize]
+	}
+	caddyhttp.SetVar(req.Context(), "ungzip_body", string(body))
+}
+
+// observeSize records the expansion ratio of the response to req,
+// warning if it is suspicious.
+func (r ResponseUngzip) observeSize(req *http.Request, compressed, decompressed int) {
+	if r.DebugParam != nil {
+		if info := debugOf(req); info != nil {
+			info.Compressed, info.Decompressed = compressed, decompressed
+		}
+	}
+	if r.metrics.observeRatio(r.metricsLabel(req), compressed, decompressed, r.suspiciousRatio(req)) {
+		r.logger.Warn("suspicious expansion ratio",
+			zap.String("uri", req.RequestURI),
+			zap.Int("compressed", compressed),
+			zap.Int("decompressed", decompressed))
+	}
+}
+
+// headerDecline returns the reason not to decode the response to req
+// with header that its headers give, or "" if they give none. force
+// overrides them.
+func (r ResponseUngzip) headerDecline(req *http.Request, header http.Header, force bool) string {
+	if force {
+		return ""
+	}
+	if !r.matchesContentType(header.Get("Content-Type")) {
+		return "content_type"
+	}
+	if !r.DecodeArchives && isArchive(req, header) {
+		return "archive"
+	}
+	if attachment := isAttachment(header); attachment && r.Attachments == "skip" || !attachment && r.Attachments == "only" {
+		return "content_disposition"
+	}
+	return ""
+}
+
+// decodable reports whether the response to req can carry a body for
+// this handler to decode. Tunnels and protocol upgrades hand the
+// connection over rather than sending a response body.
+func decodable(req *http.Request) bool {
+	if req.Method == http.MethodConnect {
+		return false
+	}
+	return req.Header.Get("Upgrade") == ""
+}
+
+// monitoringPaths are the force_path prefixes used when none are
+// given: the usual health check, probe and metrics endpoints.
+var monitoringPaths = []string{"/health", "/healthz", "/livez", "/readyz", "/ping", "/status", "/metrics"}
+
+// protocolNames are the values of the protocols option.
+var protocolNames = []string{"http/1.0", "http/1.1", "h2", "h3"}
+
+// protocolName returns the name req's protocol has in protocols.
+func protocolName(req *http.Request) string {
+	switch {
+	case req.ProtoMajor == 3:
+		return "h3"
+	case req.ProtoMajor == 2:
+		return "h2"
+	case req.ProtoMinor == 0:
+		return "http/1.0"
+	}
+	return "http/1.1"
+}
+
+// inRegion reports whether the client of req is in one of regions.
+func (r ResponseUngzip) inRegion(req *http.Request, regions []string) bool {
+	repl := req.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+	region := repl.ReplaceAll(r.RegionFrom, "")
+	return slices.ContainsFunc(regions, func(candidate string) bool {
+		return strings.EqualFold(candidate, region)
+	})
+}
+
+// maxSize returns the max_size that applies to req.
+func (r ResponseUngzip) maxSize(req *http.Request) int64 {
+	if r.MaxSizeFrom != "" {
+		repl := req.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+		if size, err := parseSize(repl.ReplaceAll(r.MaxSizeFrom, "")); err == nil {
+			return size
+		}
+	}
+	return r.MaxSize
+}
+
+// suspiciousRatio returns the suspicious_ratio that applies to req.
+func (r ResponseUngzip) suspiciousRatio(req *http.Request) float64 {
+	if r.SuspiciousRatioFrom != "" {
+		repl := req.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+		if ratio, err := strconv.ParseFloat(repl.ReplaceAll(r.SuspiciousRatioFrom, ""), 64); err == nil && ratio >= 0 {
+			return ratio
+		}
+	}
+	return r.SuspiciousRatio
+}
+
+// metricsLabel returns the value of the route label for req.
+func (r ResponseUngzip) metricsLabel(req *http.Request) string {
+	if r.MetricsLabel == "" {
+		return ""
+	}
+	repl := req.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+	return repl.ReplaceAll(r.MetricsLabel, "")
+}
+
+// costLabel returns the value of the configured cost label for req.
+func (r ResponseUngzip) costLabel(req *http.Request, pathPrefix string) string {
+	switch {
+	case r.CostLabel == "path_prefix":
+		return pathPrefix
+	case r.CostLabel == "host":
+		if host, _, err := net.SplitHostPort(req.Host); err == nil {
+			return host
+		}
+		return req.Host
+	case r.CostLabel == "upstream":
+		return upstreamHostport(req)
+	case strings.HasPrefix(r.CostLabel, "header:"):
+		return req.Header.Get(strings.TrimPrefix(r.CostLabel, "header:"))
+	}
+	return ""
+}
+
+// bodyAllowed reports whether a response with the given status to req
+// carries a body, and so whether its Content-Length describes one.
+func bodyAllowed(req *http.Request, status int) bool {
+	if req.Method == http.MethodHead {
+		return false
+	}
+	return status != http.StatusNoContent && status != http.StatusNotModified
+}
+
+// isBodiless reports whether the response recorded by rec has no body
+// to decompress, because of the method or status.
+func isBodiless(req *http.Request, rec caddyhttp.ResponseRecorder) bool {
+	if !bodyAllowed(req, rec.Status()) {
+		return true
+	}
+	return req.Method == http.MethodOptions && rec.Buffer().Len() == 0
+}
+
+// serveBodiless sends an encoded response without a body, with its
+// headers adjusted as they would be on the decompressed response unless
+// configured otherwise.
+func (r ResponseUngzip) serveBodiless(req *http.Request, rec caddyhttp.ResponseRecorder) error {
+	if r.Bodiless == "keep" {
+		return r.passthrough(req, rec, "no_body")
+	}
+	rec.Header().Del("Content-Encoding")
+	// the decompressed length is not known without the body
+	rec.Header().Del("Content-Length")
+	r.transformedHeaders(req, rec.Header())
+	if len(r.Recompress) > 0 && !hasVaryValue(rec.Header(), "Accept-Encoding") {
+		rec.Header().Add("Vary", "Accept-Encoding")
+	}
+	r.logDecision(req, "decompressed", "no_body")
+	return rec.WriteResponse()
+}
+
+// hasTrailers reports whether the response declares trailers, either
+// up front in the Trailer header or with the http.TrailerPrefix
+// convention for trailers that are not known in advance.
+func hasTrailers(header http.Header) bool {
+	if len(header.Values("Trailer")) > 0 {
+		return true
+	}
+	for key := range header {
+		if strings.HasPrefix(key, http.TrailerPrefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// flush pushes any data buffered by the underlying connection (such
+// as an HTTP/2 or HTTP/3 stream) out to the client.
+func flush(w http.ResponseWriter) error {
+	err := http.NewResponseController(w).Flush()
+	if errors.Is(err, http.ErrNotSupported) {
+		return nil
+	}
+	return err
+}
+
+// enumArg reads the argument of the current subdirective into dst,
+// which must be one of values.
+func enumArg(d *caddyfile.Dispenser, dst *string, values ...string) error {
+	name := d.Val()
+	if !d.NextArg() {
+		return d.ArgErr()
+	}
+	if !slices.Contains(values, d.Val()) {
+		return d.Errf("invalid %s %q; must be one of %s", name, d.Val(), strings.Join(values, ", "))
+	}
+	*dst = d.Val()
+	return nil
+}
+
+// sizeArg reads the argument of the current subdirective into dst, as
+// a size in bytes.
+func sizeArg(d *caddyfile.Dispenser, dst *int64) error {
+	name := d.Val()
+	if !d.NextArg() {
+		return d.ArgErr()
+	}
+	size, err := parseSize(d.Val())
+	if err != nil {
+		return d.Errf("invalid %s: %v", name, err)
+	}
+	*dst = size
+	return nil
+}
+
+// parseSize parses a size in bytes, given as a number of bytes or with
+// a unit, such as 20MB or 1MiB.
+func parseSize(s string) (int64, error) {
+	size, err := humanize.ParseBytes(s)
+	if err != nil {
+		return 0, err
+	}
+	if size > math.MaxInt64 {
+		return 0, fmt.Errorf("%s is too large", s)
+	}
+	return int64(size), nil
+}
+
+// appendUnique appends the items that are not in list yet to it.
+func appendUnique(list []string, items ...string) []string {
+	for _, item := range items {
+		if !slices.Contains(list, item) {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+func parseCaddyfile(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error) {
+	handler := new(ResponseUngzip)
+	if !noInherit(h.Dispenser) {
+		if err := applyGlobalDefaults(h, handler); err != nil {
+			return nil, err
+		}
+	}
+	h.Dispenser.Reset()
+	handler.helper = &h
 	err := handler.UnmarshalCaddyfile(h.Dispenser)
+	handler.helper = nil
 	return handler, err
 }
 
@@ -193,6 +2336,7 @@ var (
 	_ caddy.Module                = (*ResponseUngzip)(nil)
 	_ caddy.Provisioner           = (*ResponseUngzip)(nil)
 	_ caddy.Validator             = (*ResponseUngzip)(nil)
+	_ caddy.CleanerUpper          = (*ResponseUngzip)(nil)
 	_ caddyhttp.MiddlewareHandler = (*ResponseUngzip)(nil)
 	_ caddyfile.Unmarshaler       = (*ResponseUngzip)(nil)
 )
@@ -0,0 +1,187 @@
+package ungzip
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func TestValidateFilterCombinations(t *testing.T) {
+	for name, h := range map[string]ResponseUngzip{
+		"stream":         {Stream: true},
+		"range_index":    {RangeIndexSize: 1 << 20},
+		"memory_degrade": {MemoryLimit: 1 << 30, MemoryDegrade: "stream"},
+		"preview_size":   {PreviewSize: 1024},
+		"cache_size":     {CacheSize: 1 << 20},
+	} {
+		t.Run(name, func(t *testing.T) {
+			ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+			defer cancel()
+			if err := h.Provision(ctx); err != nil {
+				t.Fatal(err)
+			}
+			defer h.Cleanup()
+			// as loading the filters config would
+			h.filters = []Filter{new(JSONFormat)}
+			if err := h.Validate(); err == nil || !strings.Contains(err.Error(), "filters") {
+				t.Errorf("filters with %s: got %v", name, err)
+			}
+		})
+	}
+}
+
+// benchRequest returns a request carrying the replacer and vars a
+// Caddy server would give it.
+func benchRequest() *http.Request {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	return caddyhttp.PrepareRequest(req, caddyhttp.NewTestReplacer(req), nil, nil)
+}
+
+// discardWriter is a response writer that keeps nothing, so the
+// allocations measured are the handler's own.
+type discardWriter http.Header
+
+func (w discardWriter) Header() http.Header         { return http.Header(w) }
+func (w discardWriter) Write(p []byte) (int, error) { return len(p), nil }
+func (w discardWriter) WriteHeader(int)             {}
+
+func benchHandler(tb testing.TB) ResponseUngzip {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	tb.Cleanup(cancel)
+	var h ResponseUngzip
+	if err := h.Provision(ctx); err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { _ = h.Cleanup() })
+	return h
+}
+
+func BenchmarkPassthrough(b *testing.B) {
+	h := benchHandler(b)
+	upstream := fixture{body: []byte(strings.Repeat("passthrough ", 100))}
+	req, w := benchRequest(), discardWriter{}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if err := h.ServeHTTP(w, req, upstream); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDecode(b *testing.B) {
+	h := benchHandler(b)
+	text := []byte(strings.Repeat("decode ", 1000))
+	upstream := fixture{header: map[string]string{"Content-Encoding": "gzip"}, body: gzipped(b, text)}
+	req, w := benchRequest(), discardWriter{}
+	b.SetBytes(int64(len(text)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if err := h.ServeHTTP(w, req, upstream); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// staticUpstream answers with a body that is not encoded, without
+// allocating, so that the allocations measured are the handler's own.
+var staticUpstream = caddyhttp.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) error {
+	w.WriteHeader(http.StatusOK)
+	_, err := w.Write(staticBody)
+	return err
+})
+
+var staticBody = []byte(strings.Repeat("passthrough ", 100))
+
+// raceEnabled is set by builds with the race detector, which allocates
+// on its own account.
+var raceEnabled bool
+
+// TestPassthroughAllocs keeps responses the handler leaves alone cheap:
+// most of them are never decoded. Requests that fail the request
+// matchers go straight to the upstream and cost nothing. Whether a
+// response fails the response matchers is only known once the upstream
+// has sent its headers, so those cost the recorder that learns it:
+// Caddy's recorder and the writer it wraps, which cannot be pooled from
+// outside, and the upstreamWriter around them.
+func TestPassthroughAllocs(t *testing.T) {
+	if raceEnabled {
+		t.Skip("allocations are not representative with the race detector")
+	}
+	for _, tc := range []struct {
+		name  string
+		paths []string
+		max   float64
+	}{
+		{name: "request not matched", paths: []string{"/elsewhere"}, max: 0},
+		{name: "response not matched", max: 3},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			h := benchHandler(t)
+			h.Paths = tc.paths
+			// decisions are logged at debug level, which is left off
+			// outside of debugging
+			h.logger = zap.NewNop()
+			req, w := benchRequest(), discardWriter{}
+			allocs := testing.AllocsPerRun(100, func() {
+				if err := h.ServeHTTP(w, req, staticUpstream); err != nil {
+					t.Fatal(err)
+				}
+			})
+			if allocs > tc.max {
+				t.Errorf("made %.0f allocations, want at most %.0f", allocs, tc.max)
+			}
+		})
+	}
+}
+
+func TestCaddyfileSizes(t *testing.T) {
+	for input, want := range map[string]int64{
+		`ungzip 20MB`:                           20_000_000,
+		`ungzip { max_size 20MB }`:              20_000_000,
+		`ungzip { max_size 1048576 }`:           1 << 20,
+		`ungzip { max_decompressed_size 1MiB }`: 1 << 20,
+	} {
+		var h ResponseUngzip
+		if err := h.UnmarshalCaddyfile(caddyfile.NewTestDispenser(input)); err != nil {
+			t.Errorf("%s: %v", input, err)
+			continue
+		}
+		if got := max(h.MaxSize, h.MaxDecompressedSize); got != want {
+			t.Errorf("%s: got %d bytes, want %d", input, got, want)
+		}
+	}
+}
+
+// TestCaddyfileErrors checks that each kind of bad value is reported
+// with the subdirective and the line it is on.
+func TestCaddyfileErrors(t *testing.T) {
+	for _, tc := range []struct {
+		input string
+		want  string
+	}{
+		{"ungzip 20XB", "invalid argument 20XB: expected a content type or a size, at Testfile:1"},
+		{"ungzip {\n\tpath /api\n\tmax_size lots\n}", "invalid max_size: "},
+		{"ungzip {\n\tmax_size lots\n}", "at Testfile:2"},
+		{"ungzip {\n\tcache_size 1XB\n}", "invalid cache_size: "},
+		{"ungzip {\n\n\tcapture_size -1\n}", "at Testfile:3"},
+		{"ungzip {\n\tencodings gzip lzma\n}", `unsupported encoding "lzma"; it may need to be compiled in, at Testfile:2`},
+		{"ungzip {\n\trecompress gzip br\n}", `unsupported recompress encoding "br", at Testfile:2`},
+		{"ungzip {\n\tlink_rewrite ( /\n}", "invalid link_rewrite search: error parsing regexp"},
+		{"ungzip {\n\tpath /\n\tlink_rewrite [a- /\n}", "at Testfile:3"},
+	} {
+		var h ResponseUngzip
+		err := h.UnmarshalCaddyfile(caddyfile.NewTestDispenser(tc.input))
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%q: got %v, want %q", tc.input, err, tc.want)
+		}
+	}
+}
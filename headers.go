@@ -0,0 +1,287 @@
+package ungzip
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// CacheControl describes changes made to the Cache-Control header of
+// responses that were transformed. The decompressed representation is
+// not necessarily safe to cache as long as, or as widely as, the
+// origin's compressed one.
+type CacheControl struct {
+	// Directives to add, such as "private" or "no-transform". A
+	// directive with a value replaces any existing one of that name
+	Add []string `json:"add,omitempty"`
+
+	// Names of directives to remove, such as "public"
+	Remove []string `json:"remove,omitempty"`
+
+	// Upper bound for max-age; added if the response has none
+	MaxAge caddy.Duration `json:"max_age,omitempty"`
+
+	// s-maxage to set, so that shared caches keep decompressed
+	// responses, and the cost of decompressing them is paid less often
+	SMaxAge caddy.Duration `json:"s_maxage,omitempty"`
+
+	// stale-while-revalidate to set, so that caches go on serving a
+	// decompressed response while they fetch the next one
+	StaleWhileRevalidate caddy.Duration `json:"stale_while_revalidate,omitempty"`
+}
+
+// apply rewrites the Cache-Control header in h.
+func (cc *CacheControl) apply(h http.Header) {
+	var directives []string
+	for _, v := range h.Values("Cache-Control") {
+		for _, d := range strings.Split(v, ",") {
+			if d = strings.TrimSpace(d); d != "" {
+				directives = append(directives, d)
+			}
+		}
+	}
+
+	for _, name := range cc.Remove {
+		directives = removeDirective(directives, name)
+	}
+	for _, add := range cc.Add {
+		name, _, _ := strings.Cut(add, "=")
+		directives = append(removeDirective(directives, name), add)
+	}
+	if cc.MaxAge > 0 {
+		limit := int64(time.Duration(cc.MaxAge) / time.Second)
+		age, ok := directiveValue(directives, "max-age")
+		if n, err := strconv.ParseInt(age, 10, 64); !ok || err != nil || n > limit {
+			directives = append(removeDirective(directives, "max-age"), "max-age="+seconds(cc.MaxAge))
+		}
+	}
+
+	// shared caches are not to store these anyway
+	_, private := directiveValue(directives, "private")
+	_, noStore := directiveValue(directives, "no-store")
+	if cc.SMaxAge > 0 && !private && !noStore {
+		directives = append(removeDirective(directives, "s-maxage"), "s-maxage="+seconds(cc.SMaxAge))
+	}
+	if cc.StaleWhileRevalidate > 0 && !noStore {
+		directives = append(removeDirective(directives, "stale-while-revalidate"), "stale-while-revalidate="+seconds(cc.StaleWhileRevalidate))
+	}
+
+	if len(directives) == 0 {
+		h.Del("Cache-Control")
+		return
+	}
+	h.Set("Cache-Control", strings.Join(directives, ", "))
+}
+
+// seconds formats d as a delta-seconds value.
+func seconds(d caddy.Duration) string {
+	return strconv.FormatInt(int64(time.Duration(d)/time.Second), 10)
+}
+
+func removeDirective(directives []string, name string) []string {
+	kept := directives[:0]
+	for _, d := range directives {
+		n, _, _ := strings.Cut(d, "=")
+		if !strings.EqualFold(strings.TrimSpace(n), name) {
+			kept = append(kept, d)
+		}
+	}
+	return kept
+}
+
+func directiveValue(directives []string, name string) (string, bool) {
+	for _, d := range directives {
+		n, v, _ := strings.Cut(d, "=")
+		if strings.EqualFold(strings.TrimSpace(n), name) {
+			return strings.Trim(strings.TrimSpace(v), `"`), true
+		}
+	}
+	return "", false
+}
+
+// transformedHeaders adjusts the headers of the response to req that is
+// about to be sent decompressed.
+func (r ResponseUngzip) transformedHeaders(req *http.Request, h http.Header) {
+	for _, name := range r.encodingHeaders() {
+		h.Del(name)
+	}
+	// digests of the encoded body no longer hold (RFC 9530)
+	h.Del("Content-Digest")
+	h.Del("Repr-Digest")
+	for _, name := range r.HideHeaders {
+		h.Del(name)
+	}
+	if len(r.LinkRewrites) > 0 {
+		r.rewriteLinks(h)
+	}
+	if len(r.AddHeaders) > 0 {
+		repl := req.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+		for name, values := range r.AddHeaders {
+			for _, value := range values {
+				h.Add(name, repl.ReplaceAll(value, ""))
+			}
+		}
+	}
+	if r.CacheControl != nil {
+		r.CacheControl.apply(h)
+	}
+	switch r.Validators {
+	case "keep":
+	case "strip":
+		h.Del("Etag")
+		h.Del("Last-Modified")
+	case "weak":
+		if etag := h.Get("Etag"); etag != "" {
+			if etag = transformedETag(etag); !strings.HasPrefix(etag, "W/") {
+				etag = "W/" + etag
+			}
+			h.Set("Etag", etag)
+		}
+	default:
+		if etag := h.Get("Etag"); etag != "" {
+			h.Set("Etag", transformedETag(etag))
+		}
+	}
+}
+
+// digestValue returns the value of digest_header for a body with the
+// SHA-256 digest sum.
+func (r ResponseUngzip) digestValue(sum []byte) string {
+	switch http.CanonicalHeaderKey(r.DigestHeader) {
+	case "Repr-Digest", "Content-Digest":
+		return "sha-256=:" + base64.StdEncoding.EncodeToString(sum) + ":"
+	}
+	return hex.EncodeToString(sum)
+}
+
+// transformedETag returns the entity tag of the decompressed form of the
+// representation tagged etag. It must differ from etag, so that range
+// requests made with one of them never get bytes of the other.
+func transformedETag(etag string) string {
+	if !strings.HasSuffix(etag, `"`) || len(etag) < 2 {
+		return etag
+	}
+	return strings.TrimSuffix(etag, `"`) + `-ungzip"`
+}
+
+// isAttachment reports whether h has a Content-Disposition of attachment.
+func isAttachment(h http.Header) bool {
+	disposition, _, _ := strings.Cut(h.Get("Content-Disposition"), ";")
+	return strings.EqualFold(strings.TrimSpace(disposition), "attachment")
+}
+
+// isArchive reports whether the response to req with header h is a
+// gzip file, rather than a response that was gzipped on its way.
+func isArchive(req *http.Request, h http.Header) bool {
+	mediaType, _, _ := mime.ParseMediaType(h.Get("Content-Type"))
+	switch mediaType {
+	case "application/gzip", "application/x-gzip", "application/x-tgz", "application/x-compressed-tar":
+		return true
+	}
+	path := strings.ToLower(req.URL.Path)
+	return strings.HasSuffix(path, ".gz") || strings.HasSuffix(path, ".tgz")
+}
+
+// skipsBuffering reports whether a response with header h is to be
+// passed on without buffering it, per skip_headers.
+func skipsBuffering(skipHeaders []string, h http.Header) bool {
+	if h.Get("Content-Encoding") == "" && cacheHit(h) {
+		return true
+	}
+	for _, skip := range skipHeaders {
+		name, value, hasValue := strings.Cut(skip, ":")
+		values := h.Values(strings.TrimSpace(name))
+		if len(values) == 0 {
+			continue
+		}
+		if !hasValue {
+			return true
+		}
+		value = strings.ToLower(strings.TrimSpace(value))
+		for _, v := range values {
+			if strings.Contains(strings.ToLower(v), value) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// matchesContentType reports whether responses of contentType are
+// decompressed, per content_types.
+func (r ResponseUngzip) matchesContentType(contentType string) bool {
+	if len(r.ContentTypes) == 0 {
+		return true
+	}
+	for _, ct := range r.ContentTypes {
+		if strings.HasPrefix(contentType, ct) {
+			return true
+		}
+	}
+	return false
+}
+
+// declineReason returns why the response to a request with the given
+// method, with status and header h, is to be passed on without
+// buffering it, or "" if it is to be buffered. It looks at the headers
+// only, and declines just the responses that the checks on the buffered
+// response would pass on as they are anyway; a response that may turn
+// out to be bodiless is always buffered, since its headers are adjusted.
+// Responses to force_path requests are held to content checks as
+// responses with the "force" control header are.
+func (r ResponseUngzip) declineReason(method string, status int, h http.Header, maxSize int64, forced bool) string {
+	switch {
+	case skipsBuffering(r.SkipHeaders, h):
+		return "skip_header"
+	case status == http.StatusPartialContent:
+		return "partial_content"
+	case r.UnknownEncoding == "error" && unknownCoding(h) != "":
+		// answered with an error, so never passed on
+		return ""
+	case r.headerCodings(h) == nil:
+		return "not_encoded"
+	case method == http.MethodHead || method == http.MethodOptions ||
+		status == http.StatusNoContent || status == http.StatusNotModified:
+		return ""
+	}
+	if !r.FixContentLength {
+		if length, err := strconv.ParseInt(h.Get("Content-Length"), 10, 64); err == nil && length > maxSize {
+			return "max_size"
+		}
+	}
+	// checked last, so that the reason found again once the control
+	// header is gone is the same one
+	control := h.Get(controlHeader)
+	force := forced || strings.EqualFold(control, "force")
+	if !force && !r.matchesContentType(h.Get("Content-Type")) {
+		return "content_type"
+	}
+	if attachment := isAttachment(h); !force && (attachment && r.Attachments == "skip" || !attachment && r.Attachments == "only") {
+		return "content_disposition"
+	}
+	if strings.EqualFold(control, "skip") {
+		return "upstream_skip"
+	}
+	return ""
+}
+
+// cacheHit reports whether the Cache-Status header in h reports a hit
+// by any cache (RFC 9211, section 2.1).
+func cacheHit(h http.Header) bool {
+	for _, value := range h.Values("Cache-Status") {
+		for _, entry := range strings.Split(value, ",") {
+			for _, param := range strings.Split(entry, ";")[1:] {
+				if strings.EqualFold(strings.TrimSpace(param), "hit") {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,119 @@
+package ungzip
+
+import (
+	"sync"
+	"time"
+)
+
+// healthWindow is the period over which the failure rate is measured.
+const healthWindow = time.Minute
+
+// minHealthSamples is the number of responses needed in a window before
+// its failure rate is taken into account.
+const minHealthSamples = 10
+
+// healthTracker counts successful and failed decompressions over the
+// current and previous window, to tell whether the handler is mostly
+// failing and so effectively bypassed.
+type healthTracker struct {
+	mu          sync.Mutex
+	windowStart time.Time
+	ok, failed  [2]int // current and previous window
+}
+
+func (h *healthTracker) record(ok bool) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.rotate(time.Now())
+	if ok {
+		h.ok[0]++
+	} else {
+		h.failed[0]++
+	}
+}
+
+// failureRate returns the fraction of failures among recent responses,
+// and how many responses that is based on.
+func (h *healthTracker) failureRate() (float64, int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.rotate(time.Now())
+	total := h.ok[0] + h.ok[1] + h.failed[0] + h.failed[1]
+	if total == 0 {
+		return 0, 0
+	}
+	return float64(h.failed[0]+h.failed[1]) / float64(total), total
+}
+
+func (h *healthTracker) rotate(now time.Time) {
+	switch elapsed := now.Sub(h.windowStart); {
+	case elapsed >= 2*healthWindow:
+		h.ok, h.failed = [2]int{}, [2]int{}
+		h.windowStart = now
+	case elapsed >= healthWindow:
+		h.ok = [2]int{0, h.ok[0]}
+		h.failed = [2]int{0, h.failed[0]}
+		h.windowStart = h.windowStart.Add(healthWindow)
+	}
+}
+
+// healthReport describes the state of one handler instance.
+type healthReport struct {
+	MetricsLabel string   `json:"metrics_label,omitempty"`
+	Paths        []string `json:"paths,omitempty"`
+	Healthy      bool     `json:"healthy"`
+	Reasons      []string `json:"reasons,omitempty"`
+	FailureRate  float64  `json:"failure_rate"`
+	Samples      int      `json:"samples"`
+}
+
+// health reports whether the handler is doing its job, or degraded:
+// bypassing responses because of memory pressure, or failing to
+// decompress more than failure_rate_threshold of them.
+func (r *ResponseUngzip) health() healthReport {
+	report := healthReport{
+		MetricsLabel: r.MetricsLabel,
+		Paths:        r.Paths,
+		Healthy:      true,
+	}
+	if r.memory != nil && r.memory.degraded.Load() {
+		report.Healthy = false
+		report.Reasons = append(report.Reasons, "memory_limit exceeded")
+	}
+	report.FailureRate, report.Samples = r.healthStats.failureRate()
+	if report.Samples >= minHealthSamples && report.FailureRate > r.FailureRateThreshold {
+		report.Healthy = false
+		report.Reasons = append(report.Reasons, "failure rate above failure_rate_threshold")
+	}
+	return report
+}
+
+// instances holds the provisioned handlers, for the admin API.
+var instances = struct {
+	sync.Mutex
+	handlers map[*ResponseUngzip]struct{}
+}{handlers: make(map[*ResponseUngzip]struct{})}
+
+func registerInstance(r *ResponseUngzip) {
+	instances.Lock()
+	instances.handlers[r] = struct{}{}
+	instances.Unlock()
+}
+
+func unregisterInstance(r *ResponseUngzip) {
+	instances.Lock()
+	delete(instances.handlers, r)
+	instances.Unlock()
+}
+
+// eachInstance calls fn for every provisioned handler.
+func eachInstance(fn func(r *ResponseUngzip)) {
+	instances.Lock()
+	defer instances.Unlock()
+	for r := range instances.handlers {
+		fn(r)
+	}
+}
@@ -0,0 +1,131 @@
+package ungzip
+
+import (
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	errInputLimit    = fmt.Errorf("%w: compressed body exceeds the input limit", ErrTooLarge)
+	errOutputLimit   = fmt.Errorf("%w: decompressed body exceeds max_decompressed_size", ErrTooLarge)
+	errRatioLimit    = fmt.Errorf("%w: decompressed body exceeds max_ratio", ErrRatioExceeded)
+	errDecodeTimeout = fmt.Errorf("%w: decompression exceeded decode_timeout", ErrTimeout)
+)
+
+// ratioFloor is the output a decode may reach whatever its ratio, as
+// small bodies, such as runs of a single byte, can expand by a lot.
+const ratioFloor = 1 << 20
+
+// decodeLimits bound a single decode, whichever codecs it involves.
+// Zero values mean no limit.
+type decodeLimits struct {
+	input   int64
+	output  int64
+	ratio   float64
+	timeout time.Duration
+}
+
+// deadline returns the time a decode starting now must be done by, or
+// the zero time if there is no time limit.
+func (l decodeLimits) deadline() time.Time {
+	if l.timeout <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(l.timeout)
+}
+
+// check returns the error for a decode that has read input bytes and
+// produced output bytes so far, and is due by deadline, if it is past
+// one of the limits.
+func (l decodeLimits) check(input, output int64, deadline time.Time) error {
+	if l.output > 0 && output > l.output {
+		return errOutputLimit
+	}
+	if l.ratio > 0 && output > ratioFloor && float64(output) > l.ratio*float64(input) {
+		return errRatioLimit
+	}
+	if !deadline.IsZero() && time.Now().After(deadline) {
+		return errDecodeTimeout
+	}
+	return nil
+}
+
+// decodeLimits returns the limits decodes of responses are held to.
+// Their compressed input is already bounded by max_size, as responses
+// are buffered before they are decoded.
+func (r ResponseUngzip) decodeLimits() decodeLimits {
+	return decodeLimits{output: r.MaxDecompressedSize, ratio: r.MaxRatio, timeout: time.Duration(r.DecodeTimeout)}
+}
+
+// limitedDecoder is the front end of every decoder chain: it holds the
+// decode to its limits on compressed input read, decompressed output,
+// expansion ratio and time taken, so that each codec, including those
+// registered with RegisterDecoder, gets the same safety envelope
+// without having to enforce any of it itself.
+type limitedDecoder struct {
+	decoder  io.ReadCloser
+	input    *countingReader
+	limits   decodeLimits
+	output   int64
+	deadline time.Time
+}
+
+// newLimitedDecoder returns a reader that decodes src, compressed with
+// codings in the order given, within limits.
+func newLimitedDecoder(codings []string, src io.Reader, zstdDicts [][]byte, limits decodeLimits) (io.ReadCloser, error) {
+	input := &countingReader{r: src, limit: limits.input}
+	decoder, err := newDecoder(codings, input, zstdDicts)
+	if err != nil {
+		return nil, err
+	}
+	return &limitedDecoder{
+		decoder:  decoder,
+		input:    input,
+		limits:   limits,
+		deadline: limits.deadline(),
+	}, nil
+}
+
+func (d *limitedDecoder) Read(p []byte) (int, error) {
+	// read one byte past the output limit to tell whether it is exceeded
+	if d.limits.output > 0 && int64(len(p)) > d.limits.output-d.output+1 {
+		p = p[:d.limits.output-d.output+1]
+	}
+	n, err := d.decoder.Read(p)
+	d.output += int64(n)
+	// codecs may wrap or swallow the error of their source
+	if d.input.exceeded() {
+		return n, errInputLimit
+	}
+	if limitErr := d.limits.check(d.input.n.Load(), d.output, d.deadline); limitErr != nil {
+		return n, limitErr
+	}
+	return n, err
+}
+
+func (d *limitedDecoder) Close() error {
+	return d.decoder.Close()
+}
+
+// countingReader counts the bytes read from r, failing reads past
+// limit if it is not zero. Codecs may read from it in goroutines of
+// their own.
+type countingReader struct {
+	r     io.Reader
+	limit int64
+	n     atomic.Int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	if total := c.n.Add(int64(n)); c.limit > 0 && total > c.limit {
+		return n, errInputLimit
+	}
+	return n, err
+}
+
+func (c *countingReader) exceeded() bool {
+	return c.limit > 0 && c.n.Load() > c.limit
+}
@@ -0,0 +1,130 @@
+package ungzip
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDecodeLimitsCheck(t *testing.T) {
+	past := time.Now().Add(-time.Second)
+	future := time.Now().Add(time.Hour)
+
+	for _, tc := range []struct {
+		name          string
+		limits        decodeLimits
+		input, output int64
+		deadline      time.Time
+		want          error
+	}{
+		{name: "no limits", input: 1, output: 1 << 40},
+		{name: "output at the limit", limits: decodeLimits{output: 100}, input: 10, output: 100},
+		{name: "output past the limit", limits: decodeLimits{output: 100}, input: 10, output: 101, want: errOutputLimit},
+		{name: "ratio below the floor", limits: decodeLimits{ratio: 10}, input: 1, output: ratioFloor},
+		{name: "ratio at the limit", limits: decodeLimits{ratio: 10}, input: ratioFloor, output: 10 * ratioFloor},
+		{name: "ratio past the limit", limits: decodeLimits{ratio: 10}, input: ratioFloor, output: 10*ratioFloor + 1, want: errRatioLimit},
+		{name: "ratio with no input", limits: decodeLimits{ratio: 10}, output: ratioFloor + 1, want: errRatioLimit},
+		{name: "before the deadline", input: 1, output: 1, deadline: future},
+		{name: "past the deadline", input: 1, output: 1, deadline: past, want: errDecodeTimeout},
+		{name: "output checked first", limits: decodeLimits{output: 100, ratio: 1}, input: 1, output: ratioFloor + 1, deadline: past, want: errOutputLimit},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := tc.limits.check(tc.input, tc.output, tc.deadline); err != tc.want {
+				t.Errorf("got %v, want %v", err, tc.want)
+			}
+		})
+	}
+}
+
+func TestDecodeLimitsDeadline(t *testing.T) {
+	if d := (decodeLimits{}).deadline(); !d.IsZero() {
+		t.Errorf("no timeout: got deadline %v", d)
+	}
+	if d := (decodeLimits{timeout: -time.Second}).deadline(); !d.IsZero() {
+		t.Errorf("negative timeout: got deadline %v", d)
+	}
+	if d := (decodeLimits{timeout: time.Minute}).deadline(); d.Before(time.Now()) {
+		t.Errorf("timeout: got deadline %v in the past", d)
+	}
+}
+
+func TestLimitedDecoder(t *testing.T) {
+	text := []byte(strings.Repeat("limits ", 1000))
+	compressed := gzipped(t, text)
+
+	for _, tc := range []struct {
+		name   string
+		src    []byte
+		limits decodeLimits
+		want   error
+		class  error
+	}{
+		{name: "no limits", src: compressed},
+		{name: "output at the limit", src: compressed, limits: decodeLimits{output: int64(len(text))}},
+		{name: "output one past the limit", src: compressed, limits: decodeLimits{output: int64(len(text)) - 1}, want: errOutputLimit, class: ErrTooLarge},
+		{name: "input at the limit", src: compressed, limits: decodeLimits{input: int64(len(compressed))}},
+		{name: "input one past the limit", src: compressed, limits: decodeLimits{input: int64(len(compressed)) - 1}, want: errInputLimit, class: ErrTooLarge},
+		{name: "ratio", src: gzipped(t, make([]byte, 4<<20)), limits: decodeLimits{ratio: 10}, want: errRatioLimit, class: ErrRatioExceeded},
+		{name: "timeout", src: compressed, limits: decodeLimits{timeout: time.Nanosecond}, want: errDecodeTimeout, class: ErrTimeout},
+		{name: "truncated", src: compressed[:len(compressed)/2], want: io.ErrUnexpectedEOF},
+		{name: "truncated trailer", src: compressed[:len(compressed)-4], want: io.ErrUnexpectedEOF},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			d, err := newLimitedDecoder([]string{"gzip"}, bytes.NewReader(tc.src), nil, tc.limits)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer d.Close()
+			out, err := io.ReadAll(d)
+			if !errors.Is(err, tc.want) {
+				t.Fatalf("got %v, want %v", err, tc.want)
+			}
+			if tc.class != nil && !errors.Is(err, tc.class) {
+				t.Errorf("got %v, want it in class %v", err, tc.class)
+			}
+			if tc.want == nil && !bytes.Equal(out, text) {
+				t.Errorf("got %d bytes, want %d", len(out), len(text))
+			}
+			if tc.limits.output > 0 && int64(len(out)) > tc.limits.output+1 {
+				t.Errorf("read %d bytes past an output limit of %d", len(out), tc.limits.output)
+			}
+		})
+	}
+
+	t.Run("malformed header", func(t *testing.T) {
+		if _, err := newLimitedDecoder([]string{"gzip"}, strings.NewReader("not gzip"), nil, decodeLimits{}); err == nil {
+			t.Error("got no error")
+		}
+	})
+}
+
+func TestCountingReader(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		size  int
+		limit int64
+		want  error
+	}{
+		{name: "no limit", size: 100},
+		{name: "empty", size: 0, limit: 1},
+		{name: "at the limit", size: 100, limit: 100},
+		{name: "one past the limit", size: 101, limit: 100, want: errInputLimit},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c := &countingReader{r: bytes.NewReader(make([]byte, tc.size)), limit: tc.limit}
+			_, err := io.Copy(io.Discard, c)
+			if err != tc.want {
+				t.Errorf("got %v, want %v", err, tc.want)
+			}
+			if got := c.n.Load(); got != int64(tc.size) {
+				t.Errorf("counted %d bytes, want %d", got, tc.size)
+			}
+			if c.exceeded() != (tc.want != nil) {
+				t.Errorf("got exceeded %v", c.exceeded())
+			}
+		})
+	}
+}
@@ -0,0 +1,57 @@
+package ungzip
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+)
+
+// LinkRewrite rewrites the URLs in the Location, Content-Location and
+// Link headers of transformed responses, for those that point at the
+// compressed variant of a resource, such as a .gz file, to point at its
+// decompressed equivalent instead.
+type LinkRewrite struct {
+	// Regular expression matching the part of URLs to rewrite, such as
+	// `\.gz$`
+	Search string `json:"search"`
+
+	// Replacement for the matched part, which may refer to submatches
+	// as $1
+	Replace string `json:"replace,omitempty"`
+
+	re *regexp.Regexp
+}
+
+func (lr *LinkRewrite) provision() error {
+	re, err := regexp.Compile(lr.Search)
+	if err != nil {
+		return fmt.Errorf("invalid link_rewrite search: %v", err)
+	}
+	lr.re = re
+	return nil
+}
+
+// linkTarget matches the URI reference of a Link header entry.
+var linkTarget = regexp.MustCompile(`<[^>]*>`)
+
+// rewriteLinks applies the link rewrites to the headers in h.
+func (r ResponseUngzip) rewriteLinks(h http.Header) {
+	for _, name := range []string{"Location", "Content-Location"} {
+		for i, value := range h[name] {
+			h[name][i] = r.rewriteLink(value)
+		}
+	}
+	for i, value := range h["Link"] {
+		h["Link"][i] = linkTarget.ReplaceAllStringFunc(value, func(target string) string {
+			return "<" + r.rewriteLink(target[1:len(target)-1]) + ">"
+		})
+	}
+}
+
+// rewriteLink applies the link rewrites to url, in order.
+func (r ResponseUngzip) rewriteLink(url string) string {
+	for _, lr := range r.LinkRewrites {
+		url = lr.re.ReplaceAllString(url, lr.Replace)
+	}
+	return url
+}
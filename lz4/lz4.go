@@ -0,0 +1,29 @@
+// Package lz4 adds the lz4 content coding, in the LZ4 frame format,
+// to the response_ungzip handler. It lives in its own module so that
+// the decoder is only compiled into Caddy builds that ask for it:
+//
+//	xcaddy build --with github.com/danielballan/caddy-ungzip/lz4
+//
+// and is then enabled with the encodings option:
+//
+//	ungzip {
+//		encodings gzip lz4
+//	}
+package lz4
+
+import (
+	"io"
+
+	"github.com/pierrec/lz4/v4"
+
+	ungzip "github.com/danielballan/caddy-ungzip"
+)
+
+func init() {
+	ungzip.RegisterDecoder("lz4", ungzip.Decoder{
+		Magic: []byte{0x04, 0x22, 0x4d, 0x18},
+		NewReader: func(src io.Reader) (io.ReadCloser, error) {
+			return io.NopCloser(lz4.NewReader(src)), nil
+		},
+	})
+}
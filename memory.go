@@ -0,0 +1,73 @@
+package ungzip
+
+import (
+	"runtime/metrics"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const heapMetric = "/memory/classes/heap/objects:bytes"
+
+// memoryMonitor periodically samples the Go heap and reports the
+// handler as degraded while it is above the configured limit. To
+// avoid flapping, it only recovers once the heap falls back below
+// 90% of the limit.
+type memoryMonitor struct {
+	limit    uint64
+	degraded atomic.Bool
+	logger   *zap.Logger
+	metrics  *ungzipMetrics
+	quit     chan struct{}
+}
+
+func newMemoryMonitor(limit int64, logger *zap.Logger, m *ungzipMetrics) *memoryMonitor {
+	mon := &memoryMonitor{
+		limit:   uint64(limit),
+		logger:  logger,
+		metrics: m,
+		quit:    make(chan struct{}),
+	}
+	go mon.run(time.Second)
+	return mon
+}
+
+func (mon *memoryMonitor) run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	sample := []metrics.Sample{{Name: heapMetric}}
+	for {
+		select {
+		case <-ticker.C:
+		case <-mon.quit:
+			return
+		}
+		metrics.Read(sample)
+		if sample[0].Value.Kind() != metrics.KindUint64 {
+			continue
+		}
+		mon.update(sample[0].Value.Uint64())
+	}
+}
+
+func (mon *memoryMonitor) update(heap uint64) {
+	switch {
+	case !mon.degraded.Load() && heap > mon.limit:
+		mon.degraded.Store(true)
+		mon.metrics.observeMemoryDegraded(true)
+		mon.logger.Warn("heap above memory_limit; degrading",
+			zap.Uint64("heap_bytes", heap),
+			zap.Uint64("memory_limit", mon.limit))
+	case mon.degraded.Load() && heap < mon.limit/10*9:
+		mon.degraded.Store(false)
+		mon.metrics.observeMemoryDegraded(false)
+		mon.logger.Info("heap back under memory_limit; buffering restored",
+			zap.Uint64("heap_bytes", heap),
+			zap.Uint64("memory_limit", mon.limit))
+	}
+}
+
+func (mon *memoryMonitor) stop() {
+	close(mon.quit)
+}
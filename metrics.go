@@ -0,0 +1,221 @@
+package ungzip
+
+import (
+	"errors"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	metricsNamespace = "caddy"
+	metricsSubsystem = "http_ungzip"
+)
+
+type ungzipMetrics struct {
+	decompressedBytes *prometheus.CounterVec
+	decompressSeconds *prometheus.CounterVec
+	panics            prometheus.Counter
+	memoryDegraded    prometheus.Gauge
+	lengthMismatches  *prometheus.CounterVec
+	expansionRatio    *prometheus.HistogramVec
+	suspiciousRatios  *prometheus.CounterVec
+	upstreamResponses *prometheus.CounterVec
+	identityResponses *prometheus.CounterVec
+	verifiedResponses *prometheus.CounterVec
+	rolloutRequests   *prometheus.CounterVec
+	comparisons       *prometheus.CounterVec
+}
+
+func newUngzipMetrics(registry *prometheus.Registry) *ungzipMetrics {
+	m := &ungzipMetrics{
+		decompressedBytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "decompressed_bytes_total",
+			Help:      "Number of bytes produced by decompressing responses.",
+		}, []string{"route", "cost_label"}),
+		decompressSeconds: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "decompress_seconds_total",
+			Help:      "Time spent decompressing responses, as an estimate of CPU cost.",
+		}, []string{"route", "cost_label"}),
+		panics: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "panics_total",
+			Help:      "Number of panics recovered while decompressing responses.",
+		}),
+		memoryDegraded: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "memory_degraded",
+			Help:      "Whether decompression is degraded because of memory pressure (1) or not (0).",
+		}),
+		lengthMismatches: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "content_length_mismatches_total",
+			Help:      "Number of compressed responses whose Content-Length did not match their body.",
+		}, []string{"route"}),
+		expansionRatio: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "expansion_ratio",
+			Help:      "Ratio of decompressed to compressed size of responses.",
+			Buckets:   prometheus.ExponentialBuckets(1, 2, 12),
+		}, []string{"route"}),
+		suspiciousRatios: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "suspicious_ratio_total",
+			Help:      "Number of responses that expanded more than the configured suspicious ratio.",
+		}, []string{"route"}),
+		upstreamResponses: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "upstream_responses_total",
+			Help:      "Number of responses decompressed or failing to, by the reverse_proxy upstream that sent them.",
+		}, []string{"route", "upstream", "result"}),
+		identityResponses: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "identity_responses_total",
+			Help:      "Number of responses under ensure_identity sent as identity by the upstream, or compressed anyway (fallback).",
+		}, []string{"route", "result"}),
+		verifiedResponses: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "verified_responses_total",
+			Help:      "Number of responses decoded under verify_only, by whether they were well formed (ok) or not (broken).",
+		}, []string{"route", "result"}),
+		rolloutRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "rollout_requests_total",
+			Help:      "Number of requests under rollout_percent, by whether they were processed (rollout) or left out (holdout).",
+		}, []string{"route", "cohort"}),
+		comparisons: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "comparisons_total",
+			Help:      "Number of sampled transformed responses checked against their decompressed body, by result.",
+		}, []string{"route", "result"}),
+	}
+	if registry != nil {
+		m.decompressedBytes = register(registry, m.decompressedBytes)
+		m.decompressSeconds = register(registry, m.decompressSeconds)
+		m.panics = register(registry, m.panics)
+		m.memoryDegraded = register(registry, m.memoryDegraded)
+		m.lengthMismatches = register(registry, m.lengthMismatches)
+		m.expansionRatio = register(registry, m.expansionRatio)
+		m.suspiciousRatios = register(registry, m.suspiciousRatios)
+		m.upstreamResponses = register(registry, m.upstreamResponses)
+		m.identityResponses = register(registry, m.identityResponses)
+		m.verifiedResponses = register(registry, m.verifiedResponses)
+		m.rolloutRequests = register(registry, m.rolloutRequests)
+		m.comparisons = register(registry, m.comparisons)
+	}
+	return m
+}
+
+// register adds c to registry, or returns the collector already
+// registered there by another handler instance.
+func register[T prometheus.Collector](registry *prometheus.Registry, c T) T {
+	if err := registry.Register(c); err != nil {
+		var are prometheus.AlreadyRegisteredError
+		if errors.As(err, &are) {
+			if existing, ok := are.ExistingCollector.(T); ok {
+				return existing
+			}
+		}
+	}
+	return c
+}
+
+func (m *ungzipMetrics) observeCost(route, label string, size int, elapsed time.Duration) {
+	if m == nil {
+		return
+	}
+	m.decompressedBytes.WithLabelValues(route, label).Add(float64(size))
+	m.decompressSeconds.WithLabelValues(route, label).Add(elapsed.Seconds())
+}
+
+func (m *ungzipMetrics) observePanic() {
+	if m == nil {
+		return
+	}
+	m.panics.Inc()
+}
+
+func (m *ungzipMetrics) observeMemoryDegraded(degraded bool) {
+	if m == nil {
+		return
+	}
+	if degraded {
+		m.memoryDegraded.Set(1)
+	} else {
+		m.memoryDegraded.Set(0)
+	}
+}
+
+func (m *ungzipMetrics) observeLengthMismatch(route string) {
+	if m == nil {
+		return
+	}
+	m.lengthMismatches.WithLabelValues(route).Inc()
+}
+
+// observeRatio records the expansion ratio of a response, and reports
+// whether it exceeds threshold, if that is set.
+func (m *ungzipMetrics) observeRatio(route string, compressed, decompressed int, threshold float64) bool {
+	if compressed == 0 {
+		return false
+	}
+	ratio := float64(decompressed) / float64(compressed)
+	suspicious := threshold > 0 && ratio > threshold
+	if m == nil {
+		return suspicious
+	}
+	m.expansionRatio.WithLabelValues(route).Observe(ratio)
+	if suspicious {
+		m.suspiciousRatios.WithLabelValues(route).Inc()
+	}
+	return suspicious
+}
+
+func (m *ungzipMetrics) observeUpstream(route, upstream, result string) {
+	if m == nil {
+		return
+	}
+	m.upstreamResponses.WithLabelValues(route, upstream, result).Inc()
+}
+
+func (m *ungzipMetrics) observeIdentity(route, result string) {
+	if m == nil {
+		return
+	}
+	m.identityResponses.WithLabelValues(route, result).Inc()
+}
+
+func (m *ungzipMetrics) observeVerified(route, result string) {
+	if m == nil {
+		return
+	}
+	m.verifiedResponses.WithLabelValues(route, result).Inc()
+}
+
+func (m *ungzipMetrics) observeRollout(route, cohort string) {
+	if m == nil {
+		return
+	}
+	m.rolloutRequests.WithLabelValues(route, cohort).Inc()
+}
+
+func (m *ungzipMetrics) observeComparison(route, result string) {
+	if m == nil {
+		return
+	}
+	m.comparisons.WithLabelValues(route, result).Inc()
+}
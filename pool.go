@@ -0,0 +1,81 @@
+package ungzip
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+var (
+	errPoolFull     = errors.New("decompression queue is full")
+	errPoolCanceled = errors.New("request canceled while queued for decompression")
+)
+
+// workerPool runs decompression jobs on a fixed number of goroutines,
+// bounding the CPU spent inflating independently of how many
+// connections Caddy is serving.
+type workerPool struct {
+	jobs chan *poolJob
+	wg   sync.WaitGroup
+}
+
+type poolJob struct {
+	ctx  context.Context
+	run  func() error
+	done chan error
+}
+
+func newWorkerPool(workers, queue int) *workerPool {
+	p := &workerPool{jobs: make(chan *poolJob, queue)}
+	p.wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go p.work()
+	}
+	return p
+}
+
+func (p *workerPool) work() {
+	defer p.wg.Done()
+	for job := range p.jobs {
+		if err := job.ctx.Err(); err != nil {
+			job.done <- errPoolCanceled
+			continue
+		}
+		job.done <- job.run()
+	}
+}
+
+// do queues run and waits for it to finish. If no queue slot frees up
+// within timeout (or immediately, if timeout is zero), errPoolFull is
+// returned and run is never called. Once queued, do always waits for
+// the job to be picked up, since run typically reads pooled buffers
+// owned by the caller.
+func (p *workerPool) do(ctx context.Context, timeout time.Duration, run func() error) error {
+	job := &poolJob{ctx: ctx, run: run, done: make(chan error, 1)}
+
+	select {
+	case p.jobs <- job:
+	default:
+		if timeout <= 0 {
+			return errPoolFull
+		}
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		select {
+		case p.jobs <- job:
+		case <-timer.C:
+			return errPoolFull
+		case <-ctx.Done():
+			return errPoolCanceled
+		}
+	}
+
+	return <-job.done
+}
+
+// stop lets the workers drain the queue and exit.
+func (p *workerPool) stop() {
+	close(p.jobs)
+	p.wg.Wait()
+}
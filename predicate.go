@@ -0,0 +1,28 @@
+package ungzip
+
+import "net/http"
+
+// Predicate is implemented by modules in the
+// http.handlers.response_ungzip.predicates namespace, so that plugins
+// can bring decision logic of their own, such as database lookups or
+// feature flags. Allow is called with the request and the response
+// headers once a response has passed the handler's own checks and is
+// about to be transformed. Every predicate must allow it for it to be
+// transformed; otherwise the original, still compressed, response is
+// served. An error is handled like a decoding failure.
+type Predicate interface {
+	Allow(req *http.Request, header http.Header) (bool, error)
+}
+
+// allowed reports whether all the configured predicates allow the
+// response to req with header to be transformed.
+func (r ResponseUngzip) allowed(req *http.Request, header http.Header) (ok bool, err error) {
+	defer r.recoverPanic(&err)
+
+	for _, p := range r.predicates {
+		if ok, err := p.Allow(req, header); !ok || err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
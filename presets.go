@@ -0,0 +1,74 @@
+package ungzip
+
+import (
+	"slices"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+// presets are option bundles for common deployment patterns, applied
+// by the preset subdirective as if their options were written in its
+// place. Options given after it in the same block override or extend
+// them as repeated options do.
+var presets = map[string]string{
+	// IIS and other older servers that compress with x-gzip, send
+	// wrong lengths, or label bodies with codings they did not apply
+	"legacy_iis": `ungzip {
+		encodings gzip
+		fix_content_length
+		unknown_encoding strip
+		on_error passthrough
+	}`,
+
+	// objects stored compressed in S3 and compatible stores, whose
+	// coding is often only in their metadata, and which are served as
+	// downloads that should stay compressed
+	"s3_static": `ungzip {
+		metadata_headers X-Amz-Meta-Content-Encoding
+		attachments skip
+		max_size 52428800
+		on_error passthrough
+	}`,
+
+	// JSON APIs behind compressing upstreams, where a broken or
+	// unexpected body is better reported than passed on
+	"api_json": `ungzip {
+		content_type application/json application/problem+json
+		encodings gzip zstd
+		max_size 20971520
+		max_decompressed_size 104857600
+		unknown_encoding error
+		on_error error
+	}`,
+}
+
+// presetNames returns the names of the presets, sorted.
+func presetNames() []string {
+	names := make([]string, 0, len(presets))
+	for name := range presets {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// applyPreset parses the options of the preset named by the current
+// argument of d into r.
+func (r *ResponseUngzip) applyPreset(d *caddyfile.Dispenser) error {
+	if !d.NextArg() {
+		return d.ArgErr()
+	}
+	preset, ok := presets[d.Val()]
+	if !ok {
+		return d.Errf("unknown preset %q; must be one of %s", d.Val(), strings.Join(presetNames(), ", "))
+	}
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+	tokens, err := caddyfile.Tokenize([]byte(preset), "preset "+d.Val())
+	if err != nil {
+		return err
+	}
+	return r.UnmarshalCaddyfile(caddyfile.NewDispenser(tokens))
+}
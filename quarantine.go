@@ -0,0 +1,70 @@
+package ungzip
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// quarantineRecord is the metadata written next to a quarantined body.
+type quarantineRecord struct {
+	Time      time.Time   `json:"time"`
+	Method    string      `json:"method"`
+	Host      string      `json:"host"`
+	URI       string      `json:"uri"`
+	Status    int         `json:"status"`
+	Headers   http.Header `json:"headers"`
+	Error     string      `json:"error"`
+	Size      int         `json:"size"`
+	Truncated bool        `json:"truncated"`
+}
+
+// quarantine saves the compressed body held by rec, which failed to
+// decompress with decodeErr, into the quarantine directory. Files are
+// named after the body's checksum, so repeats of the same corrupt
+// payload overwrite each other instead of filling the disk.
+func (r ResponseUngzip) quarantine(req *http.Request, rec caddyhttp.ResponseRecorder, decodeErr error) {
+	body := rec.Buffer().Bytes()
+	record := quarantineRecord{
+		Time:    time.Now().UTC(),
+		Method:  req.Method,
+		Host:    req.Host,
+		URI:     req.RequestURI,
+		Status:  rec.Status(),
+		Headers: rec.Header().Clone(),
+		Error:   decodeErr.Error(),
+		Size:    len(body),
+	}
+	if int64(len(body)) > r.QuarantineMaxSize {
+		body = body[:r.QuarantineMaxSize]
+		record.Truncated = true
+	}
+
+	sum := sha256.Sum256(body)
+	name := filepath.Join(r.QuarantineDir, hex.EncodeToString(sum[:]))
+
+	meta, err := json.MarshalIndent(record, "", "\t")
+	if err == nil {
+		err = os.WriteFile(name+".gz", body, 0o600)
+	}
+	if err == nil {
+		err = os.WriteFile(name+".json", meta, 0o600)
+	}
+	if err != nil {
+		r.logger.Error("quarantining malformed response", zap.String("uri", req.RequestURI), zap.Error(err))
+		return
+	}
+	r.logger.Warn("quarantined malformed response",
+		zap.String("uri", req.RequestURI),
+		zap.String("file", name+".gz"),
+		zap.Error(decodeErr),
+	)
+}
@@ -0,0 +1,5 @@
+//go:build race
+
+package ungzip
+
+func init() { raceEnabled = true }
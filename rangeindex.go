@@ -0,0 +1,325 @@
+package ungzip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/klauspost/compress/gzip"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// memberIndex locates the members of a gzip file made of several, like
+// those written by bgzip or pigz --independent. Each member can be
+// decompressed on its own, so a range of the decompressed form only
+// needs the members that cover it, which the upstream can be asked for
+// with a range of the compressed form.
+type memberIndex struct {
+	// strong ETag of the compressed form the index was built from
+	etag string
+
+	// offsets at which members start in the compressed and the
+	// decompressed form, followed by the total sizes of both
+	comp, decomp []int64
+}
+
+// buildMemberIndex indexes the gzip members in src, decoding them
+// within limits. It returns nil if there is only one, since nothing can
+// then be skipped.
+func buildMemberIndex(etag string, src []byte, limits decodeLimits) (*memberIndex, error) {
+	br := bytes.NewReader(src)
+	input := memberReader{&countingReader{r: br}, br}
+	zr, err := gzip.NewReader(input)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	zr.Multistream(false)
+	limited := &limitedDecoder{
+		decoder:  io.NopCloser(zr),
+		input:    input.countingReader,
+		limits:   limits,
+		deadline: limits.deadline(),
+	}
+
+	idx := &memberIndex{etag: etag}
+	var comp, decomp int64
+	for {
+		idx.comp = append(idx.comp, comp)
+		idx.decomp = append(idx.decomp, decomp)
+		// the input is an io.ByteReader, so the decompressor reads no
+		// further than the end of the member
+		n, err := io.Copy(io.Discard, limited)
+		if err != nil {
+			return nil, err
+		}
+		decomp += n
+		comp = int64(len(src) - br.Len())
+		if err := zr.Reset(input); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		zr.Multistream(false)
+	}
+	idx.comp = append(idx.comp, comp)
+	idx.decomp = append(idx.decomp, decomp)
+	if len(idx.comp) < 3 {
+		return nil, nil
+	}
+	return idx, nil
+}
+
+// memberReader counts the bytes read from a bytes.Reader for the
+// limits of a decode, while still being an io.ByteReader.
+type memberReader struct {
+	*countingReader
+	br *bytes.Reader
+}
+
+func (m memberReader) ReadByte() (byte, error) {
+	b, err := m.br.ReadByte()
+	if err == nil {
+		m.n.Add(1)
+	}
+	return b, err
+}
+
+// size returns the size of the decompressed form.
+func (idx *memberIndex) size() int64 {
+	return idx.decomp[len(idx.decomp)-1]
+}
+
+// members returns the first and last member holding bytes start to end
+// of the decompressed form, inclusive.
+func (idx *memberIndex) members(start, end int64) (first, last int) {
+	n := len(idx.decomp) - 1
+	first, _ = slices.BinarySearch(idx.decomp[:n], start+1)
+	last, _ = slices.BinarySearch(idx.decomp[:n], end+1)
+	return first - 1, last - 1
+}
+
+func (idx *memberIndex) marshal() []byte {
+	buf := binary.AppendUvarint(nil, uint64(len(idx.etag)))
+	buf = append(buf, idx.etag...)
+	buf = binary.AppendUvarint(buf, uint64(len(idx.comp)))
+	for i := range idx.comp {
+		buf = binary.AppendVarint(buf, idx.comp[i])
+		buf = binary.AppendVarint(buf, idx.decomp[i])
+	}
+	return buf
+}
+
+var errBadIndex = errors.New("corrupt member index")
+
+func unmarshalMemberIndex(buf []byte) (*memberIndex, error) {
+	r := bytes.NewReader(buf)
+	n, err := binary.ReadUvarint(r)
+	if err != nil || n > uint64(r.Len()) {
+		return nil, errBadIndex
+	}
+	etag := make([]byte, n)
+	_, _ = r.Read(etag)
+	idx := &memberIndex{etag: string(etag)}
+	// at least one member and the totals
+	if n, err = binary.ReadUvarint(r); err != nil || n < 2 || n > uint64(r.Len()) {
+		return nil, errBadIndex
+	}
+	idx.comp, idx.decomp = make([]int64, n), make([]int64, n)
+	var comp, decomp int64
+	for i := range idx.comp {
+		if idx.comp[i], err = binary.ReadVarint(r); err != nil || idx.comp[i] < comp {
+			return nil, errBadIndex
+		}
+		if idx.decomp[i], err = binary.ReadVarint(r); err != nil || idx.decomp[i] < decomp {
+			return nil, errBadIndex
+		}
+		comp, decomp = idx.comp[i], idx.decomp[i]
+	}
+	if idx.comp[0] != 0 || idx.decomp[0] != 0 {
+		return nil, errBadIndex
+	}
+	return idx, nil
+}
+
+func indexKey(req *http.Request) string {
+	return req.Host + req.URL.RequestURI()
+}
+
+// indexMembers builds and stores the member index of the gzip response
+// with header and body src to req, for later range requests. Only
+// responses to range requests are indexed, since building the index
+// takes decompressing the body again.
+func (r ResponseUngzip) indexMembers(req *http.Request, status int, header http.Header, codings []string, src []byte) {
+	etag := header.Get("Etag")
+	if r.rangeIndex == nil || req.Header.Get("Range") == "" || status != http.StatusOK ||
+		!slices.Equal(codings, []string{"gzip"}) || etag == "" || strings.HasPrefix(etag, "W/") {
+		return
+	}
+	if buf, ok := r.rangeIndex.get(indexKey(req)); ok {
+		if idx, err := unmarshalMemberIndex(buf); err == nil && idx.etag == etag {
+			return
+		}
+	}
+	idx, err := buildMemberIndex(etag, src, r.decodeLimits())
+	if err != nil || idx == nil {
+		return
+	}
+	r.rangeIndex.put(indexKey(req), idx.marshal())
+}
+
+// serveIndexedRange serves a single-range request for the decompressed
+// form of a resource with a member index, from just the members that
+// hold the range. The members go through the same decisions as a full
+// response, as far as their headers tell; as the body is verified as a
+// whole, responses are not served from the index when verify is set.
+// It reports whether it handled the request; if not, the request is to
+// be handled as usual.
+func (r ResponseUngzip) serveIndexedRange(w http.ResponseWriter, req *http.Request, next caddyhttp.Handler, forced bool) (bool, error) {
+	if r.rangeIndex == nil || r.Verify != nil || req.Method != http.MethodGet || req.Header.Get("Range") == "" {
+		return false, nil
+	}
+	buf, ok := r.rangeIndex.get(indexKey(req))
+	if !ok {
+		return false, nil
+	}
+	idx, err := unmarshalMemberIndex(buf)
+	if err != nil {
+		return false, nil
+	}
+	start, end, ok := parseSingleRange(req.Header.Get("Range"), idx.size())
+	if !ok {
+		return false, nil
+	}
+	if ifRange := req.Header.Get("If-Range"); ifRange != "" {
+		h := http.Header{"Etag": {idx.etag}}
+		r.transformedHeaders(req, h)
+		if h.Get("Etag") == "" || ifRange != h.Get("Etag") {
+			return false, nil
+		}
+	}
+	first, last := idx.members(start, end)
+
+	sub := req.Clone(req.Context())
+	sub.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", idx.comp[first], idx.comp[last+1]-1))
+	sub.Header.Set("If-Range", idx.etag)
+	sub.Header.Set("Accept-Encoding", "gzip")
+
+	// the recorder shares w's headers, which must be left as they were
+	// if this does not work out
+	saved := w.Header().Clone()
+	restore := func() (bool, error) {
+		clear(w.Header())
+		for key, values := range saved {
+			w.Header()[key] = values
+		}
+		return false, nil
+	}
+	fallBack := func() (bool, error) {
+		// the resource changed or the upstream does not do ranges;
+		// forget the index and start over with a normal request
+		r.rangeIndex.remove(indexKey(req))
+		return restore()
+	}
+
+	respBuf := bufPool.get()
+	defer bufPool.put(respBuf)
+	rec := caddyhttp.NewResponseRecorder(w, respBuf, func(status int, headers http.Header) bool {
+		return true
+	})
+	if err := next.ServeHTTP(rec, sub); err != nil {
+		return true, err
+	}
+	if rec.Status() != http.StatusPartialContent ||
+		!slices.Equal(contentEncodings(rec.Header()), []string{"gzip"}) ||
+		!strings.HasPrefix(rec.Header().Get("Content-Range"), fmt.Sprintf("bytes %d-%d/", idx.comp[first], idx.comp[last+1]-1)) {
+		return fallBack()
+	}
+
+	// let the normal request make and log any decision not to decode
+	control := rec.Header().Get(controlHeader)
+	rec.Header().Del(controlHeader)
+	force := forced || strings.EqualFold(control, "force")
+	if strings.EqualFold(control, "skip") || r.headerDecline(req, rec.Header(), force) != "" {
+		return restore()
+	}
+	if ok, err := r.allowed(req, rec.Header()); err != nil || !ok {
+		return restore()
+	}
+
+	out := bufPool.get()
+	defer bufPool.put(out)
+	reader, err := newLimitedDecoder([]string{"gzip"}, bytes.NewReader(rec.Buffer().Bytes()), nil, r.decodeLimits())
+	if err != nil {
+		return fallBack()
+	}
+	defer reader.Close()
+	_, err = io.CopyN(io.Discard, reader, start-idx.decomp[first])
+	if err == nil {
+		_, err = io.CopyN(out, reader, end-start+1)
+	}
+	if err != nil {
+		if errorClass(err) == ErrBadStream {
+			return fallBack()
+		}
+		// past a limit, which the members are held to as the whole
+		// body would be
+		if r.OnError == "error" {
+			return true, r.fail(req, rec, err)
+		}
+		// the normal request applies the limits again and passes the
+		// response through
+		return restore()
+	}
+
+	rec.Header().Del("Content-Encoding")
+	rec.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, idx.size()))
+	rec.Header().Set("Content-Length", strconv.Itoa(out.Len()))
+	r.transformedHeaders(req, rec.Header())
+	w.WriteHeader(http.StatusPartialContent)
+	if _, err := r.output(w, req).Write(out.Bytes()); err != nil {
+		return true, err
+	}
+	r.healthStats.record(true)
+	r.logDecision(req, "decompressed", "range_index")
+	return true, flush(w)
+}
+
+// parseSingleRange parses a Range header asking for one range of a
+// representation of the given size, returning its first and last byte.
+func parseSingleRange(header string, size int64) (start, end int64, ok bool) {
+	spec, found := strings.CutPrefix(header, "bytes=")
+	if !found || strings.Contains(spec, ",") {
+		return 0, 0, false
+	}
+	first, last, found := strings.Cut(strings.TrimSpace(spec), "-")
+	if !found {
+		return 0, 0, false
+	}
+	if first == "" {
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n <= 0 {
+			return 0, 0, false
+		}
+		return max(size-n, 0), size - 1, size > 0
+	}
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 || start >= size {
+		return 0, 0, false
+	}
+	end = size - 1
+	if last != "" {
+		if end, err = strconv.ParseInt(last, 10, 64); err != nil || end < start {
+			return 0, 0, false
+		}
+		end = min(end, size-1)
+	}
+	return start, end, true
+}
@@ -0,0 +1,204 @@
+package ungzip
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func TestIndexedRangeLimits(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	h := ResponseUngzip{RangeIndexSize: 1 << 20, MaxDecompressedSize: 1 << 20, OnError: "error"}
+	if err := h.Provision(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer h.Cleanup()
+
+	zeros := gzipped(t, make([]byte, 4<<20))
+	members := append(zeros, zeros...)
+	if _, err := buildMemberIndex(`"v1"`, members, h.decodeLimits()); !errors.Is(err, ErrTooLarge) {
+		t.Errorf("indexing past max_decompressed_size: got %v", err)
+	}
+	idx, err := buildMemberIndex(`"v1"`, members, decodeLimits{})
+	if err != nil || idx == nil {
+		t.Fatalf("got index %v, %v", idx, err)
+	}
+
+	upstream := caddyhttp.HandlerFunc(func(w http.ResponseWriter, req *http.Request) error {
+		var start, end int
+		if _, err := fmt.Sscanf(req.Header.Get("Range"), "bytes=%d-%d", &start, &end); err != nil {
+			return err
+		}
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Header().Set("Etag", `"v1"`)
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(members)))
+		w.WriteHeader(http.StatusPartialContent)
+		_, err := w.Write(members[start : end+1])
+		return err
+	})
+	req := httptest.NewRequest(http.MethodGet, "/file", nil)
+	req.Header.Set("Range", "bytes=3000000-3000009")
+	req = caddyhttp.PrepareRequest(req, caddyhttp.NewTestReplacer(req), nil, nil)
+	h.rangeIndex.put(indexKey(req), idx.marshal())
+
+	err = h.ServeHTTP(httptest.NewRecorder(), req, upstream)
+	var handlerErr caddyhttp.HandlerError
+	if !errors.As(err, &handlerErr) || !errors.Is(err, ErrTooLarge) {
+		t.Errorf("range past max_decompressed_size: got %v", err)
+	}
+}
+
+func TestBuildMemberIndex(t *testing.T) {
+	a, b, c := gzipped(t, []byte("first member")), gzipped(t, []byte("second")), gzipped(t, nil)
+	cat := func(members ...[]byte) []byte { return bytes.Join(members, nil) }
+	la, lb, lc := int64(len(a)), int64(len(b)), int64(len(c))
+
+	for _, tc := range []struct {
+		name    string
+		src     []byte
+		comp    []int64
+		decomp  []int64
+		wantErr bool
+	}{
+		{name: "one member", src: a},
+		{name: "two members", src: cat(a, b), comp: []int64{0, la, la + lb}, decomp: []int64{0, 12, 18}},
+		{name: "empty member", src: cat(a, c, b), comp: []int64{0, la, la + lc, la + lc + lb}, decomp: []int64{0, 12, 12, 18}},
+		{name: "empty", src: nil, wantErr: true},
+		{name: "not gzip", src: []byte("not gzip at all"), wantErr: true},
+		{name: "truncated member", src: a[:len(a)-1], wantErr: true},
+		{name: "truncated second member", src: cat(a, b[:len(b)/2]), wantErr: true},
+		{name: "truncated second header", src: cat(a, b[:4]), wantErr: true},
+		{name: "garbage after the members", src: cat(a, b, []byte("garbage")), wantErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			idx, err := buildMemberIndex(`"v1"`, tc.src, decodeLimits{})
+			if tc.wantErr {
+				if err == nil {
+					t.Errorf("got index %v", idx)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tc.comp == nil {
+				if idx != nil {
+					t.Errorf("got index %v, want none", idx)
+				}
+				return
+			}
+			if !slices.Equal(idx.comp, tc.comp) || !slices.Equal(idx.decomp, tc.decomp) {
+				t.Errorf("got offsets %v and %v, want %v and %v", idx.comp, idx.decomp, tc.comp, tc.decomp)
+			}
+		})
+	}
+}
+
+func TestMemberIndexMembers(t *testing.T) {
+	idx := &memberIndex{comp: []int64{0, 5, 9, 14, 20}, decomp: []int64{0, 10, 10, 20, 30}}
+	for _, tc := range []struct {
+		start, end  int64
+		first, last int
+	}{
+		{0, 0, 0, 0},
+		{0, 9, 0, 0},
+		{9, 10, 0, 2},
+		{10, 10, 2, 2},
+		{10, 19, 2, 2},
+		{19, 20, 2, 3},
+		{0, 29, 0, 3},
+		{29, 29, 3, 3},
+	} {
+		first, last := idx.members(tc.start, tc.end)
+		if first != tc.first || last != tc.last {
+			t.Errorf("bytes %d-%d: got members %d-%d, want %d-%d", tc.start, tc.end, first, last, tc.first, tc.last)
+		}
+	}
+}
+
+func TestUnmarshalMemberIndex(t *testing.T) {
+	valid := (&memberIndex{etag: `"v1"`, comp: []int64{0, 5, 9}, decomp: []int64{0, 10, 30}}).marshal()
+	idx, err := unmarshalMemberIndex(valid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if idx.etag != `"v1"` || !slices.Equal(idx.comp, []int64{0, 5, 9}) || !slices.Equal(idx.decomp, []int64{0, 10, 30}) {
+		t.Errorf("got %+v", idx)
+	}
+	for n := range len(valid) {
+		if _, err := unmarshalMemberIndex(valid[:n]); err != errBadIndex {
+			t.Errorf("truncated to %d bytes: got %v", n, err)
+		}
+	}
+
+	for name, idx := range map[string]*memberIndex{
+		"no members":              {etag: `"v1"`, comp: []int64{0}, decomp: []int64{0}},
+		"nothing at all":          {etag: `"v1"`},
+		"not starting at zero":    {etag: `"v1"`, comp: []int64{1, 5, 9}, decomp: []int64{0, 10, 30}},
+		"compressed going back":   {etag: `"v1"`, comp: []int64{0, 9, 5}, decomp: []int64{0, 10, 30}},
+		"decompressed going back": {etag: `"v1"`, comp: []int64{0, 5, 9}, decomp: []int64{0, 30, 10}},
+		"negative":                {etag: `"v1"`, comp: []int64{0, -5, 9}, decomp: []int64{0, 10, 30}},
+	} {
+		if _, err := unmarshalMemberIndex(idx.marshal()); err != errBadIndex {
+			t.Errorf("%s: got %v", name, err)
+		}
+	}
+	// lengths past the end of the buffer
+	for name, buf := range map[string][]byte{
+		"etag":    binary.AppendUvarint(nil, 1<<40),
+		"members": binary.AppendUvarint(binary.AppendUvarint(nil, 0), 1<<40),
+		"varint":  {0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+	} {
+		if _, err := unmarshalMemberIndex(buf); err != errBadIndex {
+			t.Errorf("%s: got %v", name, err)
+		}
+	}
+}
+
+func TestParseSingleRange(t *testing.T) {
+	for _, tc := range []struct {
+		header     string
+		size       int64
+		start, end int64
+		ok         bool
+	}{
+		{header: "bytes=0-9", size: 100, start: 0, end: 9, ok: true},
+		{header: "bytes=0-0", size: 100, start: 0, end: 0, ok: true},
+		{header: "bytes=99-99", size: 100, start: 99, end: 99, ok: true},
+		{header: "bytes=90-", size: 100, start: 90, end: 99, ok: true},
+		{header: "bytes=5-200", size: 100, start: 5, end: 99, ok: true},
+		{header: "bytes=-10", size: 100, start: 90, end: 99, ok: true},
+		{header: "bytes=-100", size: 100, start: 0, end: 99, ok: true},
+		{header: "bytes=-200", size: 100, start: 0, end: 99, ok: true},
+		{header: "bytes= 0-9 ", size: 100, start: 0, end: 9, ok: true},
+		{header: "bytes=100-", size: 100},
+		{header: "bytes=100-200", size: 100},
+		{header: "bytes=10-5", size: 100},
+		{header: "bytes=-0", size: 100},
+		{header: "bytes=-10", size: 0},
+		{header: "bytes=0-", size: 0},
+		{header: "bytes=0-9,20-29", size: 100},
+		{header: "bytes=", size: 100},
+		{header: "bytes=-", size: 100},
+		{header: "bytes=9", size: 100},
+		{header: "bytes=a-b", size: 100},
+		{header: "bytes=-1-5", size: 100},
+		{header: "items=0-9", size: 100},
+		{header: "", size: 100},
+	} {
+		start, end, ok := parseSingleRange(tc.header, tc.size)
+		if ok != tc.ok || (ok && (start != tc.start || end != tc.end)) {
+			t.Errorf("%q of %d bytes: got %d-%d %v, want %d-%d %v", tc.header, tc.size, start, end, ok, tc.start, tc.end, tc.ok)
+		}
+	}
+}
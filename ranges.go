@@ -0,0 +1,142 @@
+package ungzip
+
+import (
+	"bytes"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// cacheKey returns the key of the decompressed form of the response
+// with header to req in the decompression cache, or "" if it is not
+// to be cached. Like recompressed variants, only responses with a
+// validator are cached.
+func (r ResponseUngzip) cacheKey(req *http.Request, header http.Header) string {
+	if r.cache == nil {
+		return ""
+	}
+	validator := header.Get("Etag")
+	if validator == "" {
+		validator = header.Get("Last-Modified")
+	}
+	if validator == "" {
+		return ""
+	}
+	return req.Host + req.URL.RequestURI() + "\x00" + validator
+}
+
+// upstreamRequest returns the request to pass to the next handler.
+// With the decompression cache or range indexes enabled, ranges of
+// resources known to be encoded are served from the full decompressed
+// body, so the Range and If-Range headers are not passed on for them:
+// a range of the compressed body is of no use. Ranges of any other
+// resource, such as a video, are left to the upstream. Accept-Encoding
+// is replaced with upstream_accept_encoding on a copy too, as
+// recompress negotiates with the client's.
+func (r ResponseUngzip) upstreamRequest(req *http.Request) *http.Request {
+	// like the encode handler, take our suffix off the ETag clients
+	// revalidate with, so that upstreams can still answer 304
+	if etag := req.Header.Get("If-None-Match"); strings.HasSuffix(etag, `-ungzip"`) {
+		req.Header.Set("If-None-Match", strings.TrimSuffix(etag, `-ungzip"`)+`"`)
+	}
+	stripRange := r.servesRanges() && req.Method == http.MethodGet && req.Header.Get("Range") != "" && r.knownEncoded(req)
+	replaceAE := r.UpstreamAcceptEncoding != "" && req.Header.Get("Accept-Encoding") != r.UpstreamAcceptEncoding
+	if !stripRange && !replaceAE {
+		return req
+	}
+	upstream := req.Clone(req.Context())
+	if stripRange {
+		upstream.Header.Del("Range")
+		upstream.Header.Del("If-Range")
+	}
+	if replaceAE {
+		upstream.Header.Set("Accept-Encoding", r.UpstreamAcceptEncoding)
+	}
+	return upstream
+}
+
+// encodedNotes returns where the resources known to be encoded are
+// noted, which is the cache if there is one, or else the range index.
+func (r ResponseUngzip) encodedNotes() *lruCache {
+	if r.cache != nil {
+		return r.cache
+	}
+	return r.rangeIndex
+}
+
+// encodedKey returns the key of the note that the resource req asks
+// for is encoded. Hosts hold no NUL, so it is unlike any other key.
+func encodedKey(req *http.Request) string {
+	return "encoded\x00" + indexKey(req)
+}
+
+// knownEncoded reports whether the resource req asks for is known to be
+// encoded, and small enough to be decoded: it has a member index, or
+// noteRanges noted it.
+func (r ResponseUngzip) knownEncoded(req *http.Request) bool {
+	if r.rangeIndex != nil {
+		if _, ok := r.rangeIndex.get(indexKey(req)); ok {
+			return true
+		}
+	}
+	_, ok := r.encodedNotes().get(encodedKey(req))
+	return ok
+}
+
+// noteRanges notes from the response to a GET request, with status and
+// header, whether the resource is encoded with codings this handler
+// decodes and no larger than maxSize, so that later range requests for
+// it are served from its decompressed form. Responses that were spilled
+// were too large.
+func (r ResponseUngzip) noteRanges(req *http.Request, status int, header http.Header, maxSize int64, spilled bool) {
+	if !r.servesRanges() || req.Method != http.MethodGet {
+		return
+	}
+	notes, key := r.encodedNotes(), encodedKey(req)
+	switch {
+	case spilled:
+		notes.remove(key)
+	case status == http.StatusPartialContent:
+		// the size of the whole encoded body follows the slash
+		_, total, _ := strings.Cut(header.Get("Content-Range"), "/")
+		size, err := strconv.ParseInt(total, 10, 64)
+		if r.headerCodings(header) != nil && err == nil && size <= maxSize {
+			notes.put(key, []byte{1})
+		}
+	case status == http.StatusOK:
+		if r.headerCodings(header) != nil {
+			notes.put(key, []byte{1})
+		} else {
+			notes.remove(key)
+		}
+	}
+}
+
+// servesRanges reports whether ranges of decompressed bodies are
+// served, rather than passed on to the upstream.
+func (r ResponseUngzip) servesRanges() bool {
+	return r.cache != nil || r.rangeIndex != nil
+}
+
+// servesRange reports whether the response to req is to be served with
+// serveRange: the client asked for a range of a successful response,
+// which is going out as a whole decompressed body.
+func (r ResponseUngzip) servesRange(req *http.Request, status int, header http.Header) bool {
+	return r.servesRanges() &&
+		req.Method == http.MethodGet &&
+		req.Header.Get("Range") != "" &&
+		status == http.StatusOK &&
+		header.Get("Content-Encoding") == "" &&
+		!hasTrailers(header)
+}
+
+// serveRange serves the ranges of body that req asks for, with the
+// headers already set on w. If-Range is evaluated against the ETag of
+// the decompressed form, so a request carrying any other validator,
+// such as the origin's, gets the whole body.
+func serveRange(w http.ResponseWriter, req *http.Request, body []byte) {
+	w.Header().Del("Content-Length")
+	// a zero time leaves If-Range to the ETag
+	modtime, _ := http.ParseTime(w.Header().Get("Last-Modified"))
+	http.ServeContent(w, req, "", modtime, bytes.NewReader(body))
+}
@@ -0,0 +1,77 @@
+package ungzip
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func TestRangesOfUnknownResourcesGoUpstream(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	h := ResponseUngzip{CacheSize: 1 << 20}
+	if err := h.Provision(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer h.Cleanup()
+
+	text := []byte(strings.Repeat("0123456789", 100))
+	compressed := gzipped(t, text)
+	var ranges []string
+	// serves /video as is and /text gzipped, with ranges of either
+	upstream := caddyhttp.HandlerFunc(func(w http.ResponseWriter, req *http.Request) error {
+		ranges = append(ranges, req.Header.Get("Range"))
+		body := text
+		if req.URL.Path == "/text" {
+			body = compressed
+			w.Header().Set("Content-Encoding", "gzip")
+		}
+		w.Header().Set("Etag", `"v1"`)
+		if req.Header.Get("Range") == "bytes=0-9" {
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes 0-9/%d", len(body)))
+			w.WriteHeader(http.StatusPartialContent)
+			_, err := w.Write(body[:10])
+			return err
+		}
+		_, err := w.Write(body)
+		return err
+	})
+	get := func(path string) *httptest.ResponseRecorder {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("Range", "bytes=0-9")
+		req = caddyhttp.PrepareRequest(req, caddyhttp.NewTestReplacer(req), nil, nil)
+		w := httptest.NewRecorder()
+		if err := h.ServeHTTP(w, req, upstream); err != nil {
+			t.Fatal(err)
+		}
+		return w
+	}
+
+	for i := 0; i < 2; i++ {
+		w := get("/video")
+		if w.Code != http.StatusPartialContent || !bytes.Equal(w.Body.Bytes(), text[:10]) {
+			t.Errorf("video: got %d with %q", w.Code, w.Body.Bytes())
+		}
+	}
+	// the first range of the text is the upstream's, of the compressed
+	// form; once it is known to be encoded, ranges are of the
+	// decompressed form
+	if w := get("/text"); w.Code != http.StatusPartialContent || !bytes.Equal(w.Body.Bytes(), compressed[:10]) {
+		t.Errorf("text: got %d with %q", w.Code, w.Body.Bytes())
+	}
+	if w := get("/text"); w.Code != http.StatusPartialContent || !bytes.Equal(w.Body.Bytes(), text[:10]) {
+		t.Errorf("text: got %d with %q", w.Code, w.Body.Bytes())
+	}
+	want := []string{"bytes=0-9", "bytes=0-9", "bytes=0-9", ""}
+	if fmt.Sprint(ranges) != fmt.Sprint(want) {
+		t.Errorf("upstream got ranges %q, want %q", ranges, want)
+	}
+}
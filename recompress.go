@@ -0,0 +1,108 @@
+package ungzip
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+	"go.uber.org/zap"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/encode"
+)
+
+// recompress re-encodes a transformed body with the best encoding in
+// r.Recompress that the client accepts, updating header to match. The
+// body is returned as is if the client accepts none of them, or is in
+// one of r.IdentityRegions.
+//
+// Encoded variants of responses that carry a validator are cached by
+// URL, validator and encoding, so each one is only encoded once.
+// This assumes the transformed body depends only on those; filters
+// that produce per-request output (like templates) remove validators,
+// which keeps their responses out of the cache.
+func (r ResponseUngzip) recompress(req *http.Request, header http.Header, body []byte) []byte {
+	if !hasVaryValue(header, "Accept-Encoding") {
+		header.Add("Vary", "Accept-Encoding")
+	}
+
+	if len(r.IdentityRegions) > 0 && r.inRegion(req, r.IdentityRegions) {
+		return body
+	}
+
+	var enc string
+	for _, accepted := range encode.AcceptedEncodings(req, r.Recompress) {
+		if slices.Contains(r.Recompress, accepted) {
+			enc = accepted
+			break
+		}
+	}
+	if enc == "" {
+		return body
+	}
+
+	var key string
+	if r.recompressCache != nil {
+		validator := header.Get("Etag")
+		if validator == "" {
+			validator = header.Get("Last-Modified")
+		}
+		if validator != "" {
+			key = req.Host + req.URL.RequestURI() + "\x00" + validator + "\x00" + enc
+		}
+	}
+
+	encoded, cached := []byte(nil), false
+	if key != "" {
+		encoded, cached = r.recompressCache.get(key)
+	}
+	if !cached {
+		var err error
+		if encoded, err = encodeBody(enc, body, r.zstdEncoderFor(req, header)); err != nil {
+			r.logger.Error("recompressing response", zap.String("encoding", enc), zap.Error(err))
+			return body
+		}
+		if key != "" {
+			r.recompressCache.put(key, encoded)
+		}
+	}
+
+	header.Set("Content-Encoding", enc)
+	// like the encode handler, distinguish the ETag of each encoding
+	if etag := header.Get("Etag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		header.Set("Etag", strings.TrimSuffix(etag, `"`)+"-"+enc+`"`)
+	}
+	return encoded
+}
+
+func encodeBody(enc string, body []byte, zstdEncoder *zstd.Encoder) ([]byte, error) {
+	switch enc {
+	case "gzip":
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		if _, err := zw.Write(body); err != nil {
+			return nil, err
+		}
+		if err := zw.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case "zstd":
+		return zstdEncoder.EncodeAll(body, make([]byte, 0, len(body)/2)), nil
+	}
+	return nil, fmt.Errorf("unsupported encoding %q", enc)
+}
+
+func hasVaryValue(header http.Header, value string) bool {
+	for _, vary := range header.Values("Vary") {
+		for _, v := range strings.Split(vary, ",") {
+			if strings.EqualFold(strings.TrimSpace(v), value) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,122 @@
+package ungzip
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// upstreamWriter is the writer the next handler writes its response to.
+// It passes flushes, hijacks, pushes and ReadFrom on to the recorder,
+// which passes them on to the client whenever the response is not
+// buffered, so that streaming upstream handlers are not held back by
+// a response this handler leaves alone.
+//
+// A buffered response that grows past limit bytes would be passed on as
+// it is anyway, so it is spilled: what was buffered is written to the
+// client, and the rest of the response goes straight to it, ReadFrom
+// included, so that large files can still be sent with sendfile.
+type upstreamWriter struct {
+	caddyhttp.ResponseRecorder
+	w       http.ResponseWriter
+	limit   int64
+	spilled bool
+}
+
+// Write buffers or passes on p, spilling the response if p takes the
+// buffered body over the limit.
+func (u *upstreamWriter) Write(p []byte) (int, error) {
+	if !u.spilled {
+		u.ResponseRecorder.WriteHeader(http.StatusOK)
+		if !u.overflows(int64(len(p))) {
+			return u.ResponseRecorder.Write(p)
+		}
+		if err := u.spill(); err != nil {
+			return 0, err
+		}
+	}
+	return u.w.Write(p)
+}
+
+// ReadFrom buffers up to the limit of src, and spills the response
+// and copies the rest of src to the client's writer if there is more.
+func (u *upstreamWriter) ReadFrom(src io.Reader) (int64, error) {
+	var n int64
+	if !u.spilled {
+		u.ResponseRecorder.WriteHeader(http.StatusOK)
+		if u.limit <= 0 || !u.Buffered() {
+			return u.readFrom(src)
+		}
+		var err error
+		n, err = u.readFrom(io.LimitReader(src, u.limit-int64(u.Buffer().Len())+1))
+		if err != nil || !u.overflows(0) {
+			return n, err
+		}
+		if err := u.spill(); err != nil {
+			return n, err
+		}
+	}
+	m, err := io.Copy(u.w, src)
+	return n + m, err
+}
+
+func (u *upstreamWriter) readFrom(src io.Reader) (int64, error) {
+	if rf, ok := u.ResponseRecorder.(io.ReaderFrom); ok {
+		return rf.ReadFrom(src)
+	}
+	return io.Copy(struct{ io.Writer }{u.ResponseRecorder}, src)
+}
+
+// overflows reports whether n more bytes take the buffered body over
+// the limit.
+func (u *upstreamWriter) overflows(n int64) bool {
+	return u.limit > 0 && u.Buffered() && int64(u.Buffer().Len())+n > u.limit
+}
+
+// spill writes the headers and the buffered body to the client, after
+// which the response is written to it directly.
+func (u *upstreamWriter) spill() error {
+	u.spilled = true
+	u.w.Header().Del(controlHeader)
+	u.w.WriteHeader(u.Status())
+	_, err := u.w.Write(u.Buffer().Bytes())
+	u.Buffer().Reset()
+	return err
+}
+
+// FlushError flushes the response, first writing its headers if none
+// were written yet, as net/http does. Flushes of a buffered response
+// are ignored.
+func (u *upstreamWriter) FlushError() error {
+	if u.spilled {
+		return http.NewResponseController(u.w).Flush()
+	}
+	if status := u.Status(); status < 200 {
+		u.WriteHeader(http.StatusOK)
+	}
+	return http.NewResponseController(u.ResponseRecorder).Flush()
+}
+
+// Flush implements http.Flusher, for handlers that assert it rather
+// than using an http.ResponseController.
+func (u *upstreamWriter) Flush() {
+	_ = u.FlushError()
+}
+
+func (u *upstreamWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return http.NewResponseController(u.ResponseRecorder).Hijack()
+}
+
+func (u *upstreamWriter) Push(target string, opts *http.PushOptions) error {
+	if pusher, ok := u.ResponseRecorder.(http.Pusher); ok {
+		return pusher.Push(target, opts)
+	}
+	return http.ErrNotSupported
+}
+
+func (u *upstreamWriter) Unwrap() http.ResponseWriter {
+	return u.ResponseRecorder
+}
@@ -0,0 +1,390 @@
+package ungzip
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func init() {
+	caddy.RegisterModule(RequestUngzip{})
+	httpcaddyfile.RegisterHandlerDirective("request_ungzip", parseRequestCaddyfile)
+}
+
+// RequestUngzip implements an HTTP handler that decompresses request
+// bodies, for backends that only accept identity
+type RequestUngzip struct {
+	// Content codings to decode, as Content-Encoding tokens
+	// Default: ["gzip", "zstd"]
+	Encodings []string `json:"encodings,omitempty"`
+
+	// Maximum size of a decompressed request body (in bytes); larger
+	// requests are rejected with 413
+	// Default: 10MB
+	MaxSize int64 `json:"max_size,omitempty"`
+
+	// Maximum number of content codings to decode from one request;
+	// requests with more are rejected with 400
+	// Default: 3
+	MaxEncodingLayers int `json:"max_encoding_layers,omitempty"`
+
+	// Header in which to pass the original Content-Encoding of decoded
+	// requests on, such as "X-Original-Content-Encoding"
+	OriginalEncodingHeader string `json:"original_encoding_header,omitempty"`
+
+	// Header in which to pass the original Content-Length of decoded
+	// requests on, when the client sent one
+	OriginalLengthHeader string `json:"original_length_header,omitempty"`
+
+	// Placeholder identifying the upstream the request is going to, to
+	// look up in upstream_encodings. reverse_proxy only sets its upstream
+	// placeholders once it has picked one, after this handler has run,
+	// so use something that decides the upstream, like a map output
+	UpstreamKey string `json:"upstream_key,omitempty"`
+
+	// Encodings that upstreams accept, by upstream_key value. Requests
+	// to an upstream that accepts all of their encodings are passed on
+	// as they are; requests to other upstreams are decoded
+	UpstreamEncodings map[string][]string `json:"upstream_encodings,omitempty"`
+
+	// Also decode the parts of multipart/form-data bodies that have a
+	// Content-Encoding of their own. These bodies are streamed, parts
+	// that are not encoded byte for byte, and sent on without a
+	// Content-Length
+	Multipart bool `json:"multipart,omitempty"`
+
+	// Size of the buffer decoders read request bodies through, in bytes
+	// Default: whatever the decoder picks, typically 4KiB
+	ReadBufferSize int `json:"read_buffer_size,omitempty"`
+
+	// Size of the chunks decoded bodies are read in, in bytes
+	// Default: whatever io.Copy picks, typically 32KiB
+	CopyBufferSize int `json:"copy_buffer_size,omitempty"`
+
+	// Decode the body as the next handler reads it instead of up front,
+	// for large uploads. The body is then sent on without a length, and
+	// reading past max_size fails instead of the request being rejected
+	Stream bool `json:"stream,omitempty"`
+}
+
+// CaddyModule returns the Caddy module information.
+func (RequestUngzip) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.handlers.request_ungzip",
+		New: func() caddy.Module { return new(RequestUngzip) },
+	}
+}
+
+// UnmarshalCaddyfile implements caddyfile.Unmarshaler.
+func (r *RequestUngzip) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		for d.NextBlock(0) {
+			switch d.Val() {
+			case "encodings":
+				r.Encodings = d.RemainingArgs()
+				if len(r.Encodings) == 0 {
+					return d.ArgErr()
+				}
+				for _, enc := range r.Encodings {
+					if _, ok := decoders[enc]; !ok {
+						return d.Errf("unsupported encoding %q; it may need to be compiled in", enc)
+					}
+				}
+
+			case "max_size":
+				if err := sizeArg(d, &r.MaxSize); err != nil {
+					return err
+				}
+
+			case "max_encoding_layers":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				layers, err := strconv.Atoi(d.Val())
+				if err != nil {
+					return d.Errf("invalid max_encoding_layers: %v", err)
+				}
+				r.MaxEncodingLayers = layers
+
+			case "original_encoding_header":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				r.OriginalEncodingHeader = d.Val()
+
+			case "original_length_header":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				r.OriginalLengthHeader = d.Val()
+
+			case "upstream_key":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				r.UpstreamKey = d.Val()
+
+			case "upstream_encodings":
+				args := d.RemainingArgs()
+				if len(args) < 1 {
+					return d.ArgErr()
+				}
+				if r.UpstreamEncodings == nil {
+					r.UpstreamEncodings = make(map[string][]string)
+				}
+				r.UpstreamEncodings[args[0]] = append(r.UpstreamEncodings[args[0]], args[1:]...)
+
+			case "read_buffer_size", "copy_buffer_size":
+				name := d.Val()
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				size, err := parseSize(d.Val())
+				if err != nil {
+					return d.Errf("invalid %s: %v", name, err)
+				}
+				if name == "read_buffer_size" {
+					r.ReadBufferSize = int(size)
+				} else {
+					r.CopyBufferSize = int(size)
+				}
+
+			case "multipart":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				r.Multipart = true
+
+			case "stream":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				r.Stream = true
+
+			default:
+				return d.Errf("unknown subdirective %s", d.Val())
+			}
+		}
+	}
+	return nil
+}
+
+// Provision implements caddy.Provisioner.
+func (r *RequestUngzip) Provision(ctx caddy.Context) error {
+	if len(r.Encodings) == 0 {
+		r.Encodings = []string{"gzip", "zstd"}
+	}
+	if r.MaxSize == 0 {
+		r.MaxSize = 10 * 1024 * 1024 // 10MB default
+	}
+	if r.MaxEncodingLayers == 0 {
+		r.MaxEncodingLayers = 3
+	}
+	registerConfig(r)
+	return nil
+}
+
+// Cleanup implements caddy.CleanerUpper.
+func (r *RequestUngzip) Cleanup() error {
+	unregisterConfig(r)
+	return nil
+}
+
+// Validate implements caddy.Validator.
+func (r *RequestUngzip) Validate() error {
+	if r.MaxSize < 0 {
+		return fmt.Errorf("max_size cannot be negative")
+	}
+	if r.MaxEncodingLayers < 0 {
+		return fmt.Errorf("max_encoding_layers cannot be negative")
+	}
+	for _, enc := range r.Encodings {
+		if _, ok := decoders[enc]; !ok {
+			return fmt.Errorf("unsupported encoding %q; it may need to be compiled in", enc)
+		}
+	}
+	if r.ReadBufferSize < 0 || r.CopyBufferSize < 0 {
+		return fmt.Errorf("read_buffer_size and copy_buffer_size cannot be negative")
+	}
+	if len(r.UpstreamEncodings) > 0 && r.UpstreamKey == "" {
+		return fmt.Errorf("upstream_encodings requires upstream_key")
+	}
+	if r.Stream && r.Multipart {
+		return fmt.Errorf("multipart cannot be used with stream")
+	}
+	return nil
+}
+
+var errRequestTooLarge = fmt.Errorf("%w: decompressed request body exceeds max_size", ErrTooLarge)
+
+func (r RequestUngzip) ServeHTTP(w http.ResponseWriter, req *http.Request, next caddyhttp.Handler) error {
+	if req.Body == nil || req.Body == http.NoBody {
+		return next.ServeHTTP(w, req)
+	}
+	codings := contentEncodings(req.Header)
+	for _, coding := range codings {
+		if !slices.Contains(r.Encodings, coding) {
+			return next.ServeHTTP(w, req)
+		}
+	}
+	if len(codings) > r.MaxEncodingLayers {
+		return classifiedError(req, http.StatusBadRequest, fmt.Errorf("%w: %d", errTooManyLayers, len(codings)))
+	}
+	if r.upstreamAccepts(req, codings) {
+		return next.ServeHTTP(w, req)
+	}
+	boundary := r.multipartBoundary(req)
+	if len(codings) == 0 && boundary == "" {
+		return next.ServeHTTP(w, req)
+	}
+
+	var reader io.Reader = req.Body
+	if len(codings) > 0 {
+		decoder, err := newLimitedDecoder(codings, bufferedReader(req.Body, r.ReadBufferSize), nil, r.decodeLimits())
+		if err != nil {
+			return classifiedError(req, http.StatusBadRequest, err)
+		}
+		if r.OriginalEncodingHeader != "" {
+			req.Header.Set(r.OriginalEncodingHeader, strings.Join(req.Header.Values("Content-Encoding"), ", "))
+		}
+		if r.OriginalLengthHeader != "" && req.ContentLength >= 0 {
+			req.Header.Set(r.OriginalLengthHeader, strconv.FormatInt(req.ContentLength, 10))
+		}
+
+		if r.Stream || boundary != "" {
+			req.Body = &decodedBody{req: req, decoder: decoder, body: req.Body, remaining: r.MaxSize}
+		} else {
+			defer decoder.Close()
+			reader = decoder
+		}
+	}
+
+	if r.Stream || boundary != "" {
+		if boundary != "" {
+			body := r.streamMultipart(req, req.Body, boundary)
+			// stops the rewrite if the body is not read to the end
+			defer body.Close()
+			req.Body = body
+		}
+		req.ContentLength = -1
+		req.Header.Del("Content-Length")
+		req.Header.Del("Content-Encoding")
+		return next.ServeHTTP(w, req)
+	}
+
+	body, err := r.readBody(reader)
+	if err != nil {
+		return classifiedError(req, http.StatusBadRequest, err)
+	}
+
+	req.Body = io.NopCloser(body)
+	req.ContentLength = int64(body.Len())
+	req.Header.Set("Content-Length", strconv.Itoa(body.Len()))
+	req.Header.Del("Content-Encoding")
+	return next.ServeHTTP(w, req)
+}
+
+// upstreamAccepts reports whether the upstream req is going to is known
+// to accept a body encoded with codings.
+func (r RequestUngzip) upstreamAccepts(req *http.Request, codings []string) bool {
+	if r.UpstreamKey == "" || len(codings) == 0 {
+		return false
+	}
+	repl := req.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+	accepted, ok := r.UpstreamEncodings[repl.ReplaceAll(r.UpstreamKey, "")]
+	if !ok {
+		return false
+	}
+	for _, coding := range codings {
+		if !slices.Contains(accepted, coding) {
+			return false
+		}
+	}
+	return true
+}
+
+// decodeLimits returns the limits decodes of request bodies are held
+// to. Compressed data is never much larger than what it decodes to, so
+// a body of more than twice max_size, plus room for the framing of
+// small ones, can only be padding, such as endless empty gzip members,
+// and is refused however little it decodes to.
+func (r RequestUngzip) decodeLimits() decodeLimits {
+	return decodeLimits{input: min(r.MaxSize, math.MaxInt64/4)*2 + 4096}
+}
+
+// readBody reads the decoded body from reader, up to max_size.
+func (r RequestUngzip) readBody(reader io.Reader) (*bytes.Buffer, error) {
+	body := new(bytes.Buffer)
+	n, err := copyChunked(body, io.LimitReader(reader, r.MaxSize+1), r.CopyBufferSize)
+	if errors.Is(err, errInputLimit) {
+		return nil, caddyhttp.Error(http.StatusRequestEntityTooLarge, err)
+	}
+	if err != nil {
+		return nil, caddyhttp.Error(http.StatusBadRequest, err)
+	}
+	if n > r.MaxSize {
+		return nil, caddyhttp.Error(http.StatusRequestEntityTooLarge, errRequestTooLarge)
+	}
+	return body, nil
+}
+
+// decodedBody is a request body that is decoded as it is read. Errors
+// carry a status code, like those of the request_body handler, and an
+// error class, for handlers that read the body themselves.
+type decodedBody struct {
+	req       *http.Request
+	decoder   io.ReadCloser
+	body      io.ReadCloser
+	remaining int64
+}
+
+func (b *decodedBody) Read(p []byte) (int, error) {
+	// read one byte past the limit to tell whether it is exceeded
+	if int64(len(p)) > b.remaining+1 {
+		p = p[:b.remaining+1]
+	}
+	n, err := b.decoder.Read(p)
+	if int64(n) > b.remaining {
+		n = int(b.remaining)
+		b.remaining = 0
+		return n, classifiedError(b.req, http.StatusRequestEntityTooLarge, errRequestTooLarge)
+	}
+	b.remaining -= int64(n)
+	if errors.Is(err, errInputLimit) {
+		err = classifiedError(b.req, http.StatusRequestEntityTooLarge, err)
+	} else if err != nil && err != io.EOF {
+		err = classifiedError(b.req, http.StatusBadRequest, err)
+	}
+	return n, err
+}
+
+func (b *decodedBody) Close() error {
+	return errors.Join(b.decoder.Close(), b.body.Close())
+}
+
+func parseRequestCaddyfile(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error) {
+	handler := new(RequestUngzip)
+	err := handler.UnmarshalCaddyfile(h.Dispenser)
+	return handler, err
+}
+
+// Interface guards
+var (
+	_ caddy.Module                = (*RequestUngzip)(nil)
+	_ caddy.Provisioner           = (*RequestUngzip)(nil)
+	_ caddy.Validator             = (*RequestUngzip)(nil)
+	_ caddy.CleanerUpper          = (*RequestUngzip)(nil)
+	_ caddyhttp.MiddlewareHandler = (*RequestUngzip)(nil)
+	_ caddyfile.Unmarshaler       = (*RequestUngzip)(nil)
+)
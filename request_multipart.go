@@ -0,0 +1,294 @@
+package ungzip
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/textproto"
+	"slices"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// maxPartHeaderSize is the most read of the header block of a part to
+// tell whether it is encoded. Parts with larger header blocks are sent
+// on as they are.
+const maxPartHeaderSize = 64 * 1024
+
+// multipartBoundary returns the boundary of req's multipart/form-data
+// body if its parts are to be decoded, or "" otherwise.
+func (r RequestUngzip) multipartBoundary(req *http.Request) string {
+	if !r.Multipart {
+		return ""
+	}
+	mediaType, params, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/form-data" {
+		return ""
+	}
+	return params["boundary"]
+}
+
+// streamMultipart returns a body that streams the multipart body read
+// from src, with the given boundary, decoding the parts that have a
+// Content-Encoding made up of enabled encodings, whose headers are
+// updated to match. Everything else, including parts that are not
+// encoded, is passed on byte for byte. Only decoded parts count
+// towards max_size.
+func (r RequestUngzip) streamMultipart(req *http.Request, src io.ReadCloser, boundary string) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		defer src.Close()
+		pw.CloseWithError(r.rewriteMultipart(pw, src, boundary))
+	}()
+	return &multipartBody{req: req, pipe: pr}
+}
+
+// rewriteMultipart writes the multipart body read from src to dst,
+// decoding its encoded parts.
+func (r RequestUngzip) rewriteMultipart(dst io.Writer, src io.Reader, boundary string) error {
+	// a CRLF in front lets a delimiter at the very start of the body be
+	// found like the others; it is not written out
+	br := bufio.NewReader(io.MultiReader(strings.NewReader("\r\n"), src))
+	out := &skipWriter{w: dst, skip: 2}
+	delim := []byte("\r\n--" + boundary)
+	remaining := r.MaxSize
+
+	var codings []string // of the current part, if it is to be decoded
+	for {
+		content := &delimitedReader{r: br, delim: delim}
+		if codings == nil {
+			if _, err := io.Copy(out, content); err != nil {
+				return err
+			}
+		} else {
+			n, err := r.decodePart(out, content, codings, remaining)
+			if err != nil {
+				return err
+			}
+			remaining -= n
+		}
+		if !content.found {
+			// the body ended without a closing delimiter
+			return nil
+		}
+
+		if _, err := br.Discard(len(delim)); err != nil {
+			return err
+		}
+		if _, err := out.Write(delim); err != nil {
+			return err
+		}
+		line, err := br.ReadBytes('\n')
+		if _, err := out.Write(line); err != nil {
+			return err
+		}
+		if err != nil {
+			return ignoreEOF(err)
+		}
+		if bytes.HasPrefix(line, []byte("--")) {
+			// the closing delimiter: the rest is the epilogue
+			_, err := io.Copy(out, br)
+			return err
+		}
+
+		raw, complete, err := readPartHeader(br)
+		if err != nil {
+			out.Write(raw)
+			return ignoreEOF(err)
+		}
+		codings = nil
+		if complete {
+			codings, err = r.partCodings(raw)
+			if err != nil {
+				return err
+			}
+		}
+		if codings != nil {
+			raw = stripPartHeader(raw)
+		}
+		if _, err := out.Write(raw); err != nil {
+			return err
+		}
+	}
+}
+
+// partCodings returns the codings of the part with the header block
+// raw if it is to be decoded, or nil if it is to be sent on as it is.
+func (r RequestUngzip) partCodings(raw []byte) ([]string, error) {
+	header, err := textproto.NewReader(bufio.NewReader(bytes.NewReader(raw))).ReadMIMEHeader()
+	if err != nil {
+		return nil, nil
+	}
+	codings := contentEncodings(http.Header(header))
+	if len(codings) == 0 {
+		return nil, nil
+	}
+	for _, coding := range codings {
+		if !slices.Contains(r.Encodings, coding) {
+			return nil, nil
+		}
+	}
+	if len(codings) > r.MaxEncodingLayers {
+		return nil, caddyhttp.Error(http.StatusBadRequest, fmt.Errorf("%w: %d", errTooManyLayers, len(codings)))
+	}
+	return codings, nil
+}
+
+// decodePart writes the content of a part read from src, compressed
+// with codings, decoded to dst, up to limit bytes. It returns the
+// number of bytes written.
+func (r RequestUngzip) decodePart(dst io.Writer, src io.Reader, codings []string, limit int64) (int64, error) {
+	decoder, err := newLimitedDecoder(codings, src, nil, r.decodeLimits())
+	if err != nil {
+		return 0, caddyhttp.Error(http.StatusBadRequest, err)
+	}
+	defer decoder.Close()
+	n, err := copyChunked(dst, io.LimitReader(decoder, limit+1), r.CopyBufferSize)
+	if errors.Is(err, errInputLimit) {
+		return n, caddyhttp.Error(http.StatusRequestEntityTooLarge, err)
+	}
+	if err != nil {
+		return n, caddyhttp.Error(http.StatusBadRequest, err)
+	}
+	if n > limit {
+		return n, caddyhttp.Error(http.StatusRequestEntityTooLarge, errRequestTooLarge)
+	}
+	// anything after the end of the compressed data is dropped
+	_, err = io.Copy(io.Discard, src)
+	return n, err
+}
+
+// readPartHeader reads the header block of a part from br, up to and
+// including the blank line that ends it. complete is false if the end
+// was not found within maxPartHeaderSize bytes.
+func readPartHeader(br *bufio.Reader) (raw []byte, complete bool, err error) {
+	lineStart := 0
+	for len(raw) <= maxPartHeaderSize {
+		chunk, err := br.ReadSlice('\n')
+		raw = append(raw, chunk...)
+		if errors.Is(err, bufio.ErrBufferFull) {
+			continue
+		}
+		if err != nil {
+			return raw, false, err
+		}
+		line := raw[lineStart:]
+		lineStart = len(raw)
+		if len(bytes.TrimRight(line, "\r\n")) == 0 {
+			return raw, true, nil
+		}
+	}
+	return raw, false, nil
+}
+
+// stripPartHeader returns the header block raw without its
+// Content-Encoding and Content-Length fields, which no longer apply to
+// the decoded part.
+func stripPartHeader(raw []byte) []byte {
+	var out []byte
+	skipping := false
+	for len(raw) > 0 {
+		end := bytes.IndexByte(raw, '\n') + 1
+		if end == 0 {
+			end = len(raw)
+		}
+		line := raw[:end]
+		raw = raw[end:]
+		// a line starting with whitespace continues the field before it
+		if line[0] != ' ' && line[0] != '\t' {
+			name, _, _ := bytes.Cut(line, []byte(":"))
+			name = bytes.TrimSpace(name)
+			skipping = strings.EqualFold(string(name), "Content-Encoding") || strings.EqualFold(string(name), "Content-Length")
+		}
+		if !skipping {
+			out = append(out, line...)
+		}
+	}
+	return out
+}
+
+func ignoreEOF(err error) error {
+	if errors.Is(err, io.EOF) {
+		return nil
+	}
+	return err
+}
+
+// multipartBody is a multipart request body being rewritten as it is
+// read. Errors carry a status code and an error class, as those of
+// decodedBody do.
+type multipartBody struct {
+	req  *http.Request
+	pipe *io.PipeReader
+}
+
+func (b *multipartBody) Read(p []byte) (int, error) {
+	n, err := b.pipe.Read(p)
+	if err != nil && err != io.EOF {
+		err = classifiedError(b.req, http.StatusBadRequest, err)
+	}
+	return n, err
+}
+
+func (b *multipartBody) Close() error {
+	return b.pipe.Close()
+}
+
+// delimitedReader reads from r up to the first occurrence of delim,
+// which it leaves unread. found reports whether it was reached.
+type delimitedReader struct {
+	r     *bufio.Reader
+	delim []byte
+	found bool
+}
+
+func (d *delimitedReader) Read(p []byte) (int, error) {
+	if d.found {
+		return 0, io.EOF
+	}
+	peek, err := d.r.Peek(d.r.Size())
+	i := bytes.Index(peek, d.delim)
+	if i == 0 {
+		d.found = true
+		return 0, io.EOF
+	}
+	end := len(peek)
+	if i > 0 {
+		end = i
+	} else if err == nil {
+		// the end of the buffer may hold the start of delim
+		end -= len(d.delim) - 1
+	}
+	if end == 0 {
+		return 0, err
+	}
+	n := copy(p, peek[:end])
+	d.r.Discard(n)
+	return n, nil
+}
+
+// skipWriter drops the first skip bytes written to it.
+type skipWriter struct {
+	w    io.Writer
+	skip int
+}
+
+func (s *skipWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	if s.skip > 0 {
+		k := min(s.skip, len(p))
+		s.skip -= k
+		p = p[k:]
+	}
+	if len(p) > 0 {
+		if _, err := s.w.Write(p); err != nil {
+			return 0, err
+		}
+	}
+	return n, nil
+}
@@ -0,0 +1,216 @@
+package ungzip
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestDelimitedReader(t *testing.T) {
+	delim := []byte("\r\n--XY")
+	for _, tc := range []struct {
+		name  string
+		src   string
+		want  string
+		found bool
+	}{
+		{name: "empty", src: ""},
+		{name: "no delimiter", src: "content without one", want: "content without one"},
+		{name: "delimiter at the start", src: "\r\n--XY rest", want: "", found: true},
+		{name: "delimiter in the middle", src: "content\r\n--XY rest", want: "content", found: true},
+		{name: "delimiter at the end", src: "content\r\n--XY", want: "content", found: true},
+		// the reader's buffer is 16 bytes
+		{name: "delimiter across the buffer", src: "0123456789abcd\r\n--XY rest", want: "0123456789abcd", found: true},
+		{name: "delimiter after several buffers", src: strings.Repeat("0123456789", 10) + "\r\n--XY", want: strings.Repeat("0123456789", 10), found: true},
+		{name: "truncated delimiter", src: "content\r\n--X", want: "content\r\n--X"},
+		{name: "delimiter prefix in content", src: "a\r\n--XZ b\r\n--XY", want: "a\r\n--XZ b", found: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			br := bufio.NewReaderSize(strings.NewReader(tc.src), 16)
+			d := &delimitedReader{r: br, delim: delim}
+			got, err := io.ReadAll(d)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tc.want {
+				t.Errorf("got %q, want %q", got, tc.want)
+			}
+			if d.found != tc.found {
+				t.Errorf("got found %v, want %v", d.found, tc.found)
+			}
+			// the delimiter is left to be read
+			rest, _ := io.ReadAll(br)
+			if want := strings.TrimPrefix(tc.src, tc.want); string(rest) != want {
+				t.Errorf("left %q, want %q", rest, want)
+			}
+		})
+	}
+}
+
+func TestReadPartHeader(t *testing.T) {
+	// fields returns header fields of exactly n bytes
+	fields := func(n int) string {
+		var b strings.Builder
+		for n > 0 {
+			size := min(n, 1000)
+			if n-size < 9 {
+				size = n
+			}
+			b.WriteString("X-Pad: " + strings.Repeat("a", size-9) + "\r\n")
+			n -= size
+		}
+		return b.String()
+	}
+
+	for _, tc := range []struct {
+		name     string
+		src      string
+		raw      string
+		complete bool
+		err      error
+	}{
+		{name: "header block", src: "Content-Type: text/plain\r\n\r\nbody", raw: "Content-Type: text/plain\r\n\r\n", complete: true},
+		{name: "bare line feeds", src: "Content-Type: text/plain\n\nbody", raw: "Content-Type: text/plain\n\n", complete: true},
+		{name: "empty header block", src: "\r\nbody", raw: "\r\n", complete: true},
+		{name: "folded field", src: "X-A: one\r\n two\r\n\r\n", raw: "X-A: one\r\n two\r\n\r\n", complete: true},
+		{name: "long line", src: "X-Long: " + strings.Repeat("a", 10000) + "\r\n\r\n", raw: "X-Long: " + strings.Repeat("a", 10000) + "\r\n\r\n", complete: true},
+		{name: "fields filling the limit", src: fields(maxPartHeaderSize) + "\r\nbody", raw: fields(maxPartHeaderSize) + "\r\n", complete: true},
+		{name: "fields past the limit", src: fields(maxPartHeaderSize+1) + "\r\nbody", raw: fields(maxPartHeaderSize + 1)},
+		{name: "empty", src: "", err: io.EOF},
+		{name: "truncated before the blank line", src: "Content-Type: text/plain\r\n", raw: "Content-Type: text/plain\r\n", err: io.EOF},
+		{name: "truncated in a line", src: "Content-Type: te", raw: "Content-Type: te", err: io.EOF},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			raw, complete, err := readPartHeader(bufio.NewReader(strings.NewReader(tc.src)))
+			if err != tc.err {
+				t.Fatalf("got %v, want %v", err, tc.err)
+			}
+			if string(raw) != tc.raw {
+				t.Errorf("got %d bytes of header, want %d", len(raw), len(tc.raw))
+			}
+			if complete != tc.complete {
+				t.Errorf("got complete %v, want %v", complete, tc.complete)
+			}
+		})
+	}
+}
+
+func TestStripPartHeader(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		raw  string
+		want string
+	}{
+		{name: "empty", raw: "", want: ""},
+		{
+			name: "encoding fields",
+			raw:  "Content-Disposition: form-data; name=\"f\"\r\nContent-Encoding: gzip\r\nContent-Length: 10\r\n\r\n",
+			want: "Content-Disposition: form-data; name=\"f\"\r\n\r\n",
+		},
+		{name: "any case", raw: "content-encoding: gzip\r\nCONTENT-LENGTH: 10\r\n\r\n", want: "\r\n"},
+		{name: "space before the colon", raw: "Content-Encoding : gzip\r\n\r\n", want: "\r\n"},
+		{name: "similar names", raw: "Content-Encodings: gzip\r\nX-Content-Length: 1\r\n\r\n", want: "Content-Encodings: gzip\r\nX-Content-Length: 1\r\n\r\n"},
+		{name: "folded encoding field", raw: "Content-Encoding: gzip,\r\n\tbr\r\nContent-Type: a\r\n\r\n", want: "Content-Type: a\r\n\r\n"},
+		{name: "folded other field", raw: "Content-Type: a;\r\n b=c\r\nContent-Encoding: gzip\r\n\r\n", want: "Content-Type: a;\r\n b=c\r\n\r\n"},
+		{name: "bare line feeds", raw: "Content-Encoding: gzip\nContent-Type: a\n\n", want: "Content-Type: a\n\n"},
+		{name: "no final line feed", raw: "Content-Type: a\r\nContent-Encoding: gzip", want: "Content-Type: a\r\n"},
+		{name: "no colon", raw: "garbage\r\nContent-Encoding: gzip\r\n\r\n", want: "garbage\r\n\r\n"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := stripPartHeader([]byte(tc.raw)); string(got) != tc.want {
+				t.Errorf("got %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) { return 0, errors.New("write failed") }
+
+func TestSkipWriter(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		skip   int
+		writes []string
+		want   string
+	}{
+		{name: "nothing to skip", writes: []string{"abc"}, want: "abc"},
+		{name: "in one write", skip: 2, writes: []string{"\r\nabc"}, want: "abc"},
+		{name: "across writes", skip: 2, writes: []string{"\r", "\nabc"}, want: "abc"},
+		{name: "exactly the skip", skip: 2, writes: []string{"\r\n", "abc"}, want: "abc"},
+		{name: "empty writes", skip: 2, writes: []string{"", "\r\n", "", "a"}, want: "a"},
+		{name: "less than the skip", skip: 5, writes: []string{"ab", "c"}, want: ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			s := &skipWriter{w: &buf, skip: tc.skip}
+			for _, w := range tc.writes {
+				if n, err := s.Write([]byte(w)); n != len(w) || err != nil {
+					t.Fatalf("write of %d bytes: got %d, %v", len(w), n, err)
+				}
+			}
+			if buf.String() != tc.want {
+				t.Errorf("got %q, want %q", buf.String(), tc.want)
+			}
+		})
+	}
+
+	s := &skipWriter{w: failingWriter{}, skip: 2}
+	if _, err := s.Write([]byte("\r\n")); err != nil {
+		t.Errorf("skipped write: got %v", err)
+	}
+	if _, err := s.Write([]byte("a")); err == nil {
+		t.Error("failed write: got no error")
+	}
+}
+
+func TestRewriteMultipart(t *testing.T) {
+	text := strings.Repeat("multipart ", 100)
+	part := func(header, content string) string {
+		return "--XY\r\n" + header + "\r\n" + content + "\r\n"
+	}
+	encoded := part("Content-Disposition: form-data; name=\"f\"\r\nContent-Encoding: gzip\r\n", string(gzipped(t, []byte(text))))
+	decoded := part("Content-Disposition: form-data; name=\"f\"\r\n", text)
+	plain := part("Content-Disposition: form-data; name=\"g\"\r\n", "plain")
+
+	for _, tc := range []struct {
+		name    string
+		src     string
+		want    string
+		wantErr bool
+	}{
+		{name: "empty", src: "", want: ""},
+		{name: "no parts", src: "--XY--\r\n", want: "--XY--\r\n"},
+		{name: "encoded part", src: encoded + "--XY--\r\n", want: decoded + "--XY--\r\n"},
+		{name: "mixed parts", src: "preamble\r\n" + plain + encoded + plain + "--XY--\r\nepilogue", want: "preamble\r\n" + plain + decoded + plain + "--XY--\r\nepilogue"},
+		{name: "unknown encoding", src: part("Content-Encoding: br\r\n", "xx") + "--XY--\r\n", want: part("Content-Encoding: br\r\n", "xx") + "--XY--\r\n"},
+		{name: "no closing delimiter", src: plain, want: plain},
+		{name: "truncated in the header", src: "--XY\r\nContent-Type: a", want: "--XY\r\nContent-Type: a"},
+		{name: "truncated after the delimiter", src: "--XY", want: "--XY"},
+		{name: "truncated encoded part", src: encoded[:len(encoded)-10], wantErr: true},
+		{name: "corrupt encoded part", src: part("Content-Encoding: gzip\r\n", "not gzip") + "--XY--\r\n", wantErr: true},
+		{name: "too many layers", src: part("Content-Encoding: gzip, gzip, gzip\r\n", "xx") + "--XY--\r\n", wantErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := RequestUngzip{Encodings: []string{"gzip"}, MaxSize: 1 << 20, MaxEncodingLayers: 2}
+			var out bytes.Buffer
+			err := r.rewriteMultipart(&out, strings.NewReader(tc.src), "XY")
+			if tc.wantErr {
+				if err == nil {
+					t.Error("got no error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if out.String() != tc.want {
+				t.Errorf("got %q, want %q", out.String(), tc.want)
+			}
+		})
+	}
+}
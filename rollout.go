@@ -0,0 +1,31 @@
+package ungzip
+
+import (
+	"hash/fnv"
+	"math/rand/v2"
+	"net/http"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// inRollout reports whether req is among the rollout_percent of
+// requests to process, counting it in its cohort.
+func (r ResponseUngzip) inRollout(req *http.Request) bool {
+	// buckets of a hundredth of a percent
+	var bucket uint64
+	if r.RolloutKey == "" {
+		bucket = rand.Uint64N(10000)
+	} else {
+		repl := req.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+		h := fnv.New32a()
+		_, _ = h.Write([]byte(repl.ReplaceAll(r.RolloutKey, "")))
+		bucket = uint64(h.Sum32()) % 10000
+	}
+	in := float64(bucket) < r.RolloutPercent*100
+	cohort := "holdout"
+	if in {
+		cohort = "rollout"
+	}
+	r.metrics.observeRollout(r.metricsLabel(req), cohort)
+	return in
+}
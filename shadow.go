@@ -0,0 +1,176 @@
+package ungzip
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// Shadow sends a copy of every decompressed response to another
+// service, such as an analytics or indexing pipeline, or through
+// routes of its own. Copies are sent in the background, after the
+// client has been served, and are dropped rather than queued when too
+// many are already in flight. Responses that are streamed are not
+// copied.
+//
+// The copy is a POST with the decompressed body and the response's
+// Content-Type, along with the X-Shadow-Method, X-Shadow-Host,
+// X-Shadow-Uri and X-Shadow-Status headers describing the exchange.
+// Responses to copies sent through routes are discarded.
+type Shadow struct {
+	// URL to send copies to
+	URL string `json:"url,omitempty"`
+
+	// Routes to send copies through instead of to a URL
+	Routes caddyhttp.RouteList `json:"routes,omitempty"`
+
+	// Maximum time to spend sending one copy
+	// Default: 10s
+	Timeout caddy.Duration `json:"timeout,omitempty"`
+
+	// Maximum number of copies in flight
+	// Default: 16
+	MaxConcurrent int `json:"max_concurrent,omitempty"`
+
+	routes  caddyhttp.RouteList // Routes, which provisioning clears
+	ctx     context.Context
+	client  *http.Client
+	handler caddyhttp.Handler
+	slots   chan struct{}
+	logger  *zap.Logger
+}
+
+func (s *Shadow) provision(ctx caddy.Context, logger *zap.Logger) error {
+	if s.Timeout == 0 {
+		s.Timeout = caddy.Duration(10 * time.Second)
+	}
+	if s.MaxConcurrent == 0 {
+		s.MaxConcurrent = 16
+	}
+	s.ctx = ctx
+	s.client = &http.Client{Timeout: time.Duration(s.Timeout)}
+	s.slots = make(chan struct{}, s.MaxConcurrent)
+	s.logger = logger.Named("shadow")
+	if s.Routes != nil {
+		s.routes = slices.Clone(s.Routes)
+		if err := s.Routes.Provision(ctx); err != nil {
+			return fmt.Errorf("shadow routes: %v", err)
+		}
+		s.handler = s.Routes.Compile(caddyhttp.HandlerFunc(func(http.ResponseWriter, *http.Request) error {
+			return nil
+		}))
+	}
+	return nil
+}
+
+func (s *Shadow) validate() error {
+	if (s.URL == "") == (s.Routes == nil) {
+		return fmt.Errorf("shadow requires either a url or routes")
+	}
+	if s.Timeout < 0 || s.MaxConcurrent < 0 {
+		return fmt.Errorf("shadow timeout and max_concurrent cannot be negative")
+	}
+	return nil
+}
+
+// send sends a copy of the response to req in the background. body is
+// copied, so the caller may reuse it.
+func (s *Shadow) send(req *http.Request, status int, header http.Header, body []byte) {
+	select {
+	case s.slots <- struct{}{}:
+	default:
+		s.logger.Debug("too many copies in flight; dropping", zap.String("uri", req.RequestURI))
+		return
+	}
+
+	target := s.URL
+	if s.handler != nil {
+		target = req.URL.String()
+	}
+	out, err := http.NewRequestWithContext(s.ctx, http.MethodPost, target, bytes.NewReader(bytes.Clone(body)))
+	if err != nil {
+		<-s.slots
+		s.logger.Error("creating shadow request", zap.Error(err))
+		return
+	}
+	out.Header.Set("Content-Type", header.Get("Content-Type"))
+	out.Header.Set("X-Shadow-Method", req.Method)
+	out.Header.Set("X-Shadow-Host", req.Host)
+	out.Header.Set("X-Shadow-Uri", req.RequestURI)
+	if status == 0 {
+		status = http.StatusOK
+	}
+	out.Header.Set("X-Shadow-Status", strconv.Itoa(status))
+
+	if s.handler != nil {
+		go func() {
+			defer func() { <-s.slots }()
+			s.route(req, out)
+		}()
+		return
+	}
+	go func() {
+		defer func() { <-s.slots }()
+		resp, err := s.client.Do(out)
+		if err != nil {
+			s.logger.Warn("sending shadow copy", zap.String("uri", req.RequestURI), zap.Error(err))
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			s.logger.Warn("shadow copy rejected",
+				zap.String("uri", req.RequestURI),
+				zap.Int("status", resp.StatusCode))
+		}
+	}()
+}
+
+// route sends the copy out of the response to req through the routes.
+func (s *Shadow) route(req, out *http.Request) {
+	ctx, cancel := context.WithTimeout(out.Context(), time.Duration(s.Timeout))
+	defer cancel()
+	out = out.WithContext(ctx)
+	out.RemoteAddr = req.RemoteAddr
+	out.Host = req.Host
+	server, _ := req.Context().Value(caddyhttp.ServerCtxKey).(*caddyhttp.Server)
+	w := &discardResponse{header: make(http.Header)}
+	out = caddyhttp.PrepareRequest(out, caddy.NewReplacer(), w, server)
+	if err := s.handler.ServeHTTP(w, out); err != nil {
+		s.logger.Warn("routing shadow copy", zap.String("uri", req.RequestURI), zap.Error(err))
+		return
+	}
+	if w.status >= 300 {
+		s.logger.Warn("shadow copy rejected",
+			zap.String("uri", req.RequestURI),
+			zap.Int("status", w.status))
+	}
+}
+
+// discardResponse is the response writer of copies sent through
+// routes. It keeps the status only.
+type discardResponse struct {
+	header http.Header
+	status int
+}
+
+func (d *discardResponse) Header() http.Header { return d.header }
+
+func (d *discardResponse) WriteHeader(status int) {
+	if d.status == 0 {
+		d.status = status
+	}
+}
+
+func (d *discardResponse) Write(p []byte) (int, error) {
+	d.WriteHeader(http.StatusOK)
+	return len(p), nil
+}
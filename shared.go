@@ -0,0 +1,104 @@
+package ungzip
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// shared holds the caches and worker pools of handlers across config
+// reloads. A reload provisions the new handlers before cleaning up the
+// old ones, so state whose key is unchanged carries over: caches keep
+// their entries and pools their goroutines.
+//
+// Keys are made of settings only, since a handler has nothing else
+// that stays the same across reloads, so state is shared process-wide:
+// every handler with the same workers and worker_queue uses one pool,
+// every one with the same range_index_size one range index, and so on.
+// Entries are keyed by host and URI, and are only used for a response
+// with the same validator (range indexes check theirs with If-Range),
+// so handlers that share state compete for its room but do not serve
+// each other's entries for other resources.
+var shared = caddy.NewUsagePool()
+
+// sharedKey returns the key of a piece of shared state of the given
+// kind, which is the same for any handler with the same settings.
+func sharedKey(kind string, settings ...any) string {
+	text, _ := json.Marshal(settings)
+	sum := sha256.Sum256(text)
+	return kind + "/" + hex.EncodeToString(sum[:])
+}
+
+// outputSettings are the settings that decompressed bodies depend on.
+// Caches are kept as long as these and their size stay the same.
+func (r *ResponseUngzip) outputSettings() []any {
+	return []any{r.Encodings, r.MaxEncodingLayers, r.ZstdDictionaries, r.filtersRaw}
+}
+
+// provisionShared sets up the caches and worker pool of r, reusing
+// those of a handler with the same settings from the previous config.
+func (r *ResponseUngzip) provisionShared() error {
+	if r.Workers > 0 {
+		key := sharedKey("pool", r.Workers, r.WorkerQueue)
+		pool, _, err := shared.LoadOrNew(key, func() (caddy.Destructor, error) {
+			return newWorkerPool(r.Workers, r.WorkerQueue), nil
+		})
+		if err != nil {
+			return fmt.Errorf("creating worker pool: %v", err)
+		}
+		r.pool, r.sharedKeys = pool.(*workerPool), append(r.sharedKeys, key)
+	}
+	if r.RecompressCacheSize > 0 {
+		key := sharedKey("recompress_cache", r.RecompressCacheSize, r.Recompress, r.outputSettings())
+		cache, _, err := shared.LoadOrNew(key, func() (caddy.Destructor, error) {
+			return newLRUCache(r.RecompressCacheSize), nil
+		})
+		if err != nil {
+			return fmt.Errorf("creating recompress cache: %v", err)
+		}
+		r.recompressCache, r.sharedKeys = cache.(*lruCache), append(r.sharedKeys, key)
+	}
+	if r.RangeIndexSize > 0 {
+		key := sharedKey("range_index", r.RangeIndexSize)
+		index, _, err := shared.LoadOrNew(key, func() (caddy.Destructor, error) {
+			return newLRUCache(r.RangeIndexSize), nil
+		})
+		if err != nil {
+			return fmt.Errorf("creating range index: %v", err)
+		}
+		r.rangeIndex, r.sharedKeys = index.(*lruCache), append(r.sharedKeys, key)
+	}
+	if r.CacheSize > 0 {
+		key := sharedKey("cache", r.CacheSize, r.outputSettings())
+		cache, _, err := shared.LoadOrNew(key, func() (caddy.Destructor, error) {
+			return newLRUCache(r.CacheSize), nil
+		})
+		if err != nil {
+			return fmt.Errorf("creating cache: %v", err)
+		}
+		r.cache, r.sharedKeys = cache.(*lruCache), append(r.sharedKeys, key)
+	}
+	return nil
+}
+
+// cleanupShared releases the shared state of r, which is destroyed
+// once no handler of the current config uses it.
+func (r *ResponseUngzip) cleanupShared() {
+	for _, key := range r.sharedKeys {
+		_, _ = shared.Delete(key)
+	}
+}
+
+// Destruct implements caddy.Destructor.
+func (p *workerPool) Destruct() error {
+	p.stop()
+	return nil
+}
+
+// Destruct implements caddy.Destructor.
+func (c *lruCache) Destruct() error {
+	return nil
+}
@@ -0,0 +1,81 @@
+package ungzip
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func TestSharedCacheAcrossReload(t *testing.T) {
+	// with the filter config as provisioning saves it
+	provision := func(filter string) *ResponseUngzip {
+		t.Helper()
+		h := &ResponseUngzip{
+			Recompress:          []string{"gzip"},
+			RecompressCacheSize: 1 << 20,
+			filtersRaw:          []json.RawMessage{json.RawMessage(filter)},
+		}
+		if err := h.provisionShared(); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(h.cleanupShared)
+		return h
+	}
+
+	old := provision(`{"filter":"json_format","mode":"compact"}`)
+	same := provision(`{"filter":"json_format","mode":"compact"}`)
+	changed := provision(`{"filter":"json_format","mode":"pretty"}`)
+	if same.recompressCache != old.recompressCache {
+		t.Error("cache not kept across a reload with the same filters")
+	}
+	if changed.recompressCache == old.recompressCache {
+		t.Error("cache kept across a reload that changed filters")
+	}
+}
+
+func TestSharedPoolAcrossReload(t *testing.T) {
+	provision := func(h *ResponseUngzip) *ResponseUngzip {
+		t.Helper()
+		ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+		t.Cleanup(cancel)
+		if err := h.Provision(ctx); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { _ = h.Cleanup() })
+		return h
+	}
+
+	old := provision(&ResponseUngzip{Workers: 2})
+	same := provision(&ResponseUngzip{Workers: 2, HideHeaders: []string{"X-Compressed-By"}})
+	changed := provision(&ResponseUngzip{Workers: 4})
+	if same.pool != old.pool {
+		t.Error("pool not kept across a reload that changed unrelated options")
+	}
+	if changed.pool == old.pool {
+		t.Error("pool kept across a reload that changed workers")
+	}
+}
+
+func TestSharedAcrossHandlers(t *testing.T) {
+	provision := func(h *ResponseUngzip) *ResponseUngzip {
+		t.Helper()
+		if err := h.provisionShared(); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(h.cleanupShared)
+		return h
+	}
+
+	// two handlers of one config, in different routes
+	a := provision(&ResponseUngzip{Workers: 3, RangeIndexSize: 1 << 16})
+	b := provision(&ResponseUngzip{Workers: 3, RangeIndexSize: 1 << 16})
+	if a.pool != b.pool || a.rangeIndex != b.rangeIndex {
+		t.Error("handlers with the same settings do not share state")
+	}
+	c := provision(&ResponseUngzip{Workers: 3, WorkerQueue: 8, RangeIndexSize: 1 << 17})
+	if c.pool == a.pool || c.rangeIndex == a.rangeIndex {
+		t.Error("handlers with different settings share state")
+	}
+}
@@ -0,0 +1,173 @@
+package ungzip
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"hash"
+	"io"
+	"net/http"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// serveStream writes the decompressed form of the body buffered in rec,
+// compressed with codings, to w as it is produced. Decompression runs
+// in its own goroutine feeding an io.Pipe, so inflating the next chunk
+// overlaps with writing the previous one to the network. The pipe is
+// unbuffered, which means the decoder never gets further ahead of a
+// slow client than a single write; if the client goes away, the request
+// context closes the pipe and the decoder stops.
+func (r ResponseUngzip) serveStream(w http.ResponseWriter, req *http.Request, rec caddyhttp.ResponseRecorder, codings []string, costLabel string) error {
+	src := rec.Buffer().Bytes()
+
+	// Check the stream header before committing to a response, so that
+	// obviously bad bodies are still subject to the error policy.
+	reader, err := r.newReader(codings, bytes.NewReader(src))
+	if err != nil {
+		return r.fail(req, rec, err)
+	}
+	reader.Close()
+
+	pr, pw := io.Pipe()
+	done := make(chan error, 1)
+	start := time.Now()
+	go func() {
+		err := r.transform(pw, codings, src)
+		pw.CloseWithError(err)
+		done <- err
+	}()
+
+	stop := context.AfterFunc(req.Context(), func() {
+		pr.CloseWithError(req.Context().Err())
+	})
+
+	rec.Header().Del("Content-Encoding")
+	rec.Header().Del("Content-Length")
+	r.transformedHeaders(req, rec.Header())
+	if r.DigestHeader != "" {
+		// the digest is known only once the body is sent
+		rec.Header().Add("Trailer", r.DigestHeader)
+	}
+
+	status := rec.Status()
+	if status == 0 {
+		status = http.StatusOK
+	}
+	w.WriteHeader(status)
+
+	var dst io.Writer = w
+	if r.FlushInterval != 0 {
+		dst = &flushWriter{w: w, interval: time.Duration(r.FlushInterval)}
+	}
+	dst = r.output(dst, req)
+	var hasher hash.Hash
+	if r.auditLogger != nil || r.DigestHeader != "" {
+		hasher = sha256.New()
+		dst = io.MultiWriter(dst, hasher)
+	}
+	var captured *captureWriter
+	if r.CaptureSize > 0 {
+		captured = &captureWriter{limit: int(r.CaptureSize)}
+		dst = io.MultiWriter(dst, captured)
+	}
+	n, copyErr := copyChunked(dst, pr, r.CopyBufferSize)
+
+	// src belongs to a pooled buffer, so the decoder must be finished
+	// with it before we return.
+	stop()
+	pr.Close()
+	decodeErr := <-done
+
+	// A closed pipe only means the copy stopped first, and a canceled
+	// one that the client went away; the copy's own error is the one
+	// worth reporting then.
+	if decodeErr != nil && !errors.Is(decodeErr, io.ErrClosedPipe) && !r.clientGone(req, decodeErr) {
+		r.healthStats.record(false)
+		r.decisions.add(req, "failed", decodeErr.Error())
+		r.noteDebug(req, "failed", decodeErr.Error())
+		r.observeUpstream(req, "failed")
+		r.logger.Error("decompressing streamed response",
+			zap.String("uri", req.RequestURI),
+			zap.String("upstream", upstreamHostport(req)),
+			zap.Error(decodeErr))
+		if r.QuarantineDir != "" {
+			r.quarantine(req, rec, decodeErr)
+		}
+		// The status is already on the wire, so returning would end the
+		// body cleanly and pass it off as complete. Aborting drops the
+		// connection (or resets the stream) instead, which the client
+		// sees as a truncated response.
+		panic(http.ErrAbortHandler)
+	}
+	if copyErr != nil {
+		return copyErr
+	}
+	if r.DigestHeader != "" {
+		w.Header().Set(r.DigestHeader, r.digestValue(hasher.Sum(nil)))
+	}
+	if err := flush(w); err != nil {
+		return err
+	}
+
+	if captured != nil {
+		r.capture(req, captured.buf)
+	}
+
+	elapsed := time.Since(start)
+	r.observeSize(req, len(src), int(n))
+	r.metrics.observeCost(r.metricsLabel(req), costLabel, int(n), elapsed)
+	if r.auditLogger != nil {
+		r.audit(req, len(src), int(n), hasher.Sum(nil), elapsed)
+	}
+	r.healthStats.record(true)
+	r.logDecision(req, "decompressed", "stream")
+	return nil
+}
+
+// clientGone reports whether err is that of the context of req, which
+// ends when the client goes away.
+func (ResponseUngzip) clientGone(req *http.Request, err error) bool {
+	if errors.Is(err, context.Canceled) {
+		return true
+	}
+	ctxErr := req.Context().Err()
+	return ctxErr != nil && errors.Is(err, ctxErr)
+}
+
+// flushWriter flushes w after writes, at most once per interval.
+// A negative interval flushes after every write.
+type flushWriter struct {
+	w         http.ResponseWriter
+	interval  time.Duration
+	lastFlush time.Time
+}
+
+func (f *flushWriter) Write(p []byte) (int, error) {
+	n, err := f.w.Write(p)
+	if err != nil {
+		return n, err
+	}
+	if f.interval < 0 || time.Since(f.lastFlush) >= f.interval {
+		f.lastFlush = time.Now()
+		err = flush(f.w)
+	}
+	return n, err
+}
+
+// captureWriter keeps the first limit bytes written to it.
+type captureWriter struct {
+	buf   []byte
+	limit int
+}
+
+func (c *captureWriter) Write(p []byte) (int, error) {
+	if room := c.limit - len(c.buf); room > 0 {
+		c.buf = append(c.buf, p[:min(room, len(p))]...)
+	}
+	return len(p), nil
+}
@@ -0,0 +1,99 @@
+package ungzip
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// disconnectingWriter stands for a client that goes away after the
+// first write of the body.
+type disconnectingWriter struct {
+	*httptest.ResponseRecorder
+	cancel context.CancelFunc
+}
+
+func (d disconnectingWriter) Write(p []byte) (int, error) {
+	d.cancel()
+	return d.ResponseRecorder.Write(p)
+}
+
+func TestStreamClientDisconnect(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	dir := t.TempDir()
+	h := ResponseUngzip{Stream: true, QuarantineDir: dir}
+	if err := h.Provision(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer h.Cleanup()
+
+	reqCtx, disconnect := context.WithCancel(context.Background())
+	defer disconnect()
+	req := httptest.NewRequest(http.MethodGet, "/", nil).WithContext(reqCtx)
+	req = caddyhttp.PrepareRequest(req, caddyhttp.NewTestReplacer(req), nil, nil)
+	w := disconnectingWriter{ResponseRecorder: httptest.NewRecorder(), cancel: disconnect}
+	body := gzipped(t, []byte(strings.Repeat("streamed ", 1<<20)))
+	upstream := fixture{header: map[string]string{"Content-Encoding": "gzip"}, body: body}
+	_ = h.ServeHTTP(w, req, upstream)
+
+	h.healthStats.mu.Lock()
+	failed := h.healthStats.failed[0]
+	h.healthStats.mu.Unlock()
+	if failed != 0 {
+		t.Errorf("disconnect recorded as %d decode failures", failed)
+	}
+	if entries, err := os.ReadDir(dir); err != nil || len(entries) != 0 {
+		t.Errorf("quarantined %d bodies (%v)", len(entries), err)
+	}
+}
+
+// TestStreamDecodeErrorAborts checks that a body that turns out to be
+// corrupt only after the status has been sent reaches the client as a
+// truncated response rather than a complete one, on every protocol.
+func TestStreamDecodeErrorAborts(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	h := ResponseUngzip{Stream: true}
+	if err := h.Provision(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer h.Cleanup()
+
+	// a bad CRC only shows once the whole stream has been inflated
+	body := gzipped(t, []byte(strings.Repeat("streamed ", 1<<16)))
+	body[len(body)-8] ^= 0xff
+	upstream := fixture{header: map[string]string{"Content-Encoding": "gzip"}, body: body}
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		req = caddyhttp.PrepareRequest(req, caddyhttp.NewTestReplacer(req), nil, nil)
+		_ = h.ServeHTTP(w, req, upstream)
+	})
+
+	for proto, c := range protocolClients(t, handler) {
+		t.Run(proto, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, c.url, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Accept-Encoding", "gzip")
+			resp, err := c.client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				t.Errorf("got status %d, want %d", resp.StatusCode, http.StatusOK)
+			}
+			if _, err := io.ReadAll(resp.Body); err == nil {
+				t.Error("read a corrupt stream to the end without error")
+			}
+		})
+	}
+}
@@ -0,0 +1,57 @@
+package ungzip
+
+import (
+	"context"
+	"io"
+	"time"
+)
+
+// throttledWriter limits writes to w to rate bytes per second, averaged
+// since the first write. Large writes are split into chunks of about a
+// tenth of a second each so the output is paced evenly.
+type throttledWriter struct {
+	w       io.Writer
+	ctx     context.Context
+	rate    int64
+	start   time.Time
+	written int64
+}
+
+func newThrottledWriter(ctx context.Context, w io.Writer, rate int64) *throttledWriter {
+	return &throttledWriter{w: w, ctx: ctx, rate: rate}
+}
+
+func (t *throttledWriter) Write(p []byte) (int, error) {
+	if t.start.IsZero() {
+		t.start = time.Now()
+	}
+	chunk := int(max(t.rate/10, 1))
+	var total int
+	for len(p) > 0 {
+		n, err := t.w.Write(p[:min(len(p), chunk)])
+		total += n
+		t.written += int64(n)
+		if err != nil {
+			return total, err
+		}
+		p = p[n:]
+
+		if wait := time.Until(t.start.Add(t.elapsed())); wait > 0 {
+			timer := time.NewTimer(wait)
+			select {
+			case <-timer.C:
+			case <-t.ctx.Done():
+				timer.Stop()
+				return total, t.ctx.Err()
+			}
+		}
+	}
+	return total, nil
+}
+
+// elapsed returns how long writing what has been written so far takes
+// at the rate. The product of bytes and nanoseconds would overflow an
+// int64 past 9.2GB, so it is worked out in floating point.
+func (t *throttledWriter) elapsed() time.Duration {
+	return time.Duration(float64(t.written) / float64(t.rate) * float64(time.Second))
+}
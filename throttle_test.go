@@ -0,0 +1,30 @@
+package ungzip
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestThrottleElapsed(t *testing.T) {
+	for _, tc := range []struct {
+		written, rate int64
+		want          time.Duration
+	}{
+		{written: 0, rate: 1000, want: 0},
+		{written: 500, rate: 1000, want: 500 * time.Millisecond},
+		// the last byte count whose product with a second fits an int64
+		{written: math.MaxInt64 / int64(time.Second), rate: 1 << 30, want: 8589934591 * time.Nanosecond},
+		// and those past it
+		{written: math.MaxInt64/int64(time.Second) + 1, rate: 1 << 30, want: 8589934592 * time.Nanosecond},
+		{written: 10 << 30, rate: 1 << 30, want: 10 * time.Second},
+		{written: 1 << 40, rate: 1 << 20, want: 1 << 20 * time.Second},
+	} {
+		w := &throttledWriter{rate: tc.rate, written: tc.written}
+		got := w.elapsed()
+		// within a microsecond, for the rounding of floating point
+		if diff := got - tc.want; diff < -time.Microsecond || diff > time.Microsecond {
+			t.Errorf("%d bytes at %d/s: got %v, want %v", tc.written, tc.rate, got, tc.want)
+		}
+	}
+}
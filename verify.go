@@ -0,0 +1,149 @@
+package ungzip
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+var (
+	errVerifyMissing = errors.New("response has no digest or signature to verify")
+	errVerifyFailed  = errors.New("response failed verification")
+)
+
+// Verify checks a digest or signature the upstream sends along with a
+// response against its compressed body, before the body is decoded in
+// any way, so that tampered content is rejected with a 502 rather than
+// served. This is meant for mirrors of signed artifacts.
+//
+// The header holds the digest or signature in hex or base64, or as an
+// RFC 9530 dictionary like Content-Digest, with the algorithm name as
+// the key of the entry to use.
+type Verify struct {
+	// Response header carrying the digest or signature, such as
+	// "Content-Digest" or "X-Signature"
+	Header string `json:"header"`
+
+	// Algorithm the header value was made with: "sha-256" for a plain
+	// digest, "hmac-sha256" or "ed25519" for a signature
+	Algorithm string `json:"algorithm"`
+
+	// Key for signatures: the shared secret for hmac-sha256, or the
+	// base64 public key for ed25519. Placeholders such as {env.KEY}
+	// are replaced once, when the config is loaded
+	Key string `json:"key,omitempty"`
+
+	// Pass on responses that carry no digest or signature at all as
+	// they would be otherwise. Those that carry a bad one are still
+	// rejected
+	AllowMissing bool `json:"allow_missing,omitempty"`
+
+	key []byte
+}
+
+func (v *Verify) provision() error {
+	key := caddy.NewReplacer().ReplaceKnown(v.Key, "")
+	switch v.Algorithm {
+	case "hmac-sha256":
+		v.key = []byte(key)
+	case "ed25519":
+		pub, err := base64.StdEncoding.DecodeString(key)
+		if err != nil {
+			return fmt.Errorf("decoding verify key: %v", err)
+		}
+		if len(pub) != ed25519.PublicKeySize {
+			return fmt.Errorf("verify key is %d bytes, not an ed25519 public key", len(pub))
+		}
+		v.key = pub
+	}
+	return nil
+}
+
+func (v *Verify) validate() error {
+	if v.Header == "" {
+		return fmt.Errorf("verify header is required")
+	}
+	switch v.Algorithm {
+	case "sha-256":
+		if v.Key != "" {
+			return fmt.Errorf("verify algorithm sha-256 takes no key")
+		}
+	case "hmac-sha256", "ed25519":
+		if v.Key == "" {
+			return fmt.Errorf("verify algorithm %s requires a key", v.Algorithm)
+		}
+	default:
+		return fmt.Errorf("unrecognized verify algorithm: %s", v.Algorithm)
+	}
+	return nil
+}
+
+// check verifies body against the digest or signature in header.
+func (v *Verify) check(header http.Header, body []byte) error {
+	value := header.Get(v.Header)
+	if value == "" {
+		if v.AllowMissing {
+			return nil
+		}
+		return errVerifyMissing
+	}
+	sig, ok := v.decode(value)
+	if !ok {
+		return errVerifyFailed
+	}
+	var valid bool
+	switch v.Algorithm {
+	case "sha-256":
+		sum := sha256.Sum256(body)
+		valid = hmac.Equal(sig, sum[:])
+	case "hmac-sha256":
+		mac := hmac.New(sha256.New, v.key)
+		mac.Write(body)
+		valid = hmac.Equal(sig, mac.Sum(nil))
+	case "ed25519":
+		valid = ed25519.Verify(v.key, body, sig)
+	}
+	if !valid {
+		return errVerifyFailed
+	}
+	return nil
+}
+
+// decode returns the digest or signature in the header value.
+func (v *Verify) decode(value string) ([]byte, bool) {
+	if strings.Contains(value, "=:") {
+		// an RFC 9530 dictionary of byte sequences
+		for _, entry := range strings.Split(value, ",") {
+			name, seq, _ := strings.Cut(strings.TrimSpace(entry), "=")
+			if name != v.Algorithm || len(seq) < 2 || seq[0] != ':' || seq[len(seq)-1] != ':' {
+				continue
+			}
+			sig, err := base64.StdEncoding.DecodeString(seq[1 : len(seq)-1])
+			return sig, err == nil
+		}
+		return nil, false
+	}
+	// hex and base64 overlap, but the size tells them apart
+	size := sha256.Size
+	if v.Algorithm == "ed25519" {
+		size = ed25519.SignatureSize
+	}
+	value = strings.TrimSpace(value)
+	if sig, err := hex.DecodeString(value); err == nil && len(sig) == size {
+		return sig, true
+	}
+	for _, enc := range []*base64.Encoding{base64.StdEncoding, base64.RawStdEncoding, base64.URLEncoding, base64.RawURLEncoding} {
+		if sig, err := enc.DecodeString(value); err == nil && len(sig) == size {
+			return sig, true
+		}
+	}
+	return nil, false
+}
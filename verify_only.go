@@ -0,0 +1,41 @@
+package ungzip
+
+import (
+	"net/http"
+
+	"go.uber.org/zap"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// serveVerifyOnly decodes the buffered response in rec, compressed with
+// codings, to check that it is well formed, then sends it as it is
+// whatever the outcome.
+func (r ResponseUngzip) serveVerifyOnly(req *http.Request, rec caddyhttp.ResponseRecorder, codings []string) error {
+	var size byteCounter
+	if err := r.transform(&size, codings, rec.Buffer().Bytes()); err != nil {
+		r.healthStats.record(false)
+		r.metrics.observeVerified(r.metricsLabel(req), "broken")
+		r.observeUpstream(req, "failed")
+		r.logger.Error("verifying response",
+			zap.String("uri", req.RequestURI),
+			zap.String("upstream", upstreamHostport(req)),
+			zap.Error(err))
+		if r.QuarantineDir != "" {
+			r.quarantine(req, rec, err)
+		}
+		return r.passthrough(req, rec, "verify_only_failed")
+	}
+	r.healthStats.record(true)
+	r.metrics.observeVerified(r.metricsLabel(req), "ok")
+	r.observeSize(req, rec.Buffer().Len(), int(size))
+	return r.passthrough(req, rec, "verify_only")
+}
+
+// byteCounter counts the bytes written to it and discards them.
+type byteCounter int64
+
+func (c *byteCounter) Write(p []byte) (int, error) {
+	*c += byteCounter(len(p))
+	return len(p), nil
+}
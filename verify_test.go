@@ -0,0 +1,132 @@
+package ungzip
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestVerifyCheck(t *testing.T) {
+	body := []byte("verified body")
+	digest := sha256.Sum256(body)
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write(body)
+	hmacSum := mac.Sum(nil)
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig := ed25519.Sign(priv, body)
+	b64 := base64.StdEncoding.EncodeToString
+
+	sha := Verify{Header: "Content-Digest", Algorithm: "sha-256"}
+	hmacVerify := Verify{Header: "X-Signature", Algorithm: "hmac-sha256", Key: "secret"}
+	ed := Verify{Header: "X-Signature", Algorithm: "ed25519", Key: b64(pub)}
+
+	for _, tc := range []struct {
+		name   string
+		verify Verify
+		value  string
+		body   []byte
+		want   error
+	}{
+		{name: "hex", verify: sha, value: hex.EncodeToString(digest[:])},
+		{name: "upper case hex", verify: sha, value: strings.ToUpper(hex.EncodeToString(digest[:]))},
+		{name: "base64", verify: sha, value: b64(digest[:])},
+		{name: "unpadded base64", verify: sha, value: base64.RawStdEncoding.EncodeToString(digest[:])},
+		{name: "url base64", verify: sha, value: base64.URLEncoding.EncodeToString(digest[:])},
+		{name: "surrounding space", verify: sha, value: " " + hex.EncodeToString(digest[:]) + " "},
+		{name: "dictionary", verify: sha, value: "sha-256=:" + b64(digest[:]) + ":"},
+		{name: "dictionary, second entry", verify: sha, value: "sha-512=:AAAA:, sha-256=:" + b64(digest[:]) + ":"},
+		{name: "missing", verify: sha, want: errVerifyMissing},
+		{name: "missing allowed", verify: Verify{Header: "Content-Digest", Algorithm: "sha-256", AllowMissing: true}},
+		{name: "bad digest allowed missing", verify: Verify{Header: "Content-Digest", Algorithm: "sha-256", AllowMissing: true}, value: hex.EncodeToString(make([]byte, sha256.Size)), want: errVerifyFailed},
+		{name: "wrong digest", verify: sha, value: hex.EncodeToString(digest[:]), body: []byte("tampered body"), want: errVerifyFailed},
+		{name: "empty body", verify: sha, value: hex.EncodeToString(digest[:]), body: []byte{}, want: errVerifyFailed},
+		{name: "truncated hex", verify: sha, value: hex.EncodeToString(digest[:])[:63], want: errVerifyFailed},
+		{name: "short hex", verify: sha, value: hex.EncodeToString(digest[:31]), want: errVerifyFailed},
+		{name: "long hex", verify: sha, value: hex.EncodeToString(append(digest[:], 0)), want: errVerifyFailed},
+		{name: "truncated base64", verify: sha, value: b64(digest[:])[:20], want: errVerifyFailed},
+		{name: "not an encoding", verify: sha, value: "not a digest", want: errVerifyFailed},
+		{name: "dictionary without the algorithm", verify: sha, value: "sha-512=:" + b64(digest[:]) + ":", want: errVerifyFailed},
+		{name: "dictionary, unterminated", verify: sha, value: "sha-256=:" + b64(digest[:]), want: errVerifyFailed},
+		{name: "dictionary, bad base64", verify: sha, value: "sha-256=:!!!:", want: errVerifyFailed},
+		{name: "dictionary, empty", verify: sha, value: "sha-256=:", want: errVerifyFailed},
+		{name: "hmac", verify: hmacVerify, value: hex.EncodeToString(hmacSum)},
+		{name: "hmac with the wrong key", verify: Verify{Header: "X-Signature", Algorithm: "hmac-sha256", Key: "other"}, value: hex.EncodeToString(hmacSum), want: errVerifyFailed},
+		{name: "hmac given a plain digest", verify: hmacVerify, value: hex.EncodeToString(digest[:]), want: errVerifyFailed},
+		{name: "ed25519", verify: ed, value: b64(sig)},
+		{name: "ed25519 hex", verify: ed, value: hex.EncodeToString(sig)},
+		{name: "ed25519 tampered", verify: ed, value: b64(sig), body: []byte("tampered body"), want: errVerifyFailed},
+		{name: "ed25519 truncated", verify: ed, value: b64(sig[:ed25519.SignatureSize-1]), want: errVerifyFailed},
+		{name: "ed25519 given a digest", verify: ed, value: hex.EncodeToString(digest[:]), want: errVerifyFailed},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			v := tc.verify
+			if err := v.validate(); err != nil {
+				t.Fatal(err)
+			}
+			if err := v.provision(); err != nil {
+				t.Fatal(err)
+			}
+			header := http.Header{}
+			if tc.value != "" {
+				header.Set(v.Header, tc.value)
+			}
+			b := tc.body
+			if b == nil {
+				b = body
+			}
+			if err := v.check(header, b); err != tc.want {
+				t.Errorf("got %v, want %v", err, tc.want)
+			}
+		})
+	}
+}
+
+func TestVerifyConfig(t *testing.T) {
+	pub, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("UNGZIP_VERIFY_KEY", base64.StdEncoding.EncodeToString(pub))
+
+	for _, tc := range []struct {
+		name    string
+		verify  Verify
+		wantErr string
+	}{
+		{name: "sha-256", verify: Verify{Header: "Content-Digest", Algorithm: "sha-256"}},
+		{name: "hmac", verify: Verify{Header: "X-Signature", Algorithm: "hmac-sha256", Key: "secret"}},
+		{name: "ed25519 from the environment", verify: Verify{Header: "X-Signature", Algorithm: "ed25519", Key: "{env.UNGZIP_VERIFY_KEY}"}},
+		{name: "no header", verify: Verify{Algorithm: "sha-256"}, wantErr: "header is required"},
+		{name: "unknown algorithm", verify: Verify{Header: "X-Signature", Algorithm: "md5"}, wantErr: "unrecognized"},
+		{name: "sha-256 with a key", verify: Verify{Header: "Content-Digest", Algorithm: "sha-256", Key: "secret"}, wantErr: "takes no key"},
+		{name: "hmac without a key", verify: Verify{Header: "X-Signature", Algorithm: "hmac-sha256"}, wantErr: "requires a key"},
+		{name: "ed25519 key not base64", verify: Verify{Header: "X-Signature", Algorithm: "ed25519", Key: "not base64!"}, wantErr: "decoding verify key"},
+		{name: "ed25519 key truncated", verify: Verify{Header: "X-Signature", Algorithm: "ed25519", Key: base64.StdEncoding.EncodeToString(pub[:31])}, wantErr: "31 bytes"},
+		{name: "ed25519 key unset", verify: Verify{Header: "X-Signature", Algorithm: "ed25519", Key: "{env.UNGZIP_VERIFY_UNSET}"}, wantErr: "0 bytes"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			v := tc.verify
+			err := v.validate()
+			if err == nil {
+				err = v.provision()
+			}
+			if tc.wantErr == "" {
+				if err != nil {
+					t.Errorf("got %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("got %v, want an error containing %q", err, tc.wantErr)
+			}
+		})
+	}
+}
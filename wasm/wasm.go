@@ -0,0 +1,226 @@
+// Package wasm provides the wasm filter for the response_ungzip
+// handler. It lives in its own module so that the WebAssembly runtime
+// is only compiled into Caddy builds that ask for it:
+//
+//	xcaddy build --with github.com/danielballan/caddy-ungzip/wasm
+package wasm
+
+import (
+	"context"
+	"fmt"
+	"mime"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+
+	ungzip "github.com/danielballan/caddy-ungzip"
+)
+
+func init() {
+	caddy.RegisterModule(WASM{})
+}
+
+// WASM is a filter that hands decompressed bodies to a sandboxed
+// WebAssembly module for transformation. Every response gets a fresh
+// instance of the module, with capped memory and execution time and
+// only the WASI imports (without filesystem or network access).
+//
+// The module must export its memory and two functions:
+//
+//	alloc(size i32) -> ptr i32
+//	transform(ptr i32, size i32) -> i64
+//
+// The body is written to the memory returned by alloc, then transform
+// is called with it. transform returns the location of the new body
+// packed as ptr<<32 | size, or 0 to leave the body as it was.
+type WASM struct {
+	// Path to the .wasm file
+	Path string `json:"path"`
+
+	// Media types of bodies to transform
+	// Default: all
+	MIMETypes []string `json:"mime_types,omitempty"`
+
+	// Maximum memory for each instance, in 64KiB pages
+	// Default: 256 (16MiB)
+	MaxMemoryPages uint32 `json:"max_memory_pages,omitempty"`
+
+	// Maximum time a transformation may take
+	// Default: 1s
+	Timeout caddy.Duration `json:"timeout,omitempty"`
+
+	runtime  wazero.Runtime
+	compiled wazero.CompiledModule
+}
+
+// CaddyModule returns the Caddy module information.
+func (WASM) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.handlers.response_ungzip.filters.wasm",
+		New: func() caddy.Module { return new(WASM) },
+	}
+}
+
+// UnmarshalCaddyfile implements caddyfile.Unmarshaler.
+//
+//	filter wasm <path> {
+//		mime <types...>
+//		max_memory_pages <n>
+//		timeout <duration>
+//	}
+func (f *WASM) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // consume filter name
+	if !d.Args(&f.Path) {
+		return d.ArgErr()
+	}
+	for d.NextBlock(0) {
+		switch d.Val() {
+		case "mime":
+			f.MIMETypes = d.RemainingArgs()
+			if len(f.MIMETypes) == 0 {
+				return d.ArgErr()
+			}
+		case "max_memory_pages":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			n, err := strconv.ParseUint(d.Val(), 10, 32)
+			if err != nil {
+				return d.Errf("invalid max_memory_pages: %v", err)
+			}
+			f.MaxMemoryPages = uint32(n)
+		case "timeout":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			dur, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return d.Errf("invalid timeout: %v", err)
+			}
+			f.Timeout = caddy.Duration(dur)
+		default:
+			return d.Errf("unknown subdirective %s", d.Val())
+		}
+	}
+	return nil
+}
+
+// Provision implements caddy.Provisioner.
+func (f *WASM) Provision(ctx caddy.Context) error {
+	if f.MaxMemoryPages == 0 {
+		f.MaxMemoryPages = 256
+	}
+	if f.Timeout == 0 {
+		f.Timeout = caddy.Duration(time.Second)
+	}
+
+	code, err := os.ReadFile(f.Path)
+	if err != nil {
+		return fmt.Errorf("reading wasm module: %v", err)
+	}
+
+	cfg := wazero.NewRuntimeConfig().
+		WithMemoryLimitPages(f.MaxMemoryPages).
+		WithCloseOnContextDone(true)
+	f.runtime = wazero.NewRuntimeWithConfig(ctx, cfg)
+	if _, err := wasi_snapshot_preview1.Instantiate(ctx, f.runtime); err != nil {
+		return fmt.Errorf("instantiating WASI: %v", err)
+	}
+	f.compiled, err = f.runtime.CompileModule(ctx, code)
+	if err != nil {
+		return fmt.Errorf("compiling wasm module: %v", err)
+	}
+	for _, name := range []string{"alloc", "transform"} {
+		if _, ok := f.compiled.ExportedFunctions()[name]; !ok {
+			return fmt.Errorf("wasm module does not export %s", name)
+		}
+	}
+	return nil
+}
+
+// Validate implements caddy.Validator.
+func (f *WASM) Validate() error {
+	if f.Path == "" {
+		return fmt.Errorf("path is required")
+	}
+	return nil
+}
+
+// Cleanup implements caddy.CleanerUpper.
+func (f *WASM) Cleanup() error {
+	if f.runtime != nil {
+		return f.runtime.Close(context.Background())
+	}
+	return nil
+}
+
+// Filter implements ungzip.Filter.
+func (f *WASM) Filter(req *http.Request, header http.Header, body []byte) ([]byte, error) {
+	if !f.matches(header.Get("Content-Type")) {
+		return body, nil
+	}
+
+	ctx, cancel := context.WithTimeout(req.Context(), time.Duration(f.Timeout))
+	defer cancel()
+
+	mod, err := f.runtime.InstantiateModule(ctx, f.compiled,
+		wazero.NewModuleConfig().WithName("").WithStartFunctions("_initialize"))
+	if err != nil {
+		return nil, fmt.Errorf("instantiating wasm module: %v", err)
+	}
+	defer mod.Close(ctx)
+
+	res, err := mod.ExportedFunction("alloc").Call(ctx, uint64(len(body)))
+	if err != nil {
+		return nil, fmt.Errorf("wasm alloc: %v", err)
+	}
+	ptr := uint32(res[0])
+	if !mod.Memory().Write(ptr, body) {
+		return nil, fmt.Errorf("wasm alloc returned out of range memory")
+	}
+
+	res, err = mod.ExportedFunction("transform").Call(ctx, uint64(ptr), uint64(len(body)))
+	if err != nil {
+		return nil, fmt.Errorf("wasm transform: %v", err)
+	}
+	if res[0] == 0 {
+		return body, nil
+	}
+	out, ok := mod.Memory().Read(uint32(res[0]>>32), uint32(res[0]))
+	if !ok {
+		return nil, fmt.Errorf("wasm transform returned out of range memory")
+	}
+
+	// out is a view of the instance's memory, which is
+	// released when the instance is closed
+	return append([]byte(nil), out...), nil
+}
+
+func (f *WASM) matches(contentType string) bool {
+	if len(f.MIMETypes) == 0 {
+		return true
+	}
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	for _, mt := range f.MIMETypes {
+		if mediaType == mt {
+			return true
+		}
+	}
+	return false
+}
+
+// Interface guards
+var (
+	_ caddy.Provisioner     = (*WASM)(nil)
+	_ caddy.Validator       = (*WASM)(nil)
+	_ caddy.CleanerUpper    = (*WASM)(nil)
+	_ caddyfile.Unmarshaler = (*WASM)(nil)
+	_ ungzip.Filter         = (*WASM)(nil)
+)
@@ -0,0 +1,35 @@
+// Package xz adds the xz content coding to the response_ungzip
+// handler. It lives in its own module so that the decoder is only
+// compiled into Caddy builds that ask for it:
+//
+//	xcaddy build --with github.com/danielballan/caddy-ungzip/xz
+//
+// and is then enabled with the encodings option:
+//
+//	ungzip {
+//		encodings gzip xz
+//	}
+package xz
+
+import (
+	"io"
+
+	"github.com/ulikunitz/xz"
+
+	ungzip "github.com/danielballan/caddy-ungzip"
+)
+
+func init() {
+	ungzip.RegisterDecoder("xz", ungzip.Decoder{
+		Magic:     []byte{0xfd, '7', 'z', 'X', 'Z', 0x00},
+		NewReader: newReader,
+	})
+}
+
+func newReader(src io.Reader) (io.ReadCloser, error) {
+	r, err := xz.NewReader(src)
+	if err != nil {
+		return nil, err
+	}
+	return io.NopCloser(r), nil
+}
@@ -0,0 +1,108 @@
+package ungzip
+
+import (
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// ZstdDictionary is a dictionary, as trained by `zstd --train`, for
+// zstd responses. All configured dictionaries are available when
+// decoding, where the frame header says which one it needs.
+//
+// Responses matching Paths and ContentTypes are also compressed with
+// the dictionary when they are re-encoded as zstd. Clients must
+// already have the dictionary to decode those, so only set them for
+// responses that are consumed by such clients.
+type ZstdDictionary struct {
+	// Path to the dictionary file
+	File string `json:"file"`
+
+	// Re-encode responses from these paths with the dictionary
+	Paths []string `json:"paths,omitempty"`
+
+	// Re-encode responses with these content types with the dictionary
+	ContentTypes []string `json:"content_types,omitempty"`
+
+	encoder *zstd.Encoder
+}
+
+// matches reports whether responses with header to req are to be
+// re-encoded with the dictionary.
+func (zd *ZstdDictionary) matches(req *http.Request, header http.Header) bool {
+	if len(zd.Paths) == 0 && len(zd.ContentTypes) == 0 {
+		return false
+	}
+	return hasPrefixAny(req.URL.Path, zd.Paths) && hasPrefixAny(header.Get("Content-Type"), zd.ContentTypes)
+}
+
+// hasPrefixAny reports whether s starts with any of prefixes, or
+// prefixes is empty.
+func hasPrefixAny(s string, prefixes []string) bool {
+	if len(prefixes) == 0 {
+		return true
+	}
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(s, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// loadZstdDictionaries reads the configured dictionaries, returning
+// their contents for decoding and preparing an encoder for each one
+// that is used for re-encoding.
+func (r *ResponseUngzip) loadZstdDictionaries() error {
+	for i := range r.ZstdDictionaries {
+		zd := &r.ZstdDictionaries[i]
+		dict, err := os.ReadFile(zd.File)
+		if err != nil {
+			return err
+		}
+		// fail now rather than on the first response that needs it
+		dec, err := zstd.NewReader(nil, zstd.WithDecoderDicts(dict))
+		if err != nil {
+			return err
+		}
+		dec.Close()
+		r.zstdDicts = append(r.zstdDicts, dict)
+
+		if len(zd.Paths) > 0 || len(zd.ContentTypes) > 0 {
+			zd.encoder, err = zstd.NewWriter(nil, zstd.WithEncoderDict(dict), zstd.WithEncoderConcurrency(1))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// zstdEncoderFor returns the encoder to re-encode the response with
+// header to req with.
+func (r ResponseUngzip) zstdEncoderFor(req *http.Request, header http.Header) *zstd.Encoder {
+	for i := range r.ZstdDictionaries {
+		if zd := &r.ZstdDictionaries[i]; zd.encoder != nil && zd.matches(req, header) {
+			return zd.encoder
+		}
+	}
+	return r.zstdEncoder
+}
+
+// newZstdReader returns a reader decoding src with the given dictionaries.
+func newZstdReader(src io.Reader, dicts [][]byte) (io.ReadCloser, error) {
+	dec, err := zstd.NewReader(src, zstd.WithDecoderConcurrency(1), zstd.WithDecoderDicts(dicts...))
+	if err != nil {
+		return nil, err
+	}
+	return dec.IOReadCloser(), nil
+}
+
+// newZstdEncoder returns an encoder for use with EncodeAll, which is
+// safe to call concurrently.
+func newZstdEncoder() (*zstd.Encoder, error) {
+	return zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+}